@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/semihalev/log"
+	"github.com/tidwall/redcon"
+)
+
+// ACL denial reasons
+const (
+	aclUser     = "user"
+	aclCommand  = "command"
+	aclCategory = "category"
+	aclKey      = "key"
+)
+
+// deny returns why the user may not run the command, empty when allowed
+func (u *user) deny(ci commandInfo, args [][]byte) string {
+	for _, name := range u.Deny {
+		if strings.EqualFold(name, ci.name) {
+			return aclCommand
+		}
+	}
+
+	if category := ci.category(); category != "" && len(u.Categories) > 0 {
+		allowed := false
+		for _, c := range u.Categories {
+			if strings.EqualFold(c, category) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return aclCategory
+		}
+	}
+
+	if len(u.Keys) > 0 && ci.category() != "" {
+		keys := ci.keys(args)
+		if len(keys) == 0 {
+			var ok bool
+			if keys, ok = keylessArgs(ci, args); !ok {
+				return aclCommand
+			}
+		}
+
+		for _, key := range keys {
+			if !u.matchKey(string(key)) {
+				return aclKey
+			}
+		}
+	}
+
+	return ""
+}
+
+// keylessSpecs are the args of commands without keys the key patterns of a
+// user apply to, from first to last, -1 for the last arg. Index names and
+// patterns and Pub/Sub channels count as keys.
+var keylessSpecs = map[string][2]int{
+	"setindex":   {1, 2},
+	"delindex":   {1, 1},
+	"indexes":    {1, 1},
+	"iter":       {1, 1},
+	"riter":      {1, 1},
+	"rect":       {1, 1},
+	"publish":    {1, 1},
+	"subscribe":  {1, -1},
+	"psubscribe": {1, -1},
+}
+
+// keylessArgs returns the args of a command without keys checked against
+// the key patterns of a user, false when the command may touch any key, so
+// users limited to some keys may not run it. PING and ECHO touch no data.
+func keylessArgs(ci commandInfo, args [][]byte) ([][]byte, bool) {
+	switch ci.name {
+	case "ping", "echo":
+		return nil, true
+	}
+
+	spec, ok := keylessSpecs[ci.name]
+	if !ok {
+		return nil, false
+	}
+
+	first, last := spec[0], spec[1]
+	if last < 0 || last >= len(args) {
+		last = len(args) - 1
+	}
+	if first > last {
+		return nil, false
+	}
+	return args[first : last+1], true
+}
+
+func (u *user) matchKey(key string) bool {
+	for _, pattern := range u.Keys {
+		if strings.HasSuffix(pattern, "*") {
+			if strings.HasPrefix(key, pattern[:len(pattern)-1]) {
+				return true
+			}
+		} else if key == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// aclDeny returns why the session user may not run the command, empty when
+// allowed or when clients don't authenticate
+func aclDeny(conn redcon.Conn, cmd redcon.Command) string {
+	name := getSession(conn).user
+	if name == "" {
+		return ""
+	}
+
+	ci := lookupCommand(qcmdlower(cmd.Args[0]))
+	switch ci.name {
+	case "auth", "quit":
+		return ""
+	}
+
+	u := getConfig().Auth.user(name)
+	if u == nil {
+		return aclUser
+	}
+
+	return u.deny(ci, cmd.Args)
+}
+
+// permitted returns true if the session user may run the command, replies
+// NOPERM otherwise
+func (sb *SummitDBBalancer) permitted(conn redcon.Conn, cmd redcon.Command) bool {
+	reason := aclDeny(conn, cmd)
+	if reason == "" {
+		return true
+	}
+
+	user, name := getSession(conn).user, qcmdlower(cmd.Args[0])
+
+	aclDenied.WithLabelValues(user, reason).Inc()
+	log.Debug("Command denied", "remote", conn.RemoteAddr(), "user", user, "command", name, "reason", reason)
+
+	if reason == aclKey {
+		conn.WriteError("NOPERM this user has no permissions to access one of the keys used as arguments")
+	} else {
+		conn.WriteError(fmt.Sprintf("NOPERM this user has no permissions to run the '%s' command", name))
+	}
+	return false
+}
+
+// pipelinePermitted returns true if the session user may run every command
+// waiting in the client pipeline, so it can be batched
+func pipelinePermitted(conn redcon.Conn) bool {
+	for _, pcmd := range conn.PeekPipeline() {
+		if aclDeny(conn, pcmd) != "" {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/masomo/summitdb-balancer/summitdbtest"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ACL", func() {
+	var app = &user{Name: "app", Categories: []string{"read", "write"}, Keys: []string{"app:*", "shared"}, Deny: []string{"pdel"}}
+
+	DescribeTable("should allow and deny commands",
+		func(u *user, command string, reason string) {
+			args := strings.Fields(command)
+			bargs := make([][]byte, len(args))
+			for i, arg := range args {
+				bargs[i] = []byte(arg)
+			}
+
+			Expect(u.deny(lookupCommand(strings.ToLower(args[0])), bargs)).To(Equal(reason))
+		},
+		Entry("keys in the patterns", app, "mget app:1 shared", ""),
+		Entry("a key outside the patterns", app, "mget app:1 other", aclKey),
+		Entry("a prefix without the pattern separator", app, "get app", aclKey),
+		Entry("a category not allowed", app, "raftstate", aclCategory),
+		Entry("a denied command", app, "pdel app:*", aclCommand),
+		Entry("commands outside categories", app, "multi", ""),
+		Entry("connection commands", app, "ping", ""),
+		Entry("KEYS within the patterns", app, "keys app:*", ""),
+		Entry("KEYS over everything", app, "keys *", aclKey),
+		Entry("FLUSHDB", app, "flushdb", aclCommand),
+		Entry("MASSINSERT", app, "massinsert", aclCommand),
+		Entry("SCRIPT", app, "script flush", aclCommand),
+		Entry("DBSIZE", app, "dbsize", aclCommand),
+		Entry("scripts with declared keys", app, "eval x 1 app:1", ""),
+		Entry("scripts without keys", app, "eval x 0", aclCommand),
+		Entry("indexes over the patterns", app, "setindex app:idx app:* json name", ""),
+		Entry("indexes over everything", app, "setindex app:idx * json name", aclKey),
+		Entry("indexes named outside the patterns", app, "setindex idx app:* json name", aclKey),
+		Entry("iterating an index of the patterns", app, "iter app:idx", ""),
+		Entry("iterating another index", app, "iter idx", aclKey),
+		Entry("rect on another index", app, "rect idx [1] [2]", aclKey),
+		Entry("dropping another index", app, "delindex idx", aclKey),
+		Entry("listing indexes of the patterns", app, "indexes app:*", ""),
+		Entry("listing all indexes", app, "indexes *", aclKey),
+		Entry("iterating without an index", app, "iter", aclCommand),
+		Entry("publishing on a channel of the patterns", app, "publish app:news hi", ""),
+		Entry("publishing on another channel", app, "publish news hi", aclKey),
+		Entry("subscribing to channels of the patterns", app, "subscribe app:a shared", ""),
+		Entry("subscribing to another channel", app, "subscribe app:a news", aclKey),
+		Entry("subscribing to all channels", app, "psubscribe *", aclKey),
+		Entry("keyless commands without key patterns", &user{Name: "ops"}, "flushdb", ""),
+		Entry("any key without key patterns", &user{Name: "ops"}, "keys *", ""),
+	)
+
+	Context("through the proxy", func() {
+		var cluster *summitdbtest.Cluster
+		var p *proxy
+		var client redis.Conn
+
+		BeforeEach(func() {
+			var err error
+			cluster, err = summitdbtest.NewCluster(2)
+			Expect(err).NotTo(HaveOccurred())
+
+			p = startClusterProxy(&Config{
+				Auth:         auth{Users: []user{{Name: "app", Password: "s3", Keys: []string{"app:*"}}}},
+				LoadBalancer: loadBalancer{MaxIdle: 4, Routing: true},
+			}, cluster)
+
+			client, err = p.dial()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(client.Do("AUTH", "app", "s3")).To(Equal("OK"))
+		})
+
+		AfterEach(func() {
+			client.Close()
+			p.close()
+			Expect(cluster.Close()).To(Succeed())
+		})
+
+		It("should reply NOPERM without reaching the backend", func() {
+			Expect(client.Do("SET", "app:1", "1")).To(Equal("OK"))
+
+			_, err := client.Do("SET", "other", "1")
+			Expect(err).To(MatchError("NOPERM this user has no permissions to access one of the keys used as arguments"))
+
+			_, err = client.Do("FLUSHDB")
+			Expect(err).To(MatchError("NOPERM this user has no permissions to run the 'flushdb' command"))
+
+			Expect(cluster.Nodes[0].Count("set")).To(Equal(1))
+			Expect(cluster.Nodes[0].Count("flushdb")).To(BeZero())
+		})
+
+		It("should deny commands of a pipeline one by one", func() {
+			client.Send("SET", "app:1", "1")
+			client.Send("SET", "other", "1")
+			client.Send("GET", "app:1")
+			Expect(client.Flush()).To(Succeed())
+
+			Expect(client.Receive()).To(Equal("OK"))
+			_, err := client.Receive()
+			Expect(err).To(MatchError(HavePrefix("NOPERM")))
+			Expect(redis.String(client.Receive())).To(Equal("1"))
+		})
+	})
+})
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/masomo/summitdb-balancer/balancer"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/semihalev/log"
+)
+
+// adminStatus is the reply of the status endpoint
+type adminStatus struct {
+	Version  string                  `json:"version"`
+	Mode     string                  `json:"mode"`
+	Routing  bool                    `json:"routing"`
+	Backends []balancer.BackendStats `json:"backends"`
+	Shards   []adminShard            `json:"shards"`
+}
+
+// adminShard lists the backends of a shard
+type adminShard struct {
+	Name     string   `json:"name"`
+	Backends []string `json:"backends"`
+}
+
+// stats returns the backends of all shards
+func (sb *SummitDBBalancer) stats() []balancer.BackendStats {
+	var stats []balancer.BackendStats
+	for _, sh := range sb.shards().shards {
+		stats = append(stats, sh.balancer.Stats()...)
+	}
+	return stats
+}
+
+func (sb *SummitDBBalancer) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/status", sb.adminStatus)
+	mux.HandleFunc("/backends", sb.adminBackends)
+	mux.HandleFunc("/backends/drain", sb.adminBackendState)
+	mux.HandleFunc("/backends/enable", sb.adminBackendState)
+	mux.HandleFunc("/mode", sb.adminMode)
+	mux.HandleFunc("/ratelimits", sb.adminRateLimits)
+	mux.Handle("/metrics", promhttp.Handler())
+
+	return mux
+}
+
+// GET /status
+func (sb *SummitDBBalancer) adminStatus(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	set := sb.shards()
+
+	status := adminStatus{
+		Version:  version,
+		Mode:     set.shards[0].balancer.Mode().String(),
+		Routing:  set.shards[0].balancer.Routing(),
+		Backends: sb.stats(),
+	}
+
+	for _, sh := range set.shards {
+		shard := adminShard{Name: sh.name}
+		for _, stats := range sh.balancer.Stats() {
+			shard.Backends = append(shard.Backends, stats.Addr)
+		}
+		status.Shards = append(status.Shards, shard)
+	}
+
+	writeJSON(w, http.StatusOK, status)
+}
+
+// GET /backends
+func (sb *SummitDBBalancer) adminBackends(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, sb.stats())
+}
+
+// POST /backends/drain?addr=host:port
+// POST /backends/enable?addr=host:port
+func (sb *SummitDBBalancer) adminBackendState(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	addr := r.URL.Query().Get("addr")
+
+	// the backend is in one of the shards
+	var err error
+	for _, sh := range sb.shards().shards {
+		if r.URL.Path == "/backends/drain" {
+			err = sh.balancer.Disable(addr)
+		} else {
+			err = sh.balancer.Enable(addr)
+		}
+
+		if err == nil {
+			break
+		}
+	}
+
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, sb.stats())
+}
+
+// GET /mode
+// POST /mode?mode=roundrobin
+func (sb *SummitDBBalancer) adminMode(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet, http.MethodPost) {
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		mode, err := balancer.ParseMode(r.URL.Query().Get("mode"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		for _, sh := range sb.shards().shards {
+			sh.balancer.SetMode(mode)
+		}
+		log.Info("Balance mode changed", "mode", mode.String(), "remote", r.RemoteAddr)
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{"mode": sb.shards().shards[0].balancer.Mode().String()})
+}
+
+// GET /ratelimits
+func (sb *SummitDBBalancer) adminRateLimits(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, limits.state())
+}
+
+func allowMethod(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, method := range methods {
+		if r.Method == method {
+			return true
+		}
+	}
+
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+	return false
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Error("Admin reply failed", "error", err.Error())
+	}
+}
+
+func runAdmin(sb *SummitDBBalancer, addr string) {
+	log.Info("Admin http listener started", "addr", addr)
+
+	err := http.ListenAndServe(addr, sb.adminHandler())
+	if err != nil {
+		log.Error("Admin http listener failed", "error", err.Error())
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/masomo/summitdb-balancer/balancer"
+	"github.com/masomo/summitdb-balancer/summitdbtest"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("admin API", func() {
+	var cluster *summitdbtest.Cluster
+	var p *proxy
+	var client redis.Conn
+	var server *httptest.Server
+
+	// call sends the request and decodes the JSON reply into v
+	var call = func(method, path string, query url.Values, v interface{}) *http.Response {
+		req, err := http.NewRequest(method, server.URL+path+"?"+query.Encode(), nil)
+		Expect(err).NotTo(HaveOccurred())
+
+		resp, err := http.DefaultClient.Do(req)
+		Expect(err).NotTo(HaveOccurred())
+		defer resp.Body.Close()
+
+		Expect(resp.Header.Get("Content-Type")).To(Equal("application/json"))
+		Expect(json.NewDecoder(resp.Body).Decode(v)).To(Succeed())
+		return resp
+	}
+
+	var addr = func(node int) url.Values { return url.Values{"addr": {cluster.Nodes[node].Addr()}} }
+
+	// backend returns the stats of the node
+	var backend = func(stats []balancer.BackendStats, node int) balancer.BackendStats {
+		for _, s := range stats {
+			if s.Addr == cluster.Nodes[node].Addr() {
+				return s
+			}
+		}
+		Fail("no stats for node")
+		return balancer.BackendStats{}
+	}
+
+	BeforeEach(func() {
+		limits = newLimiter()
+
+		var err error
+		cluster, err = summitdbtest.NewCluster(3)
+		Expect(err).NotTo(HaveOccurred())
+
+		r := rateLimits{Global: rateLimit{Reads: 100}}
+		Expect(r.parse()).To(Succeed())
+		p = startClusterProxy(&Config{RateLimit: r, LoadBalancer: loadBalancer{MaxIdle: 4, Routing: true}}, cluster)
+
+		client, err = p.dial()
+		Expect(err).NotTo(HaveOccurred())
+
+		server = httptest.NewServer(p.sb.adminHandler())
+	})
+
+	AfterEach(func() {
+		server.Close()
+		client.Close()
+		p.close()
+		Expect(cluster.Close()).To(Succeed())
+	})
+
+	DescribeTable("should reject other methods",
+		func(method, path, allow string) {
+			var reply map[string]string
+			resp := call(method, path, nil, &reply)
+
+			Expect(resp.StatusCode).To(Equal(http.StatusMethodNotAllowed))
+			Expect(resp.Header.Get("Allow")).To(Equal(allow))
+			Expect(reply).To(Equal(map[string]string{"error": "method not allowed"}))
+		},
+		Entry("on /status", http.MethodPost, "/status", "GET"),
+		Entry("on /backends", http.MethodDelete, "/backends", "GET"),
+		Entry("on /backends/drain", http.MethodGet, "/backends/drain", "POST"),
+		Entry("on /backends/enable", http.MethodGet, "/backends/enable", "POST"),
+		Entry("on /mode", http.MethodPut, "/mode", "GET, POST"),
+		Entry("on /ratelimits", http.MethodPost, "/ratelimits", "GET"),
+	)
+
+	It("should report the status", func() {
+		var status adminStatus
+		resp := call(http.MethodGet, "/status", nil, &status)
+
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(status.Version).To(Equal(version))
+		Expect(status.Mode).To(Equal("roundrobin"))
+		Expect(status.Routing).To(BeTrue())
+		Expect(status.Backends).To(HaveLen(3))
+		Expect(backend(status.Backends, 0).Leader).To(BeTrue())
+		Expect(status.Shards).To(Equal([]adminShard{{Name: defaultShard, Backends: cluster.Addrs()}}))
+	})
+
+	It("should list the backends", func() {
+		var stats []balancer.BackendStats
+		resp := call(http.MethodGet, "/backends", nil, &stats)
+
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(stats).To(HaveLen(3))
+		for i := range cluster.Nodes {
+			Expect(backend(stats, i).Up).To(BeTrue())
+		}
+	})
+
+	It("should drain and enable backends", func() {
+		var stats []balancer.BackendStats
+		resp := call(http.MethodPost, "/backends/drain", addr(1), &stats)
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(backend(stats, 1).Disabled).To(BeTrue())
+		Expect(backend(stats, 1).Up).To(BeFalse())
+
+		// a drained backend gets no reads
+		for _, node := range cluster.Nodes {
+			node.ResetCounts()
+		}
+		for i := 0; i < 6; i++ {
+			Expect(client.Do("GET", "a")).To(BeNil())
+		}
+		Expect(cluster.Nodes[1].Count("get")).To(BeZero())
+
+		resp = call(http.MethodPost, "/backends/enable", addr(1), &stats)
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(backend(stats, 1).Disabled).To(BeFalse())
+		Expect(backend(stats, 1).Up).To(BeTrue())
+	})
+
+	DescribeTable("should reply not found for unknown backends",
+		func(path string, query url.Values) {
+			var reply map[string]string
+			resp := call(http.MethodPost, path, query, &reply)
+
+			Expect(resp.StatusCode).To(Equal(http.StatusNotFound))
+			Expect(reply).To(Equal(map[string]string{"error": balancer.ErrUnknownBackend.Error()}))
+		},
+		Entry("when draining", "/backends/drain", url.Values{"addr": {"127.0.0.1:1"}}),
+		Entry("when enabling", "/backends/enable", url.Values{"addr": {"127.0.0.1:1"}}),
+		Entry("without an address", "/backends/drain", nil),
+	)
+
+	It("should report and change the balance mode", func() {
+		var reply map[string]string
+		resp := call(http.MethodGet, "/mode", nil, &reply)
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(reply).To(Equal(map[string]string{"mode": "roundrobin"}))
+
+		resp = call(http.MethodPost, "/mode", url.Values{"mode": {"leastconn"}}, &reply)
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(reply).To(Equal(map[string]string{"mode": "leastconn"}))
+		Expect(p.sb.shards().shards[0].balancer.Mode()).To(Equal(balancer.ModeLeastConn))
+	})
+
+	It("should reject unknown balance modes", func() {
+		for _, mode := range []string{"fastest", ""} {
+			var reply map[string]string
+			resp := call(http.MethodPost, "/mode", url.Values{"mode": {mode}}, &reply)
+
+			Expect(resp.StatusCode).To(Equal(http.StatusBadRequest))
+			Expect(reply).To(Equal(map[string]string{"error": "unknown balance mode '" + mode + "'"}))
+		}
+		Expect(p.sb.shards().shards[0].balancer.Mode()).To(Equal(balancer.ModeRoundRobin))
+	})
+
+	It("should report the rate limits", func() {
+		Expect(client.Do("GET", "a")).To(BeNil())
+
+		var state []limiterState
+		resp := call(http.MethodGet, "/ratelimits", nil, &state)
+
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(state).To(HaveLen(1))
+		Expect(state[0].Scope).To(Equal("global"))
+		Expect(state[0].Class).To(Equal("read"))
+		Expect(state[0].Allowed).To(BeEquivalentTo(1))
+	})
+
+	It("should expose the metrics", func() {
+		Expect(client.Do("GET", "a")).To(BeNil())
+
+		resp, err := http.Get(server.URL + "/metrics")
+		Expect(err).NotTo(HaveOccurred())
+		defer resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+		body, err := ioutil.ReadAll(resp.Body)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(body)).To(ContainSubstring(metricPrefix + "_backend_commands_total"))
+		Expect(string(body)).To(ContainSubstring(metricPrefix + "_command_duration_seconds"))
+	})
+})
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+
+	metrics "github.com/rcrowley/go-metrics"
+	"github.com/semihalev/log"
+	"github.com/tidwall/redcon"
+)
+
+// defaultUser is the user authenticated by AUTH <password>
+const defaultUser = "default"
+
+// auth configures client authentication, clients must AUTH before any
+// other command once a password or a user is set
+type auth struct {
+	// Password authenticates the default user
+	Password string
+	Users    []user
+}
+
+// user is a client account, the ACL fields are empty for full access
+type user struct {
+	Name     string
+	Password string
+
+	// Categories are the command categories allowed: read, write, admin
+	Categories []string
+
+	// Keys are the key patterns allowed, a trailing * matches a prefix
+	Keys []string
+
+	// Deny lists commands the user may not run
+	Deny []string
+}
+
+// user returns the user with the given name, nil when it no longer exists
+func (a *auth) user(name string) *user {
+	for i := range a.Users {
+		if a.Users[i].Name == name {
+			return &a.Users[i]
+		}
+	}
+
+	if name == defaultUser && a.Password != "" {
+		return &user{Name: defaultUser, Password: a.Password}
+	}
+	return nil
+}
+
+// required returns true if clients must authenticate
+func (a *auth) required() bool { return a.Password != "" || len(a.Users) > 0 }
+
+// lookup returns the user matching the credentials
+func (a *auth) lookup(name, password string) (*user, bool) {
+	if name == defaultUser && a.Password != "" && secureCompare(a.Password, password) {
+		return &user{Name: defaultUser, Password: a.Password}, true
+	}
+
+	for i := range a.Users {
+		u := &a.Users[i]
+		if u.Name == name && secureCompare(u.Password, password) {
+			return u, true
+		}
+	}
+
+	return nil, false
+}
+
+func secureCompare(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// authenticated returns true if the connection may run the command, replies
+// NOAUTH otherwise. AUTH and QUIT are always allowed.
+func (sb *SummitDBBalancer) authenticated(conn redcon.Conn, cmd redcon.Command) bool {
+	if getSession(conn).user != "" || !getConfig().Auth.required() {
+		return true
+	}
+
+	switch qcmdlower(cmd.Args[0]) {
+	case "auth", "quit":
+		return true
+	}
+
+	conn.WriteError("NOAUTH Authentication required.")
+	return false
+}
+
+// auth handles AUTH [username] password
+func (sb *SummitDBBalancer) auth(conn redcon.Conn, cmd redcon.Command) {
+	a := getConfig().Auth
+
+	var name, password string
+	switch len(cmd.Args) {
+	case 2:
+		name, password = defaultUser, string(cmd.Args[1])
+	case 3:
+		name, password = string(cmd.Args[1]), string(cmd.Args[2])
+	default:
+		conn.WriteError("ERR wrong number of arguments for 'auth' command")
+		return
+	}
+
+	if !a.required() {
+		conn.WriteError("ERR AUTH called without any password configured for the default user. Are you sure your configuration is correct?")
+		return
+	}
+
+	u, ok := a.lookup(name, password)
+	if !ok {
+		authFailedMetric := metrics.GetOrRegisterMeter(fmt.Sprintf("%s.auth.failed", metricPrefix), nil)
+		authFailedMetric.Mark(1)
+
+		log.Warn("Authentication failed", "remote", conn.RemoteAddr(), "user", name)
+		conn.WriteError("WRONGPASS invalid username-password pair or user is disabled.")
+		return
+	}
+
+	getSession(conn).user = u.Name
+	conn.WriteString("OK")
+}
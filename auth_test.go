@@ -0,0 +1,79 @@
+package main
+
+import (
+	"github.com/gomodule/redigo/redis"
+	"github.com/masomo/summitdb-balancer/summitdbtest"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("auth", func() {
+	var cluster *summitdbtest.Cluster
+	var p *proxy
+	var client redis.Conn
+
+	var start = func(a auth) {
+		p = startClusterProxy(&Config{Auth: a, LoadBalancer: loadBalancer{MaxIdle: 4, Routing: true}}, cluster)
+
+		var err error
+		client, err = p.dial()
+		Expect(err).NotTo(HaveOccurred())
+	}
+
+	BeforeEach(func() {
+		var err error
+		cluster, err = summitdbtest.NewCluster(2)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		client.Close()
+		p.close()
+		Expect(cluster.Close()).To(Succeed())
+	})
+
+	It("should serve everyone without credentials configured", func() {
+		start(auth{})
+
+		Expect(client.Do("SET", "a", "1")).To(Equal("OK"))
+
+		_, err := client.Do("AUTH", "secret")
+		Expect(err).To(MatchError(HavePrefix("ERR AUTH called without any password configured")))
+	})
+
+	It("should require AUTH before other commands", func() {
+		start(auth{Password: "secret"})
+
+		_, err := client.Do("GET", "a")
+		Expect(err).To(MatchError("NOAUTH Authentication required."))
+		_, err = client.Do("MONITOR")
+		Expect(err).To(MatchError("NOAUTH Authentication required."))
+		Expect(cluster.Nodes[1].Count("get")).To(BeZero())
+
+		_, err = client.Do("AUTH", "wrong")
+		Expect(err).To(MatchError("WRONGPASS invalid username-password pair or user is disabled."))
+		_, err = client.Do("AUTH", "a", "b", "c")
+		Expect(err).To(MatchError("ERR wrong number of arguments for 'auth' command"))
+
+		Expect(client.Do("AUTH", "secret")).To(Equal("OK"))
+		Expect(client.Do("GET", "a")).To(BeNil())
+	})
+
+	It("should authenticate users by name", func() {
+		start(auth{Users: []user{{Name: "app", Password: "s3"}}})
+
+		_, err := client.Do("AUTH", "default", "s3")
+		Expect(err).To(MatchError(HavePrefix("WRONGPASS")))
+		_, err = client.Do("AUTH", "s3")
+		Expect(err).To(MatchError(HavePrefix("WRONGPASS")))
+
+		Expect(client.Do("AUTH", "app", "s3")).To(Equal("OK"))
+		Expect(client.Do("GET", "a")).To(BeNil())
+	})
+
+	It("should allow QUIT without AUTH", func() {
+		start(auth{Password: "secret"})
+
+		Expect(client.Do("QUIT")).To(Equal("OK"))
+	})
+})
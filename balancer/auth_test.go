@@ -0,0 +1,74 @@
+package balancer
+
+import (
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/tidwall/redcon"
+)
+
+var _ = Describe("backend auth", func() {
+	var addr string
+	var server *redcon.Server
+
+	BeforeEach(func() {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+		addr = ln.Addr().String()
+		ln.Close()
+
+		// RAFTSTATE only answers after AUTH app secret
+		server = redcon.NewServer(addr, func(conn redcon.Conn, cmd redcon.Command) {
+			switch strings.ToLower(string(cmd.Args[0])) {
+			case "auth":
+				if len(cmd.Args) == 3 && string(cmd.Args[1]) == "app" && string(cmd.Args[2]) == "secret" {
+					conn.SetContext(true)
+					conn.WriteString("OK")
+					return
+				}
+				conn.WriteError("WRONGPASS invalid username-password pair")
+			case "raftstate":
+				if conn.Context() == nil {
+					conn.WriteError("NOAUTH Authentication required.")
+					return
+				}
+				conn.WriteBulkString("Follower")
+			}
+		}, nil, nil)
+
+		signal := make(chan error)
+		go server.ListenServeAndSignal(signal)
+		Expect(<-signal).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	var check = func(username, password string) *redisBackend {
+		opt := mockOpts(addr)
+		opt.CheckInterval = time.Hour
+		opt.Username, opt.Password = username, password
+
+		rb := newRedisBackend(opt)
+		rb.Close()
+		return rb
+	}
+
+	It("should authenticate new connections", func() {
+		rb := check("app", "secret")
+		Expect(atomic.LoadInt32(&rb.successes)).To(BeEquivalentTo(1))
+	})
+
+	It("should fail backends with wrong credentials", func() {
+		rb := check("app", "wrong")
+		Expect(atomic.LoadInt32(&rb.failures)).To(BeEquivalentTo(1))
+
+		rb = check("", "")
+		Expect(atomic.LoadInt32(&rb.failures)).To(BeEquivalentTo(1))
+	})
+})
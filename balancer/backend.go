@@ -12,10 +12,14 @@ import (
 // Redis backend
 type redisBackend struct {
 	client *redis.Pool
+	raw    *RawPool
 	opt    *Options
 
 	up, successes, failures, leader int32
-	connections, latency            int64
+	disabled                        int32
+	connections, latency, ejected   int64
+
+	outlier outlier
 
 	closer tomb.Tomb
 }
@@ -26,16 +30,48 @@ type Backend struct {
 	Connections int64
 	Latency     time.Duration
 	Status      bool
+	Leader      bool
 	Pool        *redis.Pool
+
+	// Raw holds connections for relaying undecoded RESP
+	Raw *RawPool
+}
+
+// BackendStats is a snapshot of a backend state
+type BackendStats struct {
+	Addr        string        `json:"addr"`
+	Up          bool          `json:"up"`
+	Healthy     bool          `json:"healthy"`
+	Leader      bool          `json:"leader"`
+	Disabled    bool          `json:"disabled"`
+	Ejected     bool          `json:"ejected"`
+	Latency     time.Duration `json:"latency"`
+	Connections int64         `json:"connections"`
+	Active      int           `json:"active"`
+	Idle        int           `json:"idle"`
+	Successes   int           `json:"successes"`
+	Failures    int           `json:"failures"`
+	Rise        int           `json:"rise"`
+	Fall        int           `json:"fall"`
 }
 
 func newRedisBackend(opt *Options) *redisBackend {
+	dialOpts, err := opt.dialOptions()
+	if err != nil {
+		// the backend stays down until the config is fixed
+		log.Error("Backend TLS config failed", "node", opt.Addr, "error", err.Error())
+	}
+
 	backend := &redisBackend{
 		client: &redis.Pool{
 			MaxIdle:     opt.MaxIdle,
 			IdleTimeout: time.Minute,
 			Dial: func() (redis.Conn, error) {
-				c, err := redis.Dial(opt.Network, opt.Addr)
+				if err != nil {
+					return nil, err
+				}
+
+				c, err := redis.Dial(opt.Network, opt.Addr, dialOpts...)
 				if err != nil {
 					return nil, err
 				}
@@ -49,6 +85,7 @@ func newRedisBackend(opt *Options) *redisBackend {
 				return err
 			},
 		},
+		raw: newRawPool(opt),
 		opt: opt,
 		up:  0,
 
@@ -60,8 +97,14 @@ func newRedisBackend(opt *Options) *redisBackend {
 	return backend
 }
 
-// Up returns true if up
-func (b *redisBackend) Up() bool { return atomic.LoadInt32(&b.up) > 0 }
+// Up returns true if healthy, not disabled and not ejected
+func (b *redisBackend) Up() bool { return b.healthy() && !b.Disabled() && !b.Ejected() }
+
+// healthy returns true if the health checks passed
+func (b *redisBackend) healthy() bool { return atomic.LoadInt32(&b.up) > 0 }
+
+// Disabled returns true if the backend was drained by an admin
+func (b *redisBackend) Disabled() bool { return atomic.LoadInt32(&b.disabled) > 0 }
 
 // Down returns true if down
 func (b *redisBackend) Down() bool { return !b.Up() }
@@ -78,19 +121,94 @@ func (b *redisBackend) Leader() bool { return atomic.LoadInt32(&b.leader) > 0 }
 // Addr returns addr
 func (b *redisBackend) Addr() string { return b.opt.Addr }
 
+// backend returns the public view of the backend
+func (b *redisBackend) backend() *Backend {
+	return &Backend{
+		Addr:        b.Addr(),
+		Pool:        b.client,
+		Raw:         b.raw,
+		Connections: b.Connections(),
+		Latency:     b.Latency(),
+		Status:      b.Up(),
+		Leader:      b.Leader(),
+	}
+}
+
 // Close shuts down the backend
 func (b *redisBackend) Close() error {
 	b.closer.Kill(nil)
 	return b.closer.Wait()
 }
 
+// inherit copies the health state of a backend being replaced
+func (b *redisBackend) inherit(old *redisBackend) {
+	atomic.StoreInt32(&b.up, atomic.LoadInt32(&old.up))
+	atomic.StoreInt32(&b.leader, atomic.LoadInt32(&old.leader))
+	atomic.StoreInt64(&b.latency, atomic.LoadInt64(&old.latency))
+	atomic.StoreInt32(&b.disabled, atomic.LoadInt32(&old.disabled))
+	atomic.StoreInt64(&b.ejected, atomic.LoadInt64(&old.ejected))
+}
+
+// stats returns a snapshot of the backend state
+func (b *redisBackend) stats() BackendStats {
+	stats := BackendStats{
+		Addr:        b.Addr(),
+		Up:          b.Up(),
+		Healthy:     b.healthy(),
+		Leader:      b.Leader(),
+		Disabled:    b.Disabled(),
+		Ejected:     b.Ejected(),
+		Latency:     b.Latency(),
+		Connections: b.Connections(),
+		Successes:   int(atomic.LoadInt32(&b.successes)),
+		Failures:    int(atomic.LoadInt32(&b.failures)),
+		Rise:        b.opt.getRise(),
+		Fall:        b.opt.getFall(),
+	}
+
+	if b.client != nil {
+		stats.Idle = b.client.IdleCount()
+		stats.Active = b.borrowed()
+	}
+
+	return stats
+}
+
+// borrowed returns the number of connections in use, the pool counts idle
+// connections as active
+func (b *redisBackend) borrowed() int {
+	return b.client.ActiveCount() - b.client.IdleCount()
+}
+
+// drain waits for borrowed connections to be returned, then closes the backend
+func (b *redisBackend) drain(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for b.borrowed() > 0 && time.Now().Before(deadline) {
+		time.Sleep(minCheckInterval)
+	}
+
+	if n := b.borrowed(); n > 0 {
+		log.Warn("Backend drain timed out", "node", b.Addr(), "active", n)
+	}
+
+	if err := b.Close(); err != nil {
+		log.Error("Backend close failed", "node", b.Addr(), "error", err.Error())
+	}
+}
+
 func (b *redisBackend) checkBackend() {
 	start := time.Now()
 
+	result := "fail"
+	defer func() {
+		checkDuration.WithLabelValues(b.Addr()).Observe(time.Since(start).Seconds())
+		checksTotal.WithLabelValues(b.Addr(), result).Inc()
+	}()
+
 	conn := b.client.Get()
 	defer conn.Close()
 
-	reply, err := conn.Do("RAFTSTATE")
+	reply, err := redis.DoWithTimeout(conn, b.opt.getCheckTimeout(), "RAFTSTATE")
 	if err != nil {
 		log.Error("Backend Down, check got error", "node", b.Addr(), "error", err.Error())
 		b.updateStatus(false)
@@ -101,15 +219,9 @@ func (b *redisBackend) checkBackend() {
 	if state, ok := reply.([]byte); ok {
 		switch string(state) {
 		case "Leader":
-			if !b.Leader() {
-				log.Info("Backend state changed", "node", b.Addr(), "state", string(state))
-			}
-			atomic.CompareAndSwapInt32(&b.leader, 0, 1)
+			b.setLeader(true)
 		case "Follower":
-			if b.Leader() {
-				log.Info("Backend state changed", "node", b.Addr(), "state", string(state))
-			}
-			atomic.CompareAndSwapInt32(&b.leader, 1, 0)
+			b.setLeader(false)
 		default:
 			atomic.CompareAndSwapInt32(&b.leader, 1, 0)
 			b.updateStatus(false)
@@ -117,14 +229,16 @@ func (b *redisBackend) checkBackend() {
 			return
 		}
 
-		if !b.Up() && int(atomic.AddInt32(&b.successes, 1)) == b.opt.getFall()-1 {
-			log.Info("Backend UP", "node", b.Addr(), "state", string(state))
-		}
-
 		atomic.StoreInt64(&b.latency, int64(time.Now().Sub(start)))
 		atomic.StoreInt64(&b.connections, int64(b.client.ActiveCount()))
 
+		result = "ok"
+
+		down := !b.healthy()
 		b.updateStatus(true)
+		if down && b.healthy() {
+			log.Info("Backend UP", "node", b.Addr(), "state", string(state))
+		}
 
 		return
 	}
@@ -134,6 +248,20 @@ func (b *redisBackend) checkBackend() {
 	b.updateStatus(false)
 }
 
+func (b *redisBackend) setLeader(leader bool) {
+	if leader {
+		if atomic.CompareAndSwapInt32(&b.leader, 0, 1) {
+			log.Info("Backend state changed", "node", b.Addr(), "state", "Leader")
+			leaderChanges.WithLabelValues(b.Addr()).Inc()
+		}
+		return
+	}
+
+	if atomic.CompareAndSwapInt32(&b.leader, 1, 0) {
+		log.Info("Backend state changed", "node", b.Addr(), "state", "Follower")
+	}
+}
+
 func (b *redisBackend) incConnections(n int64) {
 	atomic.AddInt64(&b.connections, n)
 }
@@ -168,6 +296,7 @@ func (b *redisBackend) startLoop() {
 		for {
 			select {
 			case <-b.closer.Dying():
+				b.raw.close()
 				return b.client.Close()
 			case <-time.After(interval):
 				b.checkBackend()
@@ -3,22 +3,32 @@ package balancer
 import (
 	"time"
 
+	"github.com/masomo/summitdb-balancer/summitdbtest"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 )
 
 var _ = Describe("redisBackend", func() {
 	var subject *redisBackend
+	var server *summitdbtest.Server
 
 	BeforeEach(func() {
+		var err error
+		server, err = summitdbtest.NewServer()
+		Expect(err).NotTo(HaveOccurred())
+
 		subject = newRedisBackend(&Options{
-			Addr:    "127.0.0.1:7481",
+			Addr:    server.Addr(),
 			Network: "tcp",
 			Rise:    2})
+
+		// the first check ran on start, rise 2 takes another
+		subject.checkBackend()
 	})
 
 	AfterEach(func() {
 		Expect(subject.Close()).NotTo(HaveOccurred())
+		Expect(server.Close()).To(Succeed())
 	})
 
 	It("should ping periodically", func() {
@@ -44,4 +54,68 @@ var _ = Describe("redisBackend", func() {
 		Expect(subject.Up()).To(BeTrue())
 	})
 
+	It("should rise after as many checks as rise", func() {
+		for rise := 1; rise <= 3; rise++ {
+			rb := newRedisBackend(&Options{Addr: server.Addr(), Network: "tcp", CheckInterval: time.Hour, Rise: rise})
+			for i := 1; i < rise; i++ {
+				Expect(rb.Up()).To(BeFalse())
+				rb.checkBackend()
+			}
+			Expect(rb.Up()).To(BeTrue())
+			Expect(rb.Close()).To(Succeed())
+		}
+	})
+
+	It("should fall after as many failed checks as fall", func() {
+		rb := newRedisBackend(&Options{Addr: server.Addr(), Network: "tcp", CheckInterval: time.Hour, Fall: 2})
+		defer rb.Close()
+		Expect(rb.Up()).To(BeTrue())
+
+		server.SetFault("raftstate", summitdbtest.Fault{Error: "ERR boom"})
+		rb.checkBackend()
+		Expect(rb.Up()).To(BeTrue())
+		rb.checkBackend()
+		Expect(rb.Up()).To(BeFalse())
+
+		server.ClearFaults()
+		rb.checkBackend()
+		Expect(rb.Up()).To(BeTrue())
+	})
+
+	It("should close a drained backend with only idle connections right away", func() {
+		rb := newRedisBackend(&Options{Addr: server.Addr(), Network: "tcp", CheckInterval: time.Hour, MaxIdle: 2})
+
+		conn := rb.client.Get()
+		Expect(conn.Do("PING")).To(Equal("PONG"))
+		Expect(conn.Close()).To(Succeed())
+		Expect(rb.client.IdleCount()).To(Equal(1))
+
+		start := time.Now()
+		rb.drain(time.Minute)
+		Expect(time.Since(start)).To(BeNumerically("<", time.Second))
+		Expect(rb.closer.Alive()).To(BeFalse())
+	})
+
+	It("should close a drained backend once borrowed connections are returned", func() {
+		rb := newRedisBackend(&Options{Addr: server.Addr(), Network: "tcp", CheckInterval: time.Hour, MaxIdle: 2})
+
+		conn := rb.client.Get()
+		Expect(conn.Do("PING")).To(Equal("PONG"))
+
+		drained := make(chan struct{})
+		go func() {
+			rb.drain(time.Minute)
+			close(drained)
+		}()
+
+		// the borrowed connection keeps serving while the backend drains
+		Consistently(drained, 3*minCheckInterval).ShouldNot(BeClosed())
+		Expect(rb.stats().Active).To(Equal(1))
+		Expect(conn.Do("SET", "a", "1")).To(Equal("OK"))
+
+		Expect(conn.Close()).To(Succeed())
+		Eventually(drained, time.Second).Should(BeClosed())
+		Expect(rb.closer.Alive()).To(BeFalse())
+	})
+
 })
@@ -1,13 +1,22 @@
 package balancer
 
 import (
+	"errors"
+	"fmt"
+	"sync"
 	"sync/atomic"
 	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/semihalev/log"
 )
 
 // BalanceMode type
 type BalanceMode int
 
+// ErrUnknownBackend is returned for addresses that are not in the pool
+var ErrUnknownBackend = errors.New("unknown backend")
+
 const (
 	// ModeLeastConn picks the backend with the fewest connections.
 	ModeLeastConn BalanceMode = iota
@@ -23,13 +32,50 @@ const (
 	ModeRoundRobin
 )
 
+var modeNames = map[BalanceMode]string{
+	ModeLeastConn:       "leastconn",
+	ModeFirstUp:         "firstup",
+	ModeMinLatency:      "minlatency",
+	ModeRandom:          "random",
+	ModeWeightedLatency: "weightedlatency",
+	ModeRoundRobin:      "roundrobin",
+}
+
+// ParseMode returns the balance mode with the given name
+func ParseMode(name string) (BalanceMode, error) {
+	for mode, n := range modeNames {
+		if n == name {
+			return mode, nil
+		}
+	}
+	return ModeLeastConn, fmt.Errorf("unknown balance mode '%s'", name)
+}
+
+func (m BalanceMode) String() string {
+	if name, ok := modeNames[m]; ok {
+		return name
+	}
+	return "unknown"
+}
+
 const (
 	metricPrefix     = "balancer"
 	minCheckInterval = 100 * time.Millisecond
+
+	// drainTimeout is the time given to removed backends to finish in-flight commands
+	drainTimeout = 30 * time.Second
 )
 
 // Balancer client
 type Balancer struct {
+	mu       sync.RWMutex
+	updateMu sync.Mutex
+
+	discovery *discovery
+
+	// seeds are the configured backend addresses, discovery keeps them
+	seeds []string
+
 	selector pool
 	mode     BalanceMode
 	cursor   int32
@@ -52,20 +98,214 @@ func New(opts []*Options, routing bool, mode BalanceMode) *Balancer {
 		routing:  routing,
 	}
 	for i, opt := range opts {
-		if opt.MaxIdle == 0 {
-			opt.MaxIdle = 1
+		balancer.selector[i] = newRedisBackend(opt.withDefaults())
+		balancer.seeds = append(balancer.seeds, opt.Addr)
+	}
+	return balancer
+}
+
+// Update applies a new set of backends and settings to a running balancer.
+// Backends with unchanged options are kept, changed ones are replaced and
+// inherit the health state of the old backend, removed ones are drained and
+// closed in the background.
+func (b *Balancer) Update(opts []*Options, routing bool, mode BalanceMode) {
+	if len(opts) == 0 {
+		log.Warn("Balancer update ignored, no backends given")
+		return
+	}
+
+	b.updateMu.Lock()
+	defer b.updateMu.Unlock()
+
+	seeds := make([]string, len(opts))
+	for i, opt := range opts {
+		seeds[i] = opt.Addr
+	}
+
+	b.mu.Lock()
+	b.seeds = seeds
+	b.mu.Unlock()
+
+	b.update(opts, routing, mode)
+}
+
+// update applies the backends, the caller holds updateMu
+func (b *Balancer) update(opts []*Options, routing bool, mode BalanceMode) {
+	b.mu.RLock()
+	current := make(map[string]*redisBackend, len(b.selector))
+	for _, rb := range b.selector {
+		current[rb.Addr()] = rb
+	}
+	b.mu.RUnlock()
+
+	// new backends run their first check before they are swapped in
+	var replaced pool
+	selector := make(pool, 0, len(opts))
+	for _, opt := range opts {
+		opt = opt.withDefaults()
+
+		rb, ok := current[opt.Addr]
+		switch {
+		case !ok:
+			log.Info("Backend added", "node", opt.Addr)
+			rb = newRedisBackend(opt)
+		case *rb.opt != *opt:
+			log.Info("Backend options changed", "node", opt.Addr)
+			old := rb
+			rb = newRedisBackend(opt)
+			rb.inherit(old)
+			replaced = append(replaced, old)
 		}
 
-		balancer.selector[i] = newRedisBackend(opt)
+		delete(current, opt.Addr)
+		selector = append(selector, rb)
 	}
-	return balancer
+
+	b.mu.Lock()
+	b.selector = selector
+	b.single = len(selector) == 1
+	b.routing = routing
+	b.mode = mode
+	b.mu.Unlock()
+
+	for addr, rb := range current {
+		log.Info("Backend removed", "node", addr)
+		forgetMetrics(addr)
+		replaced = append(replaced, rb)
+	}
+
+	for _, rb := range replaced {
+		go rb.drain(drainTimeout)
+	}
+}
+
+// Routing returns true if writes are routed to the leader
+func (b *Balancer) Routing() bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	return b.routing
+}
+
+// Mode returns the current balance mode
+func (b *Balancer) Mode() BalanceMode {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	return b.mode
+}
+
+// SetMode changes the balance mode
+func (b *Balancer) SetMode(mode BalanceMode) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.mode = mode
+}
+
+// Disable drains the backend at addr, it gets no new reads but still
+// receives writes while it is the leader
+func (b *Balancer) Disable(addr string) error { return b.setDisabled(addr, true) }
+
+// Enable puts a disabled backend back into rotation
+func (b *Balancer) Enable(addr string) error { return b.setDisabled(addr, false) }
+
+func (b *Balancer) setDisabled(addr string, disabled bool) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	backend := b.selector.Find(addr)
+	if backend == nil {
+		return ErrUnknownBackend
+	}
+
+	var v int32
+	if disabled {
+		v = 1
+	}
+
+	if atomic.SwapInt32(&backend.disabled, v) != v {
+		log.Info("Backend admin state changed", "node", addr, "disabled", disabled)
+	}
+
+	return nil
+}
+
+// Stats returns a snapshot of all backends
+func (b *Balancer) Stats() []BackendStats {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	stats := make([]BackendStats, len(b.selector))
+	for i, rb := range b.selector {
+		stats[i] = rb.stats()
+	}
+	return stats
 }
 
 // Next returns the next available redis client
 func (b *Balancer) Next() *Backend { return b.pickNext() }
 
+// NextFollower returns the next available follower, or the leader when no
+// follower is up, whatever the routing
+func (b *Balancer) NextFollower() *Backend {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	return b.pickPreferring(true)
+}
+
+// NextAny returns the next available backend, the leader included, whatever
+// the routing
+func (b *Balancer) NextAny() *Backend {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	return b.pickPreferring(false)
+}
+
+// NextExcept returns the next available backend other than the given
+// addrs, or nil when no other backend is up
+func (b *Balancer) NextExcept(addrs ...string) *Backend {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	selector := b.selector.all(func(rb *redisBackend) bool {
+		for _, addr := range addrs {
+			if rb.Addr() == addr {
+				return false
+			}
+		}
+		return true
+	})
+
+	backend := b.pick(selector, b.routing)
+	if backend == nil {
+		return nil
+	}
+
+	// Increment the number of connections
+	backend.incConnections(1)
+
+	return backend.backend()
+}
+
+// MarkFailed records a failure seen on live traffic for the backend at
+// addr, it counts towards fall like a failed check
+func (b *Balancer) MarkFailed(addr string) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if backend := b.selector.Find(addr); backend != nil {
+		backend.updateStatus(false)
+	}
+}
+
 // Leader returns the available leader summitdb
 func (b *Balancer) Leader() *Backend {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
 	backend := b.selector.Leader()
 
 	if backend == nil {
@@ -80,17 +320,65 @@ func (b *Balancer) Leader() *Backend {
 	// Increment the number of connections
 	backend.incConnections(1)
 
-	return &Backend{
-		Addr:        backend.Addr(),
-		Pool:        backend.client,
-		Connections: backend.Connections(),
-		Latency:     backend.Latency(),
-		Status:      backend.Up(),
+	return backend.backend()
+}
+
+// KnownLeader returns the leader when it is known and up, nil otherwise.
+// Unlike Leader it never falls back on another backend.
+func (b *Balancer) KnownLeader() *Backend {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	backend := b.selector.Leader()
+	if backend == nil || !backend.Up() {
+		return nil
+	}
+
+	// Increment the number of connections
+	backend.incConnections(1)
+
+	return backend.backend()
+}
+
+// Redirect marks the backend at addr as the leader after a redirect reply and
+// returns it, falls back on the current leader when addr is not in the pool
+func (b *Balancer) Redirect(addr string) *Backend {
+	backend := b.markLeader(addr)
+	if backend == nil {
+		return b.Leader()
+	}
+
+	// Increment the number of connections
+	backend.incConnections(1)
+
+	return backend.backend()
+}
+
+// markLeader flags the backend at addr as the only leader, returns nil
+// when addr is not in the pool
+func (b *Balancer) markLeader(addr string) *redisBackend {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	backend := b.selector.Match(addr)
+	if backend == nil {
+		return nil
+	}
+
+	for _, rb := range b.selector {
+		rb.setLeader(rb == backend)
 	}
+
+	return backend
 }
 
 // Close closes all connecitons in the balancer
 func (b *Balancer) Close() (err error) {
+	b.Discover(0)
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
 	for _, b := range b.selector {
 		if e := b.Close(); e != nil {
 			err = e
@@ -101,49 +389,62 @@ func (b *Balancer) Close() (err error) {
 
 // Pick the next backend
 func (b *Balancer) pickNext() *Backend {
-	var backend *redisBackend
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	return b.pickPreferring(b.routing)
+}
+
+// pickPreferring picks the next backend, preferring followers when set, the
+// caller holds the lock
+func (b *Balancer) pickPreferring(followers bool) *Backend {
+	backend := b.pick(b.selector, followers)
+
+	// Fall back on random backend
+	if backend == nil {
+		backend = b.selector.Random()
+	}
+
+	// Increment the number of connections
+	backend.incConnections(1)
+
+	return backend.backend()
+}
+
+// pick selects a backend from the selector using the balance mode, when
+// preferring followers the leader is only picked when no follower is up
+func (b *Balancer) pick(selector pool, followers bool) *redisBackend {
+	if followers && !b.single {
+		followers := selector.all(func(rb *redisBackend) bool { return !rb.Leader() })
+		if followers.FirstUp() != nil {
+			selector = followers
+		}
+	}
 
-next:
 	switch b.mode {
 	case ModeLeastConn:
-		backend = b.selector.MinUp(func(b *redisBackend) int64 {
+		return selector.MinUp(func(b *redisBackend) int64 {
 			return b.Connections()
 		})
 	case ModeFirstUp:
-		backend = b.selector.FirstUp()
+		return selector.FirstUp()
 	case ModeMinLatency:
-		backend = b.selector.MinUp(func(b *redisBackend) int64 {
+		return selector.MinUp(func(b *redisBackend) int64 {
 			return int64(b.Latency())
 		})
 	case ModeRandom:
-		backend = b.selector.Up().Random()
+		return selector.Up().Random()
 	case ModeWeightedLatency:
-		backend = b.selector.Up().WeightedRandom(func(b *redisBackend) int64 {
+		return selector.Up().WeightedRandom(func(b *redisBackend) int64 {
 			factor := int64(b.Latency())
 			return factor * factor
 		})
 	case ModeRoundRobin:
 		next := int(atomic.AddInt32(&b.cursor, 1))
-		backend = b.selector.Up().At(next)
-	}
-
-	// Fall back on random backend
-	if backend == nil {
-		backend = b.selector.Random()
-	} else if backend.Leader() && !b.single && b.routing {
-		goto next
+		return selector.Up().At(next)
 	}
 
-	// Increment the number of connections
-	backend.incConnections(1)
-
-	return &Backend{
-		Addr:        backend.Addr(),
-		Pool:        backend.client,
-		Connections: backend.Connections(),
-		Latency:     backend.Latency(),
-		Status:      backend.Up(),
-	}
+	return nil
 }
 
 // --------------------------------------------------------------------
@@ -161,6 +462,68 @@ type Options struct {
 	// Rise and Fall indicate the number of checks required to
 	// mark the instance as up or down, defaults to 1
 	Rise, Fall int
+
+	// Outlier ejects the backend based on live traffic
+	Outlier OutlierOptions
+
+	// DialTimeout, ReadTimeout and WriteTimeout bound the backend
+	// connections, dial defaults to 5s, 0 means no read or write timeout
+	DialTimeout, ReadTimeout, WriteTimeout time.Duration
+
+	// TLS to the backend
+	TLS TLSOptions
+
+	// Username and Password authenticate new connections, the username is
+	// only sent with a password
+	Username, Password string
+}
+
+// dialOptions returns the redigo options to dial the backend
+func (o *Options) dialOptions() ([]redis.DialOption, error) {
+	opts := []redis.DialOption{
+		redis.DialConnectTimeout(o.getDialTimeout()),
+		redis.DialReadTimeout(o.ReadTimeout),
+		redis.DialWriteTimeout(o.WriteTimeout),
+	}
+
+	if o.Password != "" {
+		opts = append(opts, redis.DialUsername(o.Username), redis.DialPassword(o.Password))
+	}
+
+	if !o.TLS.Enabled {
+		return opts, nil
+	}
+
+	c, err := o.TLS.config()
+	if err != nil {
+		return nil, err
+	}
+
+	return append(opts, redis.DialUseTLS(true), redis.DialTLSConfig(c)), nil
+}
+
+func (o *Options) getDialTimeout() time.Duration {
+	if o.DialTimeout <= 0 {
+		return 5 * time.Second
+	}
+	return o.DialTimeout
+}
+
+// health checks must answer within the read timeout, or the check interval
+// when there is none, so a hung backend can't stall the check loop
+func (o *Options) getCheckTimeout() time.Duration {
+	if o.ReadTimeout > 0 {
+		return o.ReadTimeout
+	}
+	return o.getCheckInterval()
+}
+
+func (o *Options) withDefaults() *Options {
+	opt := *o
+	if opt.MaxIdle == 0 {
+		opt.MaxIdle = 1
+	}
+	return &opt
 }
 
 func (o *Options) getCheckInterval() time.Duration {
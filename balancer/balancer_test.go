@@ -2,6 +2,7 @@ package balancer
 
 import (
 	"math/rand"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -107,6 +108,188 @@ var _ = Describe("Balancer", func() {
 
 	})
 
+	Describe("NextExcept", func() {
+
+		BeforeEach(func() {
+			subject = &Balancer{mode: ModeFirstUp, routing: true, selector: pool{
+				&redisBackend{opt: mockOpts("127.0.0.1:7481"), up: 1, leader: 1},
+				&redisBackend{opt: mockOpts("127.0.0.1:7482"), up: 1},
+				&redisBackend{opt: mockOpts("127.0.0.1:7483"), up: 1},
+			}}
+		})
+
+		It("should skip the given backends", func() {
+			Expect(subject.NextExcept().Addr).To(Equal("127.0.0.1:7482"))
+			Expect(subject.NextExcept("127.0.0.1:7482").Addr).To(Equal("127.0.0.1:7483"))
+			Expect(subject.NextExcept("127.0.0.1:7482", "127.0.0.1:7483").Addr).To(Equal("127.0.0.1:7481"))
+			Expect(subject.NextExcept("127.0.0.1:7481", "127.0.0.1:7482", "127.0.0.1:7483")).To(BeNil())
+		})
+
+		It("should pick the leader when no follower is up", func() {
+			subject.selector[1].up = 0
+			subject.selector[2].up = 0
+			Expect(subject.pickNext().Addr).To(Equal("127.0.0.1:7481"))
+		})
+
+		It("should record passive failures", func() {
+			subject.MarkFailed("127.0.0.1:7482")
+			Expect(subject.selector[1].Up()).To(BeFalse())
+			subject.MarkFailed("127.0.0.1:7489")
+		})
+
+	})
+
+	Describe("NextFollower and NextAny", func() {
+
+		BeforeEach(func() {
+			subject = &Balancer{mode: ModeFirstUp, selector: pool{
+				&redisBackend{opt: mockOpts("127.0.0.1:7481"), up: 1, leader: 1},
+				&redisBackend{opt: mockOpts("127.0.0.1:7482"), up: 1},
+			}}
+		})
+
+		It("should prefer followers whatever the routing", func() {
+			Expect(subject.Next().Addr).To(Equal("127.0.0.1:7481"))
+			Expect(subject.NextFollower().Addr).To(Equal("127.0.0.1:7482"))
+
+			subject.selector[1].up = 0
+			Expect(subject.NextFollower().Addr).To(Equal("127.0.0.1:7481"))
+		})
+
+		It("should include the leader whatever the routing", func() {
+			subject.routing = true
+			Expect(subject.Next().Addr).To(Equal("127.0.0.1:7482"))
+			Expect(subject.NextAny().Addr).To(Equal("127.0.0.1:7481"))
+		})
+
+	})
+
+	Describe("Update", func() {
+
+		BeforeEach(func() {
+			subject = New([]*Options{
+				{Network: "tcp", Addr: "127.0.0.1:7491"},
+				{Network: "tcp", Addr: "127.0.0.1:7492"},
+				{Network: "tcp", Addr: "127.0.0.1:7493"},
+			}, false, ModeFirstUp)
+		})
+
+		AfterEach(func() {
+			Expect(subject.Close()).NotTo(HaveOccurred())
+		})
+
+		It("should add, replace and remove backends", func() {
+			kept := subject.selector[0]
+			changed := subject.selector[1]
+			atomic.StoreInt32(&changed.up, 1)
+
+			subject.Update([]*Options{
+				{Network: "tcp", Addr: "127.0.0.1:7491"},
+				{Network: "tcp", Addr: "127.0.0.1:7492", MaxIdle: 8},
+				{Network: "tcp", Addr: "127.0.0.1:7494"},
+			}, true, ModeRoundRobin)
+
+			Expect(subject.selector).To(HaveLen(3))
+			Expect(subject.selector[0]).To(BeIdenticalTo(kept))
+			Expect(subject.selector[1]).NotTo(BeIdenticalTo(changed))
+			Expect(subject.selector[1].opt.MaxIdle).To(Equal(8))
+			Expect(subject.selector[1].Up()).To(BeTrue())
+			Expect(subject.selector[2].Addr()).To(Equal("127.0.0.1:7494"))
+			Expect(subject.Routing()).To(BeTrue())
+			Expect(subject.Mode()).To(Equal(ModeRoundRobin))
+		})
+
+		It("should ignore empty updates", func() {
+			subject.Update(nil, true, ModeRandom)
+			Expect(subject.selector).To(HaveLen(3))
+			Expect(subject.Routing()).To(BeFalse())
+		})
+
+	})
+
+	Describe("Admin", func() {
+
+		BeforeEach(func() {
+			subject = &Balancer{mode: ModeFirstUp, selector: pool{
+				&redisBackend{opt: mockOpts("127.0.0.1:7481"), up: 1, leader: 1},
+				&redisBackend{opt: mockOpts("127.0.0.1:7482"), up: 1},
+				&redisBackend{opt: mockOpts("127.0.0.1:7483"), up: 1},
+			}}
+		})
+
+		It("should drain and enable backends", func() {
+			Expect(subject.Disable("127.0.0.1:7482")).To(Succeed())
+			Expect(subject.selector[1].Up()).To(BeFalse())
+			Expect(subject.pickNext().Addr).To(Equal("127.0.0.1:7481"))
+			Expect(subject.Leader().Addr).To(Equal("127.0.0.1:7481"))
+
+			Expect(subject.Enable("127.0.0.1:7482")).To(Succeed())
+			Expect(subject.selector[1].Up()).To(BeTrue())
+			Expect(subject.Disable("127.0.0.1:7489")).To(Equal(ErrUnknownBackend))
+		})
+
+		It("should report stats", func() {
+			Expect(subject.Disable("127.0.0.1:7483")).To(Succeed())
+
+			stats := subject.Stats()
+			Expect(stats).To(HaveLen(3))
+			Expect(stats[0].Leader).To(BeTrue())
+			Expect(stats[2].Up).To(BeFalse())
+			Expect(stats[2].Healthy).To(BeTrue())
+			Expect(stats[2].Disabled).To(BeTrue())
+			Expect(stats[2].Rise).To(Equal(1))
+		})
+
+		It("should change and parse modes", func() {
+			subject.SetMode(ModeRandom)
+			Expect(subject.Mode()).To(Equal(ModeRandom))
+			Expect(subject.Mode().String()).To(Equal("random"))
+
+			mode, err := ParseMode("roundrobin")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(mode).To(Equal(ModeRoundRobin))
+
+			_, err = ParseMode("fastest")
+			Expect(err).To(HaveOccurred())
+		})
+
+	})
+
+	Describe("Redirect", func() {
+
+		BeforeEach(func() {
+			subject = &Balancer{selector: pool{
+				&redisBackend{opt: mockOpts("127.0.0.1:7481"), up: 1, leader: 1},
+				&redisBackend{opt: mockOpts("127.0.0.1:7482"), up: 1},
+				&redisBackend{opt: mockOpts("127.0.0.1:7483"), up: 1},
+			}}
+		})
+
+		It("should mark the redirected backend as leader", func() {
+			Expect(subject.Redirect("127.0.0.1:7483").Addr).To(Equal("127.0.0.1:7483"))
+			Expect(subject.selector[0].Leader()).To(BeFalse())
+			Expect(subject.selector[1].Leader()).To(BeFalse())
+			Expect(subject.selector[2].Leader()).To(BeTrue())
+			Expect(subject.selector[2].connections).To(Equal(int64(1)))
+		})
+
+		It("should fallback on the current leader for unknown addrs", func() {
+			Expect(subject.Redirect("10.0.0.1:7481").Addr).To(Equal("127.0.0.1:7481"))
+			Expect(subject.selector[0].Leader()).To(BeTrue())
+		})
+
+		It("should return a known leader only while it is up", func() {
+			Expect(subject.KnownLeader().Addr).To(Equal("127.0.0.1:7481"))
+
+			subject.selector[0].up = 0
+			Expect(subject.KnownLeader()).To(BeNil())
+
+			subject.selector[0].up, subject.selector[0].leader = 1, 0
+			Expect(subject.KnownLeader()).To(BeNil())
+		})
+
+	})
+
 })
 
 // --------------------------------------------------------------------
@@ -0,0 +1,198 @@
+package balancer
+
+import (
+	"net"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/semihalev/log"
+	"gopkg.in/tomb.v2"
+)
+
+// discovery keeps the pool in sync with the raft cluster membership
+type discovery struct {
+	balancer *Balancer
+	interval time.Duration
+
+	closer tomb.Tomb
+}
+
+// Discover keeps the pool in sync with the cluster members reported by
+// RAFTPEERS, checking every interval. Peers joining the cluster are added
+// with the options of the first configured backend, departed ones are
+// drained. Peers are matched to backends by resolved host and port, and the
+// configured backends are kept even when no peer matches them. An interval
+// of 0 stops discovery.
+func (b *Balancer) Discover(interval time.Duration) {
+	b.updateMu.Lock()
+	d := b.discovery
+	b.discovery = nil
+	b.updateMu.Unlock()
+
+	if d != nil {
+		d.Close()
+	}
+
+	if interval <= 0 {
+		return
+	}
+
+	if interval < minCheckInterval {
+		interval = minCheckInterval
+	}
+
+	d = &discovery{balancer: b, interval: interval}
+	d.startLoop()
+
+	b.updateMu.Lock()
+	b.discovery = d
+	b.updateMu.Unlock()
+}
+
+// Close stops the discovery loop
+func (d *discovery) Close() error {
+	d.closer.Kill(nil)
+	return d.closer.Wait()
+}
+
+func (d *discovery) discover() {
+	b := d.balancer
+
+	b.mu.RLock()
+	seed := b.selector.FirstUp()
+	if seed == nil {
+		seed = b.selector.Random()
+	}
+	selector, seeds := b.selector, b.seeds
+	b.mu.RUnlock()
+
+	conn := seed.client.Get()
+	defer conn.Close()
+
+	peers, err := redis.Strings(redis.DoWithTimeout(conn, seed.opt.getCheckTimeout(), "RAFTPEERS"))
+	if err != nil {
+		log.Error("Discovery failed", "node", seed.Addr(), "error", err.Error())
+		return
+	}
+
+	if len(peers) == 0 {
+		log.Warn("Discovery ignored, no peers returned", "node", seed.Addr())
+		return
+	}
+
+	if opts, changed := peerOptions(selector, seeds, peers); changed {
+		b.updateMu.Lock()
+		// an update since the snapshot wins, the next round starts from it
+		b.mu.RLock()
+		stale := &b.selector[0] != &selector[0]
+		b.mu.RUnlock()
+
+		if stale {
+			log.Debug("Discovery ignored, backends updated meanwhile", "node", seed.Addr())
+		} else {
+			log.Info("Discovery found membership change", "node", seed.Addr(), "peers", peers)
+			b.update(opts, b.Routing(), b.Mode())
+		}
+		b.updateMu.Unlock()
+	}
+
+	leader, err := redis.String(redis.DoWithTimeout(conn, seed.opt.getCheckTimeout(), "RAFTLEADER"))
+	if err == nil && leader != "" {
+		b.markLeader(leader)
+	}
+}
+
+// peerOptions returns the backend options for the given peers merged with
+// the seeds, reusing the options of known backends, and reports whether the
+// membership changed
+func peerOptions(selector pool, seeds, peers []string) ([]*Options, bool) {
+	template := selector[0].opt
+
+	opts := make([]*Options, 0, len(peers)+len(seeds))
+	matched := make(map[*redisBackend]bool, len(selector))
+	for _, addr := range peers {
+		rb := selector.Match(addr)
+		if rb == nil {
+			opt := *template
+			opt.Addr = addr
+			opts = append(opts, &opt)
+			continue
+		}
+
+		// peers may be listed twice with different spellings
+		if !matched[rb] {
+			matched[rb] = true
+			opts = append(opts, rb.opt)
+		}
+	}
+
+	for _, addr := range seeds {
+		if rb := selector.Find(addr); rb != nil && !matched[rb] {
+			matched[rb] = true
+			opts = append(opts, rb.opt)
+		}
+	}
+
+	return opts, len(matched) != len(opts) || len(matched) != len(selector)
+}
+
+// sameAddr returns true if both addresses reach the same host and port,
+// host names are resolved
+func sameAddr(a, b string) bool {
+	if a == b {
+		return true
+	}
+
+	ahost, aport, err := net.SplitHostPort(a)
+	if err != nil {
+		return false
+	}
+	bhost, bport, err := net.SplitHostPort(b)
+	if err != nil || aport != bport {
+		return false
+	}
+
+	bips := resolveHost(bhost)
+	for _, aip := range resolveHost(ahost) {
+		for _, bip := range bips {
+			if aip == bip {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// resolveHost returns the normalized addresses of the host, the lowercase
+// host itself when it doesn't resolve
+func resolveHost(host string) []string {
+	if ip := net.ParseIP(host); ip != nil {
+		return []string{ip.String()}
+	}
+
+	addrs, err := net.LookupHost(host)
+	if err != nil {
+		return []string{strings.ToLower(host)}
+	}
+
+	for i, addr := range addrs {
+		if ip := net.ParseIP(addr); ip != nil {
+			addrs[i] = ip.String()
+		}
+	}
+	return addrs
+}
+
+func (d *discovery) startLoop() {
+	d.closer.Go(func() error {
+		for {
+			select {
+			case <-d.closer.Dying():
+				return nil
+			case <-time.After(d.interval):
+				d.discover()
+			}
+		}
+	})
+}
@@ -0,0 +1,156 @@
+package balancer
+
+import (
+	"net"
+	"sort"
+	"time"
+
+	"github.com/masomo/summitdb-balancer/summitdbtest"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("discovery", func() {
+	var selector pool
+
+	var addrsOf = func(opts []*Options) []string {
+		addrs := make([]string, len(opts))
+		for i, opt := range opts {
+			addrs[i] = opt.Addr
+		}
+		return addrs
+	}
+
+	BeforeEach(func() {
+		selector = pool{
+			&redisBackend{opt: &Options{Network: "tcp", Addr: "127.0.0.1:7481", Rise: 2, MaxIdle: 4}},
+			&redisBackend{opt: &Options{Network: "tcp", Addr: "127.0.0.1:7482", Rise: 3}},
+		}
+	})
+
+	It("should keep the pool when membership is unchanged", func() {
+		opts, changed := peerOptions(selector, nil, []string{"127.0.0.1:7482", "127.0.0.1:7481"})
+		Expect(changed).To(BeFalse())
+		Expect(opts[0]).To(BeIdenticalTo(selector[1].opt))
+		Expect(opts[1]).To(BeIdenticalTo(selector[0].opt))
+	})
+
+	It("should add joined peers using the first backend as template", func() {
+		opts, changed := peerOptions(selector, nil, []string{"127.0.0.1:7481", "127.0.0.1:7482", "127.0.0.1:7483"})
+		Expect(changed).To(BeTrue())
+		Expect(addrsOf(opts)).To(Equal([]string{"127.0.0.1:7481", "127.0.0.1:7482", "127.0.0.1:7483"}))
+		Expect(opts[2].Rise).To(Equal(2))
+		Expect(opts[2].MaxIdle).To(Equal(4))
+		Expect(selector[0].opt.Addr).To(Equal("127.0.0.1:7481"))
+	})
+
+	It("should drop departed peers", func() {
+		opts, changed := peerOptions(selector, nil, []string{"127.0.0.1:7482"})
+		Expect(changed).To(BeTrue())
+		Expect(addrsOf(opts)).To(Equal([]string{"127.0.0.1:7482"}))
+	})
+
+	It("should keep the seeds no peer matches", func() {
+		opts, changed := peerOptions(selector, []string{"127.0.0.1:7481"}, []string{"127.0.0.1:7482", "127.0.0.1:7483"})
+		Expect(changed).To(BeTrue())
+		Expect(addrsOf(opts)).To(Equal([]string{"127.0.0.1:7482", "127.0.0.1:7483", "127.0.0.1:7481"}))
+
+		opts, changed = peerOptions(selector, []string{"127.0.0.1:7481"}, []string{"127.0.0.1:7482"})
+		Expect(changed).To(BeFalse())
+		Expect(addrsOf(opts)).To(Equal([]string{"127.0.0.1:7482", "127.0.0.1:7481"}))
+	})
+
+	It("should match peers spelled differently", func() {
+		selector[0].opt.Addr = "localhost:7481"
+
+		opts, changed := peerOptions(selector, []string{"localhost:7481"}, []string{"127.0.0.1:7481", "127.0.0.1:7482"})
+		Expect(changed).To(BeFalse())
+		Expect(addrsOf(opts)).To(Equal([]string{"localhost:7481", "127.0.0.1:7482"}))
+
+		Expect(sameAddr("LOCALHOST:7481", "127.0.0.1:7481")).To(BeTrue())
+		Expect(sameAddr("127.0.0.1:7481", "127.0.0.1:7482")).To(BeFalse())
+		Expect(sameAddr("unknown.invalid:7481", "127.0.0.1:7481")).To(BeFalse())
+	})
+
+	Context("against a cluster", func() {
+		var cluster *summitdbtest.Cluster
+		var subject *Balancer
+		var seed string
+
+		var addrs = func() []string {
+			var addrs []string
+			for _, s := range subject.Stats() {
+				addrs = append(addrs, s.Addr)
+			}
+			sort.Strings(addrs)
+			return addrs
+		}
+
+		BeforeEach(func() {
+			var err error
+			cluster, err = summitdbtest.NewCluster(3)
+			Expect(err).NotTo(HaveOccurred())
+
+			// the seed is configured by name, RAFTPEERS lists its IP
+			_, port, _ := net.SplitHostPort(cluster.Nodes[0].Addr())
+			seed = "localhost:" + port
+			subject = New([]*Options{{Network: "tcp", Addr: seed, CheckInterval: time.Hour}}, true, ModeRoundRobin)
+			subject.Discover(minCheckInterval)
+		})
+
+		AfterEach(func() {
+			subject.Close()
+			Expect(cluster.Close()).To(Succeed())
+		})
+
+		It("should add joined peers and drop departed ones", func() {
+			Eventually(addrs, time.Second, 10*time.Millisecond).Should(ConsistOf(seed, cluster.Nodes[1].Addr(), cluster.Nodes[2].Addr()))
+
+			// the RAFTLEADER address matches the seed
+			Eventually(func() string {
+				for _, s := range subject.Stats() {
+					if s.Leader {
+						return s.Addr
+					}
+				}
+				return ""
+			}, time.Second, 10*time.Millisecond).Should(Equal(seed))
+
+			for _, node := range cluster.Nodes {
+				node.SetPeers(cluster.Addrs()[:2])
+			}
+			Eventually(addrs, time.Second, 10*time.Millisecond).Should(ConsistOf(seed, cluster.Nodes[1].Addr()))
+
+			// the seed stays when it leaves the cluster
+			for _, node := range cluster.Nodes {
+				node.SetPeers(cluster.Addrs()[1:])
+			}
+			Eventually(addrs, time.Second, 10*time.Millisecond).Should(ConsistOf(seed, cluster.Nodes[1].Addr(), cluster.Nodes[2].Addr()))
+		})
+	})
+
+	It("should not overwrite an update made while asking for peers", func() {
+		cluster, err := summitdbtest.NewCluster(3)
+		Expect(err).NotTo(HaveOccurred())
+		defer cluster.Close()
+
+		subject := New([]*Options{{Network: "tcp", Addr: cluster.Nodes[0].Addr(), CheckInterval: time.Hour}}, true, ModeRoundRobin)
+		defer subject.Close()
+
+		cluster.Nodes[0].SetFault("raftpeers", summitdbtest.Fault{Latency: 200 * time.Millisecond})
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			(&discovery{balancer: subject}).discover()
+		}()
+		Eventually(func() int { return cluster.Nodes[0].Count("raftpeers") }).Should(Equal(1))
+
+		subject.Update([]*Options{{Network: "tcp", Addr: cluster.Nodes[1].Addr(), CheckInterval: time.Hour}}, true, ModeRoundRobin)
+		Eventually(done, time.Second).Should(BeClosed())
+
+		stats := subject.Stats()
+		Expect(stats).To(HaveLen(1))
+		Expect(stats[0].Addr).To(Equal(cluster.Nodes[1].Addr()))
+	})
+})
@@ -0,0 +1,106 @@
+package balancer
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	checkDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricPrefix,
+		Name:      "check_duration_seconds",
+		Help:      "Latency of RAFTSTATE health checks.",
+		Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 14),
+	}, []string{"backend"})
+
+	checksTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricPrefix,
+		Name:      "checks_total",
+		Help:      "Health checks by result.",
+	}, []string{"backend", "result"})
+
+	leaderChanges = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricPrefix,
+		Name:      "leader_changes_total",
+		Help:      "Times a backend became the leader.",
+	}, []string{"backend"})
+
+	ejectionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricPrefix,
+		Name:      "ejections_total",
+		Help:      "Times a backend was ejected as an outlier.",
+	}, []string{"backend"})
+
+	backendUpDesc = prometheus.NewDesc(metricPrefix+"_backend_up",
+		"Whether the backend is in rotation.", []string{"backend"}, nil)
+	backendLeaderDesc = prometheus.NewDesc(metricPrefix+"_backend_leader",
+		"Whether the backend is the raft leader.", []string{"backend"}, nil)
+	backendEjectedDesc = prometheus.NewDesc(metricPrefix+"_backend_ejected",
+		"Whether the backend is ejected as an outlier.", []string{"backend"}, nil)
+	backendLatencyDesc = prometheus.NewDesc(metricPrefix+"_backend_latency_seconds",
+		"Latency of the last health check.", []string{"backend"}, nil)
+	poolConnectionsDesc = prometheus.NewDesc(metricPrefix+"_pool_connections",
+		"Connections of the backend pool by state.", []string{"backend", "state"}, nil)
+)
+
+// Describe implements prometheus.Collector
+func (b *Balancer) Describe(ch chan<- *prometheus.Desc) { describe(ch) }
+
+// Collect implements prometheus.Collector
+func (b *Balancer) Collect(ch chan<- prometheus.Metric) { collect(ch, []*Balancer{b}) }
+
+// Collector reports the metrics of a changing set of balancers, which
+// can't be registered one by one as they share their metrics
+type Collector func() []*Balancer
+
+// Describe implements prometheus.Collector
+func (c Collector) Describe(ch chan<- *prometheus.Desc) { describe(ch) }
+
+// Collect implements prometheus.Collector
+func (c Collector) Collect(ch chan<- prometheus.Metric) { collect(ch, c()) }
+
+func describe(ch chan<- *prometheus.Desc) {
+	checkDuration.Describe(ch)
+	checksTotal.Describe(ch)
+	leaderChanges.Describe(ch)
+	ejectionsTotal.Describe(ch)
+
+	ch <- backendUpDesc
+	ch <- backendLeaderDesc
+	ch <- backendEjectedDesc
+	ch <- backendLatencyDesc
+	ch <- poolConnectionsDesc
+}
+
+func collect(ch chan<- prometheus.Metric, balancers []*Balancer) {
+	checkDuration.Collect(ch)
+	checksTotal.Collect(ch)
+	leaderChanges.Collect(ch)
+	ejectionsTotal.Collect(ch)
+
+	for _, b := range balancers {
+		for _, stats := range b.Stats() {
+			ch <- prometheus.MustNewConstMetric(backendUpDesc, prometheus.GaugeValue, boolValue(stats.Up), stats.Addr)
+			ch <- prometheus.MustNewConstMetric(backendLeaderDesc, prometheus.GaugeValue, boolValue(stats.Leader), stats.Addr)
+			ch <- prometheus.MustNewConstMetric(backendEjectedDesc, prometheus.GaugeValue, boolValue(stats.Ejected), stats.Addr)
+			ch <- prometheus.MustNewConstMetric(backendLatencyDesc, prometheus.GaugeValue, stats.Latency.Seconds(), stats.Addr)
+			ch <- prometheus.MustNewConstMetric(poolConnectionsDesc, prometheus.GaugeValue, float64(stats.Active), stats.Addr, "active")
+			ch <- prometheus.MustNewConstMetric(poolConnectionsDesc, prometheus.GaugeValue, float64(stats.Idle), stats.Addr, "idle")
+		}
+	}
+}
+
+// forgetMetrics drops the series of a backend removed from the pool
+func forgetMetrics(addr string) {
+	checkDuration.DeleteLabelValues(addr)
+	checksTotal.DeleteLabelValues(addr, "ok")
+	checksTotal.DeleteLabelValues(addr, "fail")
+	leaderChanges.DeleteLabelValues(addr)
+	ejectionsTotal.DeleteLabelValues(addr)
+}
+
+func boolValue(v bool) float64 {
+	if v {
+		return 1
+	}
+	return 0
+}
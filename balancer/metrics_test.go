@@ -0,0 +1,50 @@
+package balancer
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("metrics", func() {
+	var subject *Balancer
+
+	BeforeEach(func() {
+		subject = &Balancer{selector: pool{
+			&redisBackend{opt: mockOpts("127.0.0.1:7481"), up: 1, leader: 1},
+			&redisBackend{opt: mockOpts("127.0.0.1:7482"), up: 0},
+		}}
+	})
+
+	It("should collect backend gauges", func() {
+		registry := prometheus.NewPedanticRegistry()
+		Expect(registry.Register(subject)).To(Succeed())
+
+		families, err := registry.Gather()
+		Expect(err).NotTo(HaveOccurred())
+
+		values := make(map[string]float64)
+		for _, family := range families {
+			for _, m := range family.GetMetric() {
+				if m.GetGauge() == nil || len(m.GetLabel()) != 1 {
+					continue
+				}
+				values[family.GetName()+" "+m.GetLabel()[0].GetValue()] = m.GetGauge().GetValue()
+			}
+		}
+
+		Expect(values).To(HaveKeyWithValue("balancer_backend_up 127.0.0.1:7481", 1.0))
+		Expect(values).To(HaveKeyWithValue("balancer_backend_up 127.0.0.1:7482", 0.0))
+		Expect(values).To(HaveKeyWithValue("balancer_backend_leader 127.0.0.1:7481", 1.0))
+	})
+
+	It("should count leader changes", func() {
+		before := testutil.ToFloat64(leaderChanges.WithLabelValues("127.0.0.1:7482"))
+		subject.selector[1].setLeader(true)
+		subject.selector[1].setLeader(true)
+		Expect(testutil.ToFloat64(leaderChanges.WithLabelValues("127.0.0.1:7482"))).To(Equal(before + 1))
+	})
+
+})
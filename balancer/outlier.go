@@ -0,0 +1,124 @@
+package balancer
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/semihalev/log"
+)
+
+// OutlierOptions configure passive health checking from live traffic
+type OutlierOptions struct {
+	// Interval over which errors and latency are evaluated, 0 disables it
+	Interval time.Duration
+
+	// MinRequests seen in an interval before a backend can be ejected
+	MinRequests int
+
+	// ErrorRate, between 0 and 1, of failed commands that ejects a backend
+	ErrorRate float64
+
+	// Latency is the mean command latency that ejects a backend, 0 ignores latency
+	Latency time.Duration
+
+	// EjectTime a backend stays out of rotation, defaults to 30s
+	EjectTime time.Duration
+}
+
+func (o OutlierOptions) getEjectTime() time.Duration {
+	if o.EjectTime <= 0 {
+		return 30 * time.Second
+	}
+	return o.EjectTime
+}
+
+// outlier tracks live traffic of a backend over the current interval
+type outlier struct {
+	mu sync.Mutex
+
+	start            time.Time
+	requests, errors int
+	latency          time.Duration
+}
+
+// Observe records the result of a command proxied to the backend at addr.
+// Backends crossing the error rate or latency thresholds over an interval
+// are ejected for the eject time, unless they are the last backend up.
+func (b *Balancer) Observe(addr string, latency time.Duration, failed bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	backend := b.selector.Find(addr)
+	if backend == nil || !backend.observe(latency, failed) {
+		return
+	}
+
+	if len(b.selector.Up()) <= 1 {
+		log.Warn("Backend outlier not ejected, no other backend up", "node", addr)
+		return
+	}
+
+	backend.eject()
+}
+
+// observe records a command and returns true if the backend is an outlier
+// at the end of the interval
+func (b *redisBackend) observe(latency time.Duration, failed bool) bool {
+	opt := b.opt.Outlier
+	if opt.Interval <= 0 {
+		return false
+	}
+
+	o := &b.outlier
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	now := time.Now()
+	if o.start.IsZero() {
+		o.start = now
+	}
+
+	o.requests++
+	o.latency += latency
+	if failed {
+		o.errors++
+	}
+
+	if now.Sub(o.start) < opt.Interval {
+		return false
+	}
+
+	requests, errors, total := o.requests, o.errors, o.latency
+	o.start, o.requests, o.errors, o.latency = now, 0, 0, 0
+
+	if requests < opt.MinRequests {
+		return false
+	}
+
+	if opt.ErrorRate > 0 && float64(errors)/float64(requests) >= opt.ErrorRate {
+		log.Warn("Backend outlier, error rate", "node", b.Addr(), "requests", requests, "errors", errors)
+		return true
+	}
+
+	if mean := total / time.Duration(requests); opt.Latency > 0 && mean >= opt.Latency {
+		log.Warn("Backend outlier, latency", "node", b.Addr(), "requests", requests, "latency", mean)
+		return true
+	}
+
+	return false
+}
+
+// eject takes the backend out of rotation for the eject time
+func (b *redisBackend) eject() {
+	ejectTime := b.opt.Outlier.getEjectTime()
+	atomic.StoreInt64(&b.ejected, time.Now().Add(ejectTime).UnixNano())
+
+	log.Warn("Backend ejected", "node", b.Addr(), "for", ejectTime)
+	ejectionsTotal.WithLabelValues(b.Addr()).Inc()
+}
+
+// Ejected returns true while the backend is ejected as an outlier
+func (b *redisBackend) Ejected() bool {
+	return time.Now().UnixNano() < atomic.LoadInt64(&b.ejected)
+}
@@ -0,0 +1,74 @@
+package balancer
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("outlier", func() {
+	var subject *Balancer
+
+	var outlierOpts = func(addr string) *Options {
+		opt := mockOpts(addr)
+		opt.Outlier = OutlierOptions{
+			Interval:    time.Millisecond,
+			MinRequests: 4,
+			ErrorRate:   0.5,
+			Latency:     100 * time.Millisecond,
+			EjectTime:   time.Hour,
+		}
+		return opt
+	}
+
+	BeforeEach(func() {
+		subject = &Balancer{selector: pool{
+			&redisBackend{opt: outlierOpts("127.0.0.1:7481"), up: 1},
+			&redisBackend{opt: outlierOpts("127.0.0.1:7482"), up: 1},
+		}}
+	})
+
+	var observe = func(addr string, n int, latency time.Duration, failed bool) {
+		for i := 0; i < n; i++ {
+			subject.Observe(addr, latency, failed)
+		}
+		time.Sleep(2 * time.Millisecond)
+		subject.Observe(addr, latency, failed)
+	}
+
+	It("should eject backends with a high error rate", func() {
+		observe("127.0.0.1:7481", 4, time.Millisecond, true)
+		Expect(subject.selector[0].Ejected()).To(BeTrue())
+		Expect(subject.selector[0].Up()).To(BeFalse())
+		Expect(subject.Stats()[0].Ejected).To(BeTrue())
+	})
+
+	It("should eject backends with a high latency", func() {
+		observe("127.0.0.1:7482", 4, time.Second, false)
+		Expect(subject.selector[1].Ejected()).To(BeTrue())
+	})
+
+	It("should keep healthy backends", func() {
+		observe("127.0.0.1:7481", 8, time.Millisecond, false)
+		Expect(subject.selector[0].Up()).To(BeTrue())
+	})
+
+	It("should wait for enough requests", func() {
+		observe("127.0.0.1:7481", 1, time.Millisecond, true)
+		Expect(subject.selector[0].Up()).To(BeTrue())
+	})
+
+	It("should not eject the last backend up", func() {
+		subject.selector[1].up = 0
+		observe("127.0.0.1:7481", 4, time.Millisecond, true)
+		Expect(subject.selector[0].Up()).To(BeTrue())
+	})
+
+	It("should return after the eject time", func() {
+		subject.selector[0].opt.Outlier.EjectTime = time.Millisecond
+		observe("127.0.0.1:7481", 4, time.Millisecond, true)
+		Eventually(subject.selector[0].Up).Should(BeTrue())
+	})
+
+})
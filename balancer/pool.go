@@ -22,6 +22,20 @@ func (p pool) Leader() *redisBackend {
 	return p.first(func(b *redisBackend) bool { return b.Leader() })
 }
 
+// Find returns the backend with the given address
+func (p pool) Find(addr string) *redisBackend {
+	return p.first(func(b *redisBackend) bool { return b.Addr() == addr })
+}
+
+// Match returns the backend at the address, or the one reaching the same
+// host and port when no address is spelled the same way
+func (p pool) Match(addr string) *redisBackend {
+	if b := p.Find(addr); b != nil {
+		return b
+	}
+	return p.first(func(b *redisBackend) bool { return sameAddr(b.Addr(), addr) })
+}
+
 // MinUp returns the backend with the minumum result that is up
 func (p pool) MinUp(minimum func(*redisBackend) int64) *redisBackend {
 	min := int64(math.MaxInt64)
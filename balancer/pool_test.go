@@ -42,6 +42,12 @@ var _ = Describe("pool", func() {
 		Expect(subject.FirstUp().opt.Addr).To(Equal("127.0.0.1:7482"))
 	})
 
+	It("should find by addr", func() {
+		Expect(pool{}.Find("127.0.0.1:7481")).To(BeNil())
+		Expect(subject.Find("127.0.0.1:7483").opt.Addr).To(Equal("127.0.0.1:7483"))
+		Expect(subject.Find("127.0.0.1:7485")).To(BeNil())
+	})
+
 	It("should select min up", func() {
 		Expect(pool{}.MinUp(func(b *redisBackend) int64 { return 100 })).To(BeNil())
 		Expect(subject.MinUp(func(b *redisBackend) int64 { return b.Connections() }).opt.Addr).To(Equal("127.0.0.1:7483"))
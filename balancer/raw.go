@@ -0,0 +1,186 @@
+package balancer
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// rawBufferSize is the read and write buffer of raw connections, it
+	// bounds the memory a relayed reply takes
+	rawBufferSize = 32 * 1024
+
+	// rawIdleTimeout drops idle raw connections the backend may have closed
+	rawIdleTimeout = time.Minute
+)
+
+// RawPool keeps idle backend connections that exchange RESP without
+// decoding it, so replies can be relayed to clients as they arrive
+type RawPool struct {
+	opt  *Options
+	idle chan *RawConn
+
+	tls    *tls.Config
+	tlsErr error
+
+	closed int32
+}
+
+func newRawPool(opt *Options) *RawPool {
+	p := &RawPool{opt: opt, idle: make(chan *RawConn, opt.MaxIdle)}
+
+	if opt.TLS.Enabled {
+		p.tls, p.tlsErr = opt.TLS.config()
+		if p.tlsErr == nil && p.tls.ServerName == "" {
+			p.tls.ServerName, _, _ = net.SplitHostPort(opt.Addr)
+		}
+	}
+
+	return p
+}
+
+// Get returns an idle connection, or dials a new one
+func (p *RawPool) Get() (*RawConn, error) {
+	for {
+		select {
+		case c := <-p.idle:
+			if time.Since(c.used) < rawIdleTimeout {
+				return c, nil
+			}
+			c.conn.Close()
+		default:
+			return p.dial()
+		}
+	}
+}
+
+// close drops the idle connections, connections in use are dropped when
+// they are closed
+func (p *RawPool) close() {
+	atomic.StoreInt32(&p.closed, 1)
+
+	for {
+		select {
+		case c := <-p.idle:
+			c.conn.Close()
+		default:
+			return
+		}
+	}
+}
+
+func (p *RawPool) dial() (*RawConn, error) {
+	if p.tlsErr != nil {
+		return nil, p.tlsErr
+	}
+
+	conn, err := net.DialTimeout(p.opt.Network, p.opt.Addr, p.opt.getDialTimeout())
+	if err != nil {
+		return nil, err
+	}
+
+	c := &RawConn{pool: p}
+	if err = c.handshake(conn); err != nil {
+		c.conn.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// RawConn is a backend connection of a RawPool
+type RawConn struct {
+	conn net.Conn
+	br   *bufio.Reader
+	bw   *bufio.Writer
+
+	pool *RawPool
+	used time.Time
+	err  error
+}
+
+// handshake sets up TLS and authenticates, within the dial timeout
+func (c *RawConn) handshake(conn net.Conn) error {
+	opt := c.pool.opt
+
+	c.conn = conn
+	c.conn.SetDeadline(time.Now().Add(opt.getDialTimeout()))
+
+	if c.pool.tls != nil {
+		tc := tls.Client(conn, c.pool.tls)
+		if err := tc.Handshake(); err != nil {
+			return err
+		}
+		c.conn = tc
+	}
+
+	c.br = bufio.NewReaderSize(c.conn, rawBufferSize)
+	c.bw = bufio.NewWriterSize(c.conn, rawBufferSize)
+
+	if opt.Password != "" {
+		args := []string{"AUTH", opt.Password}
+		if opt.Username != "" {
+			args = []string{"AUTH", opt.Username, opt.Password}
+		}
+
+		c.bw.WriteString("*" + strconv.Itoa(len(args)) + "\r\n")
+		for _, arg := range args {
+			c.bw.WriteString("$" + strconv.Itoa(len(arg)) + "\r\n" + arg + "\r\n")
+		}
+		if err := c.bw.Flush(); err != nil {
+			return err
+		}
+
+		line, err := c.br.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		if line[0] == '-' {
+			return errors.New(line[1 : len(line)-2])
+		}
+	}
+
+	return c.conn.SetDeadline(time.Time{})
+}
+
+// Reader returns the buffered reader of the connection
+func (c *RawConn) Reader() *bufio.Reader { return c.br }
+
+// Writer returns the buffered writer of the connection
+func (c *RawConn) Writer() *bufio.Writer { return c.bw }
+
+// SetDeadline sets the read and write deadline of the connection
+func (c *RawConn) SetDeadline(t time.Time) error { return c.conn.SetDeadline(t) }
+
+// Fail marks the connection broken, replies may be left unread on it
+func (c *RawConn) Fail(err error) {
+	if c.err == nil {
+		c.err = err
+	}
+}
+
+// Err returns the error the connection failed with
+func (c *RawConn) Err() error { return c.err }
+
+// Close returns the connection to its pool, broken connections and those
+// with unread replies are closed
+func (c *RawConn) Close() error {
+	if c.err != nil || c.br.Buffered() > 0 || c.bw.Buffered() > 0 || atomic.LoadInt32(&c.pool.closed) > 0 {
+		return c.conn.Close()
+	}
+
+	c.conn.SetDeadline(time.Time{})
+	c.used = time.Now()
+
+	select {
+	case c.pool.idle <- c:
+		return nil
+	default:
+		return c.conn.Close()
+	}
+}
@@ -0,0 +1,126 @@
+package balancer
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/tidwall/redcon"
+)
+
+var _ = Describe("RawPool", func() {
+	var addr string
+	var server *redcon.Server
+
+	BeforeEach(func() {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+		addr = ln.Addr().String()
+		ln.Close()
+
+		// ECHO only answers after AUTH app secret
+		server = redcon.NewServer(addr, func(conn redcon.Conn, cmd redcon.Command) {
+			switch strings.ToLower(string(cmd.Args[0])) {
+			case "auth":
+				if len(cmd.Args) == 3 && string(cmd.Args[1]) == "app" && string(cmd.Args[2]) == "secret" {
+					conn.SetContext(true)
+					conn.WriteString("OK")
+					return
+				}
+				conn.WriteError("WRONGPASS invalid username-password pair")
+			case "echo":
+				if conn.Context() == nil {
+					conn.WriteError("NOAUTH Authentication required.")
+					return
+				}
+				conn.WriteBulk(cmd.Args[1])
+			}
+		}, nil, nil)
+
+		signal := make(chan error)
+		go server.ListenServeAndSignal(signal)
+		Expect(<-signal).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	var pool = func(username, password string) *RawPool {
+		opt := mockOpts(addr)
+		opt.MaxIdle = 1
+		opt.Username, opt.Password = username, password
+		return newRawPool(opt)
+	}
+
+	var echo = func(c *RawConn, msg string) string {
+		c.Writer().WriteString("*2\r\n$4\r\nECHO\r\n$" + strconv.Itoa(len(msg)) + "\r\n" + msg + "\r\n")
+		Expect(c.Writer().Flush()).To(Succeed())
+
+		c.SetDeadline(time.Now().Add(time.Second))
+		header, err := c.Reader().ReadString('\n')
+		Expect(err).NotTo(HaveOccurred())
+		if header[0] != '$' {
+			return header
+		}
+
+		data, err := c.Reader().ReadString('\n')
+		Expect(err).NotTo(HaveOccurred())
+		return data[:len(data)-2]
+	}
+
+	It("should authenticate new connections", func() {
+		p := pool("app", "secret")
+		defer p.close()
+
+		c, err := p.Get()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(echo(c, "hello")).To(Equal("hello"))
+		Expect(c.Close()).To(Succeed())
+	})
+
+	It("should fail to dial with wrong credentials", func() {
+		p := pool("app", "wrong")
+		defer p.close()
+
+		_, err := p.Get()
+		Expect(err).To(MatchError("WRONGPASS invalid username-password pair"))
+	})
+
+	It("should reuse idle connections", func() {
+		p := pool("app", "secret")
+		defer p.close()
+
+		c, err := p.Get()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(echo(c, "a")).To(Equal("a"))
+		Expect(c.Close()).To(Succeed())
+
+		again, err := p.Get()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(again).To(BeIdenticalTo(c))
+		again.Close()
+	})
+
+	It("should drop failed connections", func() {
+		p := pool("app", "secret")
+		defer p.close()
+
+		c, err := p.Get()
+		Expect(err).NotTo(HaveOccurred())
+		failure := errors.New("short reply")
+		c.Fail(failure)
+		Expect(c.Err()).To(Equal(failure))
+		c.Close()
+
+		again, err := p.Get()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(again).NotTo(BeIdenticalTo(c))
+		Expect(echo(again, "b")).To(Equal("b"))
+		again.Close()
+	})
+})
@@ -0,0 +1,76 @@
+package balancer
+
+import (
+	"bytes"
+	"hash/crc32"
+	"sort"
+	"strconv"
+)
+
+// ringReplicas is the number of points each shard gets on the ring
+const ringReplicas = 160
+
+// Ring maps keys to shards with consistent hashing, so adding or removing
+// a shard only moves the keys of that shard
+type Ring struct {
+	hashes []uint32
+	owners []int
+}
+
+// NewRing builds a ring of the named shards, owners are reported as the
+// index of the name
+func NewRing(names []string) *Ring {
+	r := &Ring{
+		hashes: make([]uint32, 0, len(names)*ringReplicas),
+		owners: make([]int, 0, len(names)*ringReplicas),
+	}
+
+	points := make(map[uint32]int, len(names)*ringReplicas)
+	for i, name := range names {
+		for replica := 0; replica < ringReplicas; replica++ {
+			h := crc32.ChecksumIEEE([]byte(name + "-" + strconv.Itoa(replica)))
+			if _, ok := points[h]; ok {
+				continue
+			}
+			points[h] = i
+			r.hashes = append(r.hashes, h)
+		}
+	}
+
+	sort.Slice(r.hashes, func(i, j int) bool { return r.hashes[i] < r.hashes[j] })
+	for _, h := range r.hashes {
+		r.owners = append(r.owners, points[h])
+	}
+
+	return r
+}
+
+// Get returns the shard owning the key. Keys with a non-empty {tag} are
+// hashed by the tag only, so related keys can be kept on one shard.
+func (r *Ring) Get(key []byte) int {
+	if len(r.hashes) == 0 {
+		return 0
+	}
+
+	h := crc32.ChecksumIEEE(hashTag(key))
+	i := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= h })
+	if i == len(r.hashes) {
+		i = 0
+	}
+	return r.owners[i]
+}
+
+// hashTag returns the part of the key between the first { and the next },
+// the whole key when there is none
+func hashTag(key []byte) []byte {
+	start := bytes.IndexByte(key, '{')
+	if start < 0 {
+		return key
+	}
+
+	end := bytes.IndexByte(key[start+1:], '}')
+	if end <= 0 {
+		return key
+	}
+	return key[start+1 : start+1+end]
+}
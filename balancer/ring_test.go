@@ -0,0 +1,52 @@
+package balancer
+
+import (
+	"fmt"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Ring", func() {
+
+	It("should spread keys across shards", func() {
+		ring := NewRing([]string{"a", "b", "c"})
+
+		counts := make([]int, 3)
+		for i := 0; i < 3000; i++ {
+			counts[ring.Get([]byte(fmt.Sprintf("key:%d", i)))]++
+		}
+
+		for _, n := range counts {
+			Expect(n).To(BeNumerically(">", 600))
+		}
+	})
+
+	It("should only move keys of a new shard", func() {
+		before := NewRing([]string{"a", "b"})
+		after := NewRing([]string{"a", "b", "c"})
+
+		for i := 0; i < 1000; i++ {
+			key := []byte(fmt.Sprintf("key:%d", i))
+			if owner := after.Get(key); owner != 2 {
+				Expect(owner).To(Equal(before.Get(key)))
+			}
+		}
+	})
+
+	It("should hash keys by their tag", func() {
+		ring := NewRing([]string{"a", "b", "c", "d"})
+
+		owner := ring.Get([]byte("{user:1}.name"))
+		Expect(ring.Get([]byte("{user:1}.email"))).To(Equal(owner))
+		Expect(ring.Get([]byte("user:1"))).To(Equal(owner))
+
+		Expect(hashTag([]byte("{}key"))).To(Equal([]byte("{}key")))
+		Expect(hashTag([]byte("key{"))).To(Equal([]byte("key{")))
+	})
+
+	It("should map everything to the only shard", func() {
+		ring := NewRing([]string{"a"})
+		Expect(ring.Get([]byte("anything"))).To(Equal(0))
+	})
+})
@@ -0,0 +1,62 @@
+package balancer
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("timeouts", func() {
+	var ln net.Listener
+
+	BeforeEach(func() {
+		var err error
+		ln, err = net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+
+		// accept connections and never answer, each is closed once the
+		// client is done with it
+		go func() {
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				go func() {
+					io.Copy(ioutil.Discard, conn)
+					conn.Close()
+				}()
+			}
+		}()
+	})
+
+	AfterEach(func() {
+		ln.Close()
+	})
+
+	It("should fail checks of a hung backend within the read timeout", func() {
+		opt := mockOpts(ln.Addr().String())
+		opt.CheckInterval = time.Hour
+		opt.ReadTimeout = 50 * time.Millisecond
+
+		// the first check runs when the backend is created
+		start := time.Now()
+		rb := newRedisBackend(opt)
+		defer rb.Close()
+
+		Expect(time.Since(start)).To(BeNumerically("<", time.Second))
+		Expect(atomic.LoadInt32(&rb.failures)).To(BeEquivalentTo(1))
+	})
+
+	It("should bound checks by the check interval without a read timeout", func() {
+		opt := mockOpts(ln.Addr().String())
+		opt.CheckInterval = 200 * time.Millisecond
+		Expect(opt.getCheckTimeout()).To(Equal(200 * time.Millisecond))
+		Expect(opt.getDialTimeout()).To(Equal(5 * time.Second))
+	})
+})
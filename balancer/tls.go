@@ -0,0 +1,66 @@
+package balancer
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+)
+
+// TLSOptions configures TLS to a backend
+type TLSOptions struct {
+	Enabled bool
+
+	// CA is the PEM bundle verifying the backend, system roots when empty
+	CA string
+
+	// Cert and Key are the PEM client certificate, if the backend wants one
+	Cert, Key string
+
+	// ServerName is used for SNI and verification, the host of Addr when empty
+	ServerName string
+
+	// SkipVerify disables verification, only meant for tests
+	SkipVerify bool
+}
+
+// config builds the client TLS config
+func (o *TLSOptions) config() (*tls.Config, error) {
+	c := &tls.Config{
+		ServerName:         o.ServerName,
+		InsecureSkipVerify: o.SkipVerify,
+	}
+
+	if o.CA != "" {
+		pool, err := LoadCertPool(o.CA)
+		if err != nil {
+			return nil, err
+		}
+		c.RootCAs = pool
+	}
+
+	if o.Cert != "" || o.Key != "" {
+		cert, err := tls.LoadX509KeyPair(o.Cert, o.Key)
+		if err != nil {
+			return nil, err
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
+
+	return c, nil
+}
+
+// LoadCertPool reads a PEM bundle of certificates
+func LoadCertPool(path string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, errors.New("no certificates found in " + path)
+	}
+
+	return pool, nil
+}
@@ -0,0 +1,132 @@
+package balancer
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/tidwall/redcon"
+)
+
+// writeTestCert writes a self-signed certificate for 127.0.0.1 and its key
+// to dir, returns the file paths
+func writeTestCert(dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).NotTo(HaveOccurred())
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "summitdb"},
+		DNSNames:              []string{"summitdb"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	Expect(err).NotTo(HaveOccurred())
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	Expect(err).NotTo(HaveOccurred())
+
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	Expect(ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)).To(Succeed())
+	Expect(ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)).To(Succeed())
+
+	return certFile, keyFile
+}
+
+var _ = Describe("TLS", func() {
+	var dir, certFile, keyFile, addr string
+	var server *redcon.TLSServer
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "balancer-tls")
+		Expect(err).NotTo(HaveOccurred())
+
+		certFile, keyFile = writeTestCert(dir)
+
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		Expect(err).NotTo(HaveOccurred())
+
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+		addr = ln.Addr().String()
+		ln.Close()
+
+		server = redcon.NewServerTLS(addr, func(conn redcon.Conn, cmd redcon.Command) {
+			if strings.ToLower(string(cmd.Args[0])) == "raftstate" {
+				conn.WriteBulkString("Leader")
+				return
+			}
+			conn.WriteError("ERR unknown command")
+		}, nil, nil, &tls.Config{Certificates: []tls.Certificate{cert}})
+
+		signal := make(chan error)
+		go server.ListenServeAndSignal(signal)
+		Expect(<-signal).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		server.Close()
+		os.RemoveAll(dir)
+	})
+
+	var check = func(opts TLSOptions) *redisBackend {
+		opt := mockOpts(addr)
+		opt.CheckInterval = time.Hour
+		opt.TLS = opts
+
+		rb := newRedisBackend(opt)
+		rb.Close()
+		return rb
+	}
+
+	It("should verify backends with the CA bundle", func() {
+		rb := check(TLSOptions{Enabled: true, CA: certFile})
+		Expect(atomic.LoadInt32(&rb.successes)).To(BeEquivalentTo(1))
+		Expect(rb.Leader()).To(BeTrue())
+	})
+
+	It("should use the server name for verification", func() {
+		rb := check(TLSOptions{Enabled: true, CA: certFile, ServerName: "summitdb"})
+		Expect(atomic.LoadInt32(&rb.successes)).To(BeEquivalentTo(1))
+
+		rb = check(TLSOptions{Enabled: true, CA: certFile, ServerName: "other"})
+		Expect(atomic.LoadInt32(&rb.failures)).To(BeEquivalentTo(1))
+	})
+
+	It("should fail backends with an unknown CA", func() {
+		rb := check(TLSOptions{Enabled: true})
+		Expect(atomic.LoadInt32(&rb.failures)).To(BeEquivalentTo(1))
+	})
+
+	It("should skip verification when asked", func() {
+		rb := check(TLSOptions{Enabled: true, SkipVerify: true})
+		Expect(atomic.LoadInt32(&rb.successes)).To(BeEquivalentTo(1))
+	})
+
+	It("should fail backends with a broken TLS config", func() {
+		rb := check(TLSOptions{Enabled: true, CA: filepath.Join(dir, "missing.pem")})
+		Expect(atomic.LoadInt32(&rb.failures)).To(BeEquivalentTo(1))
+	})
+})
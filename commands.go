@@ -0,0 +1,247 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// commandClass describes how the balancer treats a command
+type commandClass int
+
+const (
+	// classUnknown is for commands SummitDB does not know about
+	classUnknown commandClass = iota
+	// classRead commands can be served by any backend
+	classRead
+	// classWrite commands must be applied by the leader
+	classWrite
+	// classAdmin commands manage the cluster and go to the leader
+	classAdmin
+	// classLocal commands are answered by the balancer itself
+	classLocal
+	// classUnsupported commands are known but cannot be proxied
+	classUnsupported
+)
+
+func (c commandClass) String() string {
+	switch c {
+	case classRead:
+		return "read"
+	case classWrite:
+		return "write"
+	case classAdmin:
+		return "admin"
+	case classLocal:
+		return "local"
+	case classUnsupported:
+		return "unsupported"
+	default:
+		return "unknown"
+	}
+}
+
+// commandInfo holds the routing details of a command
+type commandInfo struct {
+	name  string
+	class commandClass
+
+	// keys are the args from firstKey to lastKey every keyStep, lastKey -1
+	// is the last arg, numKeys commands take the key count as second arg
+	firstKey, lastKey, keyStep int
+	numKeys                    bool
+
+	// fanOut commands run on every shard, their replies are merged
+	fanOut bool
+
+	// stream commands may reply huge arrays, which are relayed to the
+	// client as they arrive
+	stream bool
+
+	// indexRead commands reply in index order over all keys, which can't
+	// be merged from several shards
+	indexRead bool
+}
+
+// leader returns true if the command has to be sent to the leader
+func (ci commandInfo) leader() bool {
+	return ci.class == classWrite || ci.class == classAdmin
+}
+
+// category returns the ACL category of the command, empty for commands
+// every authenticated user may run
+func (ci commandInfo) category() string {
+	switch ci.class {
+	case classRead, classWrite, classAdmin:
+		return ci.class.String()
+	}
+
+	switch ci.name {
+	case "plget", "psubscribe", "subscribe":
+		return classRead.String()
+	case "plset":
+		return classWrite.String()
+	case "metrics", "monitor", "reload":
+		return classAdmin.String()
+	}
+	return ""
+}
+
+// keys returns the keys in the command args
+func (ci commandInfo) keys(args [][]byte) [][]byte {
+	first, last := ci.firstKey, ci.lastKey
+	if ci.numKeys {
+		if len(args) < 3 {
+			return nil
+		}
+
+		n, err := strconv.Atoi(string(args[2]))
+		if err != nil || n < 0 {
+			return nil
+		}
+		first, last = 3, 2+n
+	}
+
+	if first == 0 {
+		return nil
+	}
+
+	if last < 0 || last >= len(args) {
+		last = len(args) - 1
+	}
+
+	var keys [][]byte
+	for i := first; i <= last; i += ci.keyStep {
+		keys = append(keys, args[i])
+	}
+	return keys
+}
+
+// commandTable covers the whole SummitDB command set, keyed by lowercase name
+var commandTable = map[string]commandInfo{}
+
+func init() {
+	register(classRead,
+		// keys and strings
+		"bitcount", "bitpos", "dbsize", "dump", "exists", "get", "getbit",
+		"getrange", "keys", "mget", "pttl", "strlen", "ttl", "type",
+		// json
+		"jget",
+		// indexes and iteration
+		"indexes", "iter", "rect", "riter",
+		// scripts
+		"evalro", "evalsharo",
+		// connection
+		"echo", "ping",
+	)
+
+	register(classWrite,
+		// keys and strings
+		"append", "bitop", "decr", "decrby", "del", "expire", "expireat",
+		"flushdb", "getset", "incr", "incrby", "incrbyfloat", "mset", "msetnx",
+		"pdel", "persist", "pexpire", "pexpireat", "rename", "renamenx",
+		"restore", "set", "setbit", "setrange",
+		// json
+		"jdel", "jset",
+		// indexes
+		"delindex", "setindex",
+		// scripts
+		"eval", "evalsha", "script",
+		// server
+		"fence", "massinsert",
+		// pub/sub
+		"publish",
+	)
+
+	register(classAdmin,
+		"backup", "raftaddpeer", "raftleader", "raftpeers", "raftremovepeer",
+		"raftsnapshot", "raftstate", "raftstats",
+	)
+
+	register(classLocal,
+		"auth", "metrics", "monitor", "plget", "plset", "quit", "reload",
+		"sb.readpref",
+		// transactions pin a leader connection to the client session
+		"discard", "exec", "multi",
+		// subscribers get a dedicated backend connection
+		"psubscribe", "punsubscribe", "subscribe", "unsubscribe",
+	)
+
+	register(classUnsupported,
+		// SummitDB has no optimistic locking
+		"unwatch", "watch",
+		// connection state can not be shared across the pool
+		"client", "select",
+	)
+
+	// reads and writes take a single key unless listed here, the KEYS and
+	// PDEL patterns count as keys
+	keySpec(0, 0, 0,
+		"dbsize", "echo", "ping", "flushdb", "fence", "massinsert", "script",
+		"indexes", "iter", "rect", "riter", "delindex", "setindex", "publish",
+	)
+	keySpec(1, -1, 1, "del", "exists", "mget", "plget")
+	keySpec(1, -1, 2, "mset", "msetnx", "plset")
+	keySpec(1, 2, 1, "rename", "renamenx")
+	keySpec(2, -1, 1, "bitop")
+
+	for _, name := range []string{"eval", "evalro", "evalsha", "evalsharo"} {
+		ci := commandTable[name]
+		ci.numKeys, ci.keyStep = true, 1
+		commandTable[name] = ci
+	}
+
+	// commands over the whole keyspace or the index definitions
+	for _, name := range []string{"dbsize", "delindex", "flushdb", "keys", "pdel", "setindex"} {
+		ci := commandTable[name]
+		ci.fanOut = true
+		commandTable[name] = ci
+	}
+
+	for _, name := range []string{"iter", "keys", "riter"} {
+		ci := commandTable[name]
+		ci.stream = true
+		commandTable[name] = ci
+	}
+
+	for _, name := range []string{"iter", "rect", "riter"} {
+		ci := commandTable[name]
+		ci.indexRead = true
+		commandTable[name] = ci
+	}
+}
+
+func register(class commandClass, names ...string) {
+	for _, name := range names {
+		ci := commandInfo{name: name, class: class}
+		if class == classRead || class == classWrite {
+			ci.firstKey, ci.lastKey, ci.keyStep = 1, 1, 1
+		}
+		commandTable[name] = ci
+	}
+}
+
+func keySpec(first, last, step int, names ...string) {
+	for _, name := range names {
+		ci := commandTable[name]
+		ci.firstKey, ci.lastKey, ci.keyStep = first, last, step
+		commandTable[name] = ci
+	}
+}
+
+// lookupCommand returns the command details for a lowercase command name
+func lookupCommand(name string) commandInfo {
+	if ci, ok := commandTable[name]; ok {
+		return ci
+	}
+	return commandInfo{name: name, class: classUnknown}
+}
+
+// commandError returns the error message sent for commands that can't be served
+func commandError(ci commandInfo) string {
+	switch ci.class {
+	case classUnsupported:
+		return fmt.Sprintf("ERR command '%s' not supported by balancer", ci.name)
+	default:
+		return fmt.Sprintf("ERR unknown command '%s'", ci.name)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"github.com/gomodule/redigo/redis"
+	"github.com/masomo/summitdb-balancer/summitdbtest"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("commands", func() {
+
+	DescribeTable("should classify commands",
+		func(name string, class commandClass) {
+			Expect(lookupCommand(name).class).To(Equal(class))
+		},
+		Entry("reads", "get", classRead),
+		Entry("iteration", "iter", classRead),
+		Entry("read only scripts", "evalro", classRead),
+		Entry("writes", "del", classWrite),
+		Entry("json writes", "jdel", classWrite),
+		Entry("index writes", "setindex", classWrite),
+		Entry("mass inserts", "massinsert", classWrite),
+		Entry("cluster management", "raftaddpeer", classAdmin),
+		Entry("balancer commands", "plget", classLocal),
+		Entry("transactions", "multi", classLocal),
+		Entry("optimistic locking", "watch", classUnsupported),
+		Entry("typos", "gte", classUnknown),
+	)
+
+	DescribeTable("should find the keys in the args",
+		func(args []string, keys []string) {
+			bargs := make([][]byte, len(args))
+			for i, arg := range args {
+				bargs[i] = []byte(arg)
+			}
+
+			var found []string
+			for _, key := range lookupCommand(args[0]).keys(bargs) {
+				found = append(found, string(key))
+			}
+			Expect(found).To(Equal(keys))
+		},
+		Entry("single key", []string{"get", "a"}, []string{"a"}),
+		Entry("all args", []string{"del", "a", "b", "c"}, []string{"a", "b", "c"}),
+		Entry("key value pairs", []string{"mset", "a", "1", "b", "2"}, []string{"a", "b"}),
+		Entry("source and destination", []string{"rename", "a", "b"}, []string{"a", "b"}),
+		Entry("after the operation", []string{"bitop", "and", "d", "a", "b"}, []string{"d", "a", "b"}),
+		Entry("script key count", []string{"eval", "return 1", "2", "a", "b", "c"}, []string{"a", "b"}),
+		Entry("bad script key count", []string{"eval", "return 1", "x"}, nil),
+		Entry("no keys", []string{"flushdb"}, nil),
+	)
+
+	It("should explain why a command can't be served", func() {
+		Expect(commandError(lookupCommand("watch"))).To(Equal("ERR command 'watch' not supported by balancer"))
+		Expect(commandError(lookupCommand("gte"))).To(Equal("ERR unknown command 'gte'"))
+	})
+
+	Context("through the proxy", func() {
+		var cluster *summitdbtest.Cluster
+		var p *proxy
+		var client redis.Conn
+
+		BeforeEach(func() {
+			var err error
+			cluster, err = summitdbtest.NewCluster(3)
+			Expect(err).NotTo(HaveOccurred())
+
+			p = startClusterProxy(&Config{LoadBalancer: loadBalancer{MaxIdle: 4, Routing: true}}, cluster)
+
+			client, err = p.dial()
+			Expect(err).NotTo(HaveOccurred())
+
+			for _, node := range cluster.Nodes {
+				node.ResetCounts()
+			}
+		})
+
+		AfterEach(func() {
+			client.Close()
+			p.close()
+			Expect(cluster.Close()).To(Succeed())
+		})
+
+		It("should reject unknown and unsupported commands", func() {
+			_, err := client.Do("GTE", "a")
+			Expect(err).To(MatchError("ERR unknown command 'gte'"))
+
+			_, err = client.Do("WATCH", "a")
+			Expect(err).To(MatchError("ERR command 'watch' not supported by balancer"))
+
+			for _, node := range cluster.Nodes {
+				Expect(node.Count("gte")).To(BeZero())
+				Expect(node.Count("watch")).To(BeZero())
+			}
+		})
+
+		It("should send every write to the leader", func() {
+			for _, cmd := range [][]interface{}{
+				{"DEL", "a"}, {"INCRBY", "a", 1}, {"APPEND", "a", "b"}, {"JDEL", "a", "b"},
+				{"SETINDEX", "i", "*", "JSON", "a"}, {"EVAL", "return 1", 0},
+			} {
+				// the fake knows none of them, the leader answers anyway
+				client.Do(cmd[0].(string), cmd[1:]...)
+			}
+
+			for _, name := range []string{"del", "incrby", "append", "jdel", "setindex", "eval"} {
+				Expect(cluster.Nodes[0].Count(name)).To(Equal(1), name)
+				Expect(cluster.Nodes[1].Count(name)+cluster.Nodes[2].Count(name)).To(BeZero(), name)
+			}
+		})
+
+		It("should spread reads over the followers", func() {
+			for i := 0; i < 10; i++ {
+				Expect(client.Do("GET", "a")).To(BeNil())
+			}
+
+			Expect(cluster.Nodes[0].Count("get")).To(BeZero())
+			Expect(cluster.Nodes[1].Count("get") + cluster.Nodes[2].Count("get")).To(Equal(10))
+		})
+	})
+})
@@ -2,23 +2,112 @@ package main
 
 import (
 	"bytes"
+	"fmt"
 	"os"
 	"time"
 
+	"github.com/masomo/summitdb-balancer/balancer"
 	yaml "gopkg.in/yaml.v2"
 )
 
 // Config structure
 type Config struct {
 	LoadBalancer loadBalancer
+	Admin        admin
+	TLS          listenerTLS
+	Auth         auth
+	RateLimit    rateLimits
+
+	// ShutdownTimeout bounds the wait for in-flight commands on shutdown
+	ShutdownTimeout time.Duration
+}
+
+func (c *Config) getShutdownTimeout() time.Duration {
+	if c.ShutdownTimeout <= 0 {
+		return defaultShutdownTimeout
+	}
+	return c.ShutdownTimeout
+}
+
+// listenerTLS configures TLS on the client listener, it is read on startup
+type listenerTLS struct {
+	Cert, Key string
+
+	// ClientCA is the PEM bundle verifying client certificates, clients
+	// must present one when set
+	ClientCA string
+}
+
+type admin struct {
+	Addr string
 }
 
 type loadBalancer struct {
-	Upstream    []backend
+	Upstream []backend
+
+	// Shards are independent clusters the keys are spread over, Upstream
+	// is a single shard when none are set
+	Shards []shardConfig
+
 	MaxIdle     int
 	Mode        string
 	HealthCheck bool
 	Routing     bool
+
+	Discovery         bool
+	DiscoveryInterval time.Duration
+
+	Retry   retry
+	Outlier balancer.OutlierOptions
+
+	// ReadYourWrites keeps reads of a connection on the leader after it wrote
+	ReadYourWrites readYourWrites
+
+	// timeouts for all upstreams, upstreams may override them
+	DialTimeout  time.Duration
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+
+	// CommandTimeout is the deadline for a backend reply to a command
+	CommandTimeout time.Duration
+
+	// StreamThreshold streams the replies of all reads once they exceed
+	// it in bytes, 0 streams only the commands flagged in the table
+	StreamThreshold int
+
+	// Passthrough forwards commands as received and relays their replies
+	// without decoding them
+	Passthrough bool
+
+	// TLS to all upstreams
+	TLS balancer.TLSOptions
+
+	// credentials for all upstreams, upstreams may override them
+	Username string
+	Password string
+}
+
+// readYourWrites sends the reads of a connection that wrote within the
+// window to the leader, with routing on, so it sees its own writes. Fence
+// also commits a FENCE through raft before each of them, which confirms
+// the leader is still in charge.
+type readYourWrites struct {
+	Window time.Duration
+	Fence  bool
+}
+
+// shardConfig is a cluster holding part of the keys, the name places it on
+// the hash ring so renaming a shard moves its keys
+type shardConfig struct {
+	Name     string
+	Upstream []backend
+}
+
+// retry holds the number of retries after connection errors, writes are
+// only retried when the connection could not be made
+type retry struct {
+	Reads  int
+	Writes int
 }
 
 type backend struct {
@@ -26,6 +115,43 @@ type backend struct {
 	CheckInterval time.Duration
 	Rise          int
 	Fall          int
+
+	DialTimeout  time.Duration
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+
+	// ServerName overrides the TLS server name of the upstream
+	ServerName string
+
+	Username string
+	Password string
+}
+
+// getDiscoveryInterval returns the discovery interval, 0 when discovery is off
+func (lb *loadBalancer) getDiscoveryInterval() time.Duration {
+	if !lb.Discovery {
+		return 0
+	} else if lb.DiscoveryInterval == 0 {
+		return 5 * time.Second
+	}
+	return lb.DiscoveryInterval
+}
+
+// shards returns the configured shards, the top level upstream list when
+// none are set
+func (lb *loadBalancer) shards() []shardConfig {
+	if len(lb.Shards) == 0 {
+		return []shardConfig{{Name: defaultShard, Upstream: lb.Upstream}}
+	}
+	return lb.Shards
+}
+
+// orDefault returns d when v is not set
+func orDefault(v, d time.Duration) time.Duration {
+	if v == 0 {
+		return d
+	}
+	return v
 }
 
 func readConfig(path string) (c *Config, err error) {
@@ -45,5 +171,18 @@ func readConfig(path string) (c *Config, err error) {
 		return nil, err
 	}
 
+	err = c.RateLimit.parse()
+	if err != nil {
+		return nil, err
+	}
+
+	names := make(map[string]bool)
+	for _, sc := range c.LoadBalancer.Shards {
+		if sc.Name == "" || names[sc.Name] {
+			return nil, fmt.Errorf("shards: missing or duplicate name %q", sc.Name)
+		}
+		names[sc.Name] = true
+	}
+
 	return
 }
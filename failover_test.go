@@ -0,0 +1,271 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/masomo/summitdb-balancer/balancer"
+	"github.com/masomo/summitdb-balancer/summitdbtest"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// checkInterval is the health check interval of the failover specs, the
+// minimum the balancer allows
+const checkInterval = 100 * time.Millisecond
+
+// outcome is the result of a command sent by the traffic of a spec
+type outcome struct {
+	sent, done time.Time
+	err        error
+}
+
+var _ = Describe("failover", func() {
+	var cluster *summitdbtest.Cluster
+	var nodes []*summitdbtest.Server
+	var p *proxy
+	var client redis.Conn
+
+	var stats = func() map[string]balancer.BackendStats {
+		stats := make(map[string]balancer.BackendStats)
+		for _, s := range p.sb.shards().shards[0].balancer.Stats() {
+			stats[s.Addr] = s
+		}
+		return stats
+	}
+
+	var up = func(node *summitdbtest.Server) func() bool {
+		return func() bool { return stats()[node.Addr()].Up }
+	}
+
+	var leads = func(node *summitdbtest.Server) func() bool {
+		return func() bool { return stats()[node.Addr()].Leader }
+	}
+
+	var resetCounts = func() {
+		for _, node := range nodes {
+			node.ResetCounts()
+		}
+	}
+
+	// traffic sends writes until stop is closed, their outcomes are sent
+	// on the returned channel once it is
+	var traffic = func(stop chan struct{}) chan []outcome {
+		done := make(chan []outcome, 1)
+
+		go func() {
+			defer GinkgoRecover()
+
+			conn, err := p.dial()
+			Expect(err).NotTo(HaveOccurred())
+			defer conn.Close()
+
+			var outcomes []outcome
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					done <- outcomes
+					return
+				default:
+				}
+
+				sent := time.Now()
+				_, err := conn.Do("SET", "traffic", i)
+				outcomes = append(outcomes, outcome{sent: sent, done: time.Now(), err: err})
+				time.Sleep(time.Millisecond)
+			}
+		}()
+
+		return done
+	}
+
+	BeforeEach(func() {
+		var err error
+		cluster, err = summitdbtest.NewCluster(3)
+		Expect(err).NotTo(HaveOccurred())
+		nodes = cluster.Nodes
+
+		var upstream []backend
+		for _, addr := range cluster.Addrs() {
+			upstream = append(upstream, backend{
+				Host: addr, Rise: 2, Fall: 2, CheckInterval: checkInterval,
+				DialTimeout: 200 * time.Millisecond,
+			})
+		}
+
+		p, err = startProxy(&Config{LoadBalancer: loadBalancer{
+			Mode:           "roundrobin",
+			MaxIdle:        8,
+			Routing:        true,
+			Retry:          retry{Reads: 2, Writes: 1},
+			CommandTimeout: time.Second,
+			Upstream:       upstream,
+		}})
+		Expect(err).NotTo(HaveOccurred())
+
+		for _, node := range nodes {
+			Eventually(up(node), time.Second, 10*time.Millisecond).Should(BeTrue())
+		}
+		Eventually(leads(nodes[0]), time.Second, 10*time.Millisecond).Should(BeTrue())
+
+		client, err = p.dial()
+		Expect(err).NotTo(HaveOccurred())
+
+		resetCounts()
+	})
+
+	AfterEach(func() {
+		client.Close()
+		p.close()
+		Expect(cluster.Close()).To(Succeed())
+	})
+
+	It("should route writes to the leader and reads to followers", func() {
+		for i := 0; i < 30; i++ {
+			Expect(client.Do("SET", fmt.Sprintf("key:%d", i), i)).To(Equal("OK"))
+			Expect(redis.Int(client.Do("GET", fmt.Sprintf("key:%d", i)))).To(Equal(i))
+		}
+
+		Expect(nodes[0].Count("set")).To(Equal(30))
+		Expect(nodes[0].Count("get")).To(BeZero())
+
+		for _, follower := range nodes[1:] {
+			Expect(follower.Count("set")).To(BeZero())
+			Expect(follower.Count("get")).To(BeNumerically(">", 0))
+		}
+		Expect(nodes[1].Count("get") + nodes[2].Count("get")).To(Equal(30))
+	})
+
+	It("should follow a leader change without errors", func() {
+		stop := make(chan struct{})
+		done := traffic(stop)
+
+		time.Sleep(5 * checkInterval)
+		cluster.Elect(1)
+
+		// writes redirected by the old leader succeed until the checks
+		// notice the change
+		Eventually(leads(nodes[1]), time.Second, 10*time.Millisecond).Should(BeTrue())
+		Eventually(leads(nodes[0]), time.Second, 10*time.Millisecond).Should(BeFalse())
+
+		time.Sleep(5 * checkInterval)
+		close(stop)
+
+		outcomes := <-done
+		Expect(outcomes).NotTo(BeEmpty())
+		for _, o := range outcomes {
+			Expect(o.err).NotTo(HaveOccurred())
+		}
+
+		resetCounts()
+		for i := 0; i < 10; i++ {
+			Expect(client.Do("SET", "moved", i)).To(Equal("OK"))
+		}
+		Expect(nodes[1].Count("set")).To(Equal(10))
+		Expect(nodes[0].Count("set")).To(BeZero())
+	})
+
+	It("should recover writes once a killed leader is replaced", func() {
+		stop := make(chan struct{})
+		done := traffic(stop)
+
+		time.Sleep(5 * checkInterval)
+
+		// the cluster votes for a while after losing its leader
+		killed := time.Now()
+		Expect(nodes[0].Stop()).To(Succeed())
+		nodes[1].SetState(summitdbtest.Candidate, "")
+		nodes[2].SetState(summitdbtest.Candidate, "")
+
+		time.Sleep(3 * checkInterval)
+		elected := time.Now()
+		nodes[1].SetState(summitdbtest.Leader, nodes[1].Addr())
+		nodes[2].SetState(summitdbtest.Follower, nodes[1].Addr())
+
+		// candidates fail the checks, so writes recover once the new
+		// leader rose again
+		Eventually(func() bool {
+			s := stats()[nodes[1].Addr()]
+			return s.Up && s.Leader
+		}, time.Second, 5*time.Millisecond).Should(BeTrue())
+		recovered := time.Now()
+
+		Expect(up(nodes[0])()).To(BeFalse())
+		Expect(recovered.Sub(elected)).To(BeNumerically("<", 4*checkInterval))
+
+		time.Sleep(5 * checkInterval)
+		close(stop)
+
+		var failed int
+		for _, o := range <-done {
+			switch {
+			case o.done.Before(killed):
+				Expect(o.err).NotTo(HaveOccurred())
+			case o.sent.After(recovered):
+				Expect(o.err).NotTo(HaveOccurred(), "write failed after recovery")
+			case o.err != nil:
+				failed++
+			}
+		}
+
+		// writes fail while the cluster has no leader
+		Expect(failed).To(BeNumerically(">", 0))
+
+		resetCounts()
+		for i := 0; i < 10; i++ {
+			Expect(client.Do("SET", "recovered", i)).To(Equal("OK"))
+		}
+		Expect(nodes[1].Count("set")).To(Equal(10))
+	})
+
+	It("should take a failing follower out after fall checks", func() {
+		nodes[2].SetFault("raftstate", summitdbtest.Fault{Error: "ERR boom"})
+
+		// a single failed check leaves it up
+		var first balancer.BackendStats
+		Eventually(func() int {
+			first = stats()[nodes[2].Addr()]
+			return first.Failures
+		}, time.Second, 5*time.Millisecond).Should(Equal(1))
+		Expect(first.Up).To(BeTrue())
+
+		Eventually(up(nodes[2]), time.Second, 10*time.Millisecond).Should(BeFalse())
+
+		resetCounts()
+		for i := 0; i < 20; i++ {
+			Expect(client.Do("GET", "key")).To(BeNil())
+		}
+		Expect(nodes[2].Count("get")).To(BeZero())
+		Expect(nodes[1].Count("get")).To(Equal(20))
+	})
+
+	It("should bring a restarted node back after rise checks", func() {
+		Expect(nodes[2].Stop()).To(Succeed())
+		Eventually(up(nodes[2]), time.Second, 10*time.Millisecond).Should(BeFalse())
+
+		Expect(nodes[2].Start()).To(Succeed())
+		started := time.Now()
+
+		// rise 2 takes a second check an interval after the first
+		Consistently(up(nodes[2]), checkInterval/2, 10*time.Millisecond).Should(BeFalse())
+		Eventually(up(nodes[2]), time.Second, 10*time.Millisecond).Should(BeTrue())
+		Expect(time.Since(started)).To(BeNumerically(">=", checkInterval/2))
+
+		resetCounts()
+		for i := 0; i < 20; i++ {
+			client.Do("GET", "key")
+		}
+		Expect(nodes[2].Count("get")).To(Equal(10))
+	})
+
+	It("should retry reads dropped by a follower on another one", func() {
+		nodes[2].SetFault("get", summitdbtest.Fault{Drop: true})
+
+		for i := 0; i < 20; i++ {
+			Expect(client.Do("GET", "key")).To(BeNil())
+		}
+		Expect(nodes[2].Count("get")).To(BeNumerically(">", 0))
+		Expect(nodes[1].Count("get")).To(BeNumerically(">=", 10))
+	})
+})
@@ -1,22 +1,24 @@
 package main
 
 import (
-	"bytes"
+	"crypto/tls"
 	"encoding/json"
-	"errors"
 	"flag"
 	"fmt"
+	"net"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
 	"os/signal"
-	"reflect"
 	"runtime"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
-	"github.com/gomodule/redigo/redis"
 	"github.com/masomo/summitdb-balancer/balancer"
+	"github.com/prometheus/client_golang/prometheus"
 	metrics "github.com/rcrowley/go-metrics"
 	"github.com/semihalev/log"
 	"github.com/tidwall/redcon"
@@ -24,12 +26,16 @@ import (
 
 // SummitDBBalancer structure
 type SummitDBBalancer struct {
-	balancer *balancer.Balancer
+	// shardSet holds the current *shardSet, replaced on reload
+	shardSet atomic.Value
 }
 
 const (
 	metricPrefix = "sb"
 	version      = "v0.1"
+
+	// maxRedirects bounds the leader redirects followed for a single command
+	maxRedirects = 3
 )
 
 var (
@@ -41,36 +47,83 @@ var (
 )
 
 var (
-	redisMonitorCh = make(chan string)
+	// config holds the current *Config, replaced on reload
+	config atomic.Value
 
-	config *Config
+	// reloadMu serializes config reloads
+	reloadMu sync.Mutex
 )
 
+func getConfig() *Config { return config.Load().(*Config) }
+
 func (sb *SummitDBBalancer) onRedisConnect(conn redcon.Conn) bool {
 	log.Info("Redis new connection", "remote", conn.RemoteAddr())
+	conn.SetContext(new(session))
 	return true
 }
 
 func (sb *SummitDBBalancer) onRedisCommand(conn redcon.Conn, cmd redcon.Command) {
 	command := strings.ToLower(string(cmd.Args[0]))
+	if lookupCommand(command).class == classUnknown {
+		// don't register a metric for every typo sent by clients
+		command = "unknown"
+	}
+
+	s := getSession(conn)
+	if !enterBatch(conn, s) {
+		return
+	}
+	defer leaveBatch(conn, s)
+
+	// commands batched with this one are consumed from the pipeline
+	var pcmds []redcon.Command
+	monitored, limited := monitors.enabled(), getConfig().RateLimit.enabled()
+	if monitored || limited {
+		pcmds = conn.PeekPipeline()
+	}
+
+	s.routed("", 0)
+	s.piped = s.piped[:0]
 
 	start := time.Now()
 
 	sb.redisCommandNext(conn, cmd)
 
+	// a one-shot read preference is used up by the command after it
+	if command != "sb.readpref" {
+		s.prefOnce = false
+	}
+
+	if monitored || limited {
+		pcmds = pcmds[:len(pcmds)-len(conn.PeekPipeline())]
+	}
+
+	if limited {
+		sb.charge(conn, pcmds)
+	}
+
 	commandMetric := metrics.GetOrRegisterTimer(fmt.Sprintf("%s.command.%s", metricPrefix, command), nil)
 	commandMetric.UpdateSince(start)
+	commandDuration.WithLabelValues(command).Observe(time.Since(start).Seconds())
 
-	redisMonitor(conn, cmd)
+	if monitored {
+		sb.publish(conn, s, cmd, pcmds)
+	}
 }
 
-// monitor middleware
-func redisMonitor(conn redcon.Conn, cmd redcon.Command) {
-	select {
-	case redisMonitorCh <- fmt.Sprintf("- %s [%s] |%s|",
-		time.Now().Format("2006/01/02 15:04:05.00"),
-		conn.RemoteAddr(), string(bytes.Join(cmd.Args, []byte(" ")))):
-	default:
+// publish reports the command and the pipelined commands served with it
+// to monitors
+func (sb *SummitDBBalancer) publish(conn redcon.Conn, s *session, cmd redcon.Command, pcmds []redcon.Command) {
+	now := time.Now()
+	for i, c := range append([]redcon.Command{cmd}, pcmds...) {
+		r := s.route(i)
+		monitors.publish(&monitorEvent{
+			time:    now,
+			remote:  conn.RemoteAddr(),
+			args:    c.Args,
+			backend: r.backend,
+			latency: r.latency,
+		})
 	}
 }
 
@@ -78,29 +131,72 @@ func (sb *SummitDBBalancer) redisCommandNext(conn redcon.Conn, cmd redcon.Comman
 	var pn int
 	var err error
 
-	pn, cmd, err = pipelineCommand(conn, cmd)
-	if err != nil {
-		conn.WriteError("ERR " + err.Error())
+	if !sb.authenticated(conn, cmd) || !sb.permitted(conn, cmd) {
+		return
 	}
 
-	switch qcmdlower(cmd.Args[0]) {
-	case "monitor":
-		dc := conn.Detach()
-		go func() {
-			defer dc.Close()
+	// pipelines with denied commands or over the rate limits are dispatched
+	// one by one, so each command gets its own reply, as are commands after
+	// a one-shot read preference, which is for the first of them only
+	s := getSession(conn)
+	batch := !s.inTx() && pipelinePermitted(conn) && !s.prefOnce && sb.pipelineAllowed(conn, cmd)
 
-			dc.WriteString("OK")
-			dc.Flush()
+	release, batch, ok := sb.admit(conn, cmd, batch)
+	if !ok {
+		return
+	}
+	defer release()
 
-			for {
-				dc.WriteString(<-redisMonitorCh)
+	if s.inTx() {
+		sb.txCommand(conn, cmd, lookupCommand(qcmdlower(cmd.Args[0])))
+		return
+	}
 
-				err := dc.Flush()
-				if err != nil {
-					break
-				}
-			}
-		}()
+	if batch {
+		pn, cmd, err = pipelineCommand(conn, cmd)
+		if err != nil {
+			conn.WriteError("ERR " + err.Error())
+		}
+	}
+
+	// mixed pipelines are batched per route instead of GET/SET only
+	if pn == 0 && batch && sb.pipeline(conn, cmd) {
+		return
+	}
+
+	ci := lookupCommand(qcmdlower(cmd.Args[0]))
+	switch ci.class {
+	case classUnknown, classUnsupported:
+		conn.WriteError(commandError(ci))
+		return
+	}
+
+	switch ci.name {
+	case "quit":
+		conn.WriteString("OK")
+		conn.Close()
+	case "auth":
+		sb.auth(conn, cmd)
+	case "monitor":
+		sb.monitor(conn, cmd)
+	case "sb.readpref":
+		sb.readPreference(conn, cmd)
+	case "subscribe", "psubscribe":
+		sb.subscribe(conn, cmd)
+	case "unsubscribe", "punsubscribe":
+		sb.unsubscribe(conn, cmd)
+	case "multi":
+		sb.multi(conn)
+	case "exec", "discard":
+		sb.txDo(conn, cmd, ci)
+	case "reload":
+		err := sb.reload()
+		if err != nil {
+			conn.WriteError("ERR " + err.Error())
+			return
+		}
+
+		conn.WriteString("OK")
 	case "metrics":
 		data, err := json.Marshal(metrics.DefaultRegistry.GetAll())
 		if err != nil {
@@ -110,7 +206,7 @@ func (sb *SummitDBBalancer) redisCommandNext(conn redcon.Conn, cmd redcon.Comman
 
 		conn.WriteBulk(data)
 	case "plget":
-		resp, err := sb.plget(cmd)
+		resp, err := sb.mget(getSession(conn), cmd.Args[1:])
 		if err != nil {
 			respPipeline(conn, pn, err)
 			return
@@ -124,7 +220,7 @@ func (sb *SummitDBBalancer) redisCommandNext(conn redcon.Conn, cmd redcon.Comman
 			conn.WriteBulk(val.([]byte))
 		}
 	case "plset":
-		err := sb.plset(cmd)
+		err := sb.mset(getSession(conn), cmd.Args[1:])
 		if err != nil {
 			respPipeline(conn, pn, err)
 			return
@@ -134,140 +230,112 @@ func (sb *SummitDBBalancer) redisCommandNext(conn redcon.Conn, cmd redcon.Comman
 			conn.WriteString("OK")
 		}
 	default:
-		sb.Do(conn, cmd)
+		sb.Do(conn, cmd, ci)
 	}
 }
 
 func (sb *SummitDBBalancer) onRedisClose(conn redcon.Conn, err error) {
 	log.Info("Redis connection closed", "remote", conn.RemoteAddr())
+	getSession(conn).release()
 }
 
-func (sb *SummitDBBalancer) plget(cmd redcon.Command) ([]interface{}, error) {
-	backend := sb.balancer.Next()
-
-	cmd.Args[0] = []byte("MGET")
+// doBackend runs the command on the backend, following leader redirects
+// from followers for at most maxRedirects hops
+func (sb *SummitDBBalancer) doBackend(s *session, b *balancer.Balancer, backend *balancer.Backend, name string, args []interface{}) (interface{}, error) {
+	reply, _, err := sb.doFollow(s, b, backend, name, args)
+	return reply, err
+}
 
-	client := backend.Pool.Get()
-	defer client.Close()
+// doFollow runs the command like doBackend and returns the backend that
+// replied last, the leader a redirect pointed to
+func (sb *SummitDBBalancer) doFollow(s *session, b *balancer.Balancer, backend *balancer.Backend, name string, args []interface{}) (interface{}, *balancer.Backend, error) {
+	for hops := 0; ; hops++ {
+		reply, err := sb.doOnce(s, b, backend, name, args)
+		if err != nil {
+			return nil, backend, err
+		}
 
-	backendMetric := metrics.GetOrRegisterMeter(fmt.Sprintf("%s.backend.%s", metricPrefix, backend.Addr), nil)
-	backendMetric.Mark(1)
+		addr, ok := redirectAddr(reply)
+		if !ok || hops >= maxRedirects {
+			return reply, backend, nil
+		}
 
-	var args []interface{}
-	for _, arg := range cmd.Args[1:] {
-		args = append(args, arg)
-	}
+		log.Debug("Backend redirected command", "node", backend.Addr, "leader", addr, "command", name)
 
-	reply, err := client.Do(string(cmd.Args[0]), args...)
-	if err != nil {
-		return nil, errors.New("ERR " + err.Error())
-	}
+		redirectMetric := metrics.GetOrRegisterMeter(fmt.Sprintf("%s.redirect", metricPrefix), nil)
+		redirectMetric.Mark(1)
 
-	switch val := reply.(type) {
-	case redis.Error:
-		return nil, errors.New(string(val))
-	case []interface{}:
-		return val, nil
-	default:
-		log.Debug("Invalid response from backend", "response-type", reflect.TypeOf(reply))
-		return nil, errors.New("ERR invalid response")
+		backend = b.Redirect(addr)
 	}
 }
 
-func (sb *SummitDBBalancer) plset(cmd redcon.Command) error {
-	var backend *balancer.Backend
+func (sb *SummitDBBalancer) doOnce(s *session, b *balancer.Balancer, backend *balancer.Backend, name string, args []interface{}) (interface{}, error) {
+	client := backend.Pool.Get()
+	defer client.Close()
 
-	if config.LoadBalancer.Routing {
-		backend = sb.balancer.Leader()
-	} else {
-		backend = sb.balancer.Next()
-	}
+	markBackend(backend, 1)
 
-	cmd.Args[0] = []byte("MSET")
+	start := time.Now()
+	reply, err := backendReply(doWithDeadline(client, name, args...))
+	latency := time.Since(start)
 
-	client := backend.Pool.Get()
-	defer client.Close()
+	b.Observe(backend.Addr, latency, err != nil)
+	s.routed(backend.Addr, latency)
 
-	backendMetric := metrics.GetOrRegisterMeter(fmt.Sprintf("%s.backend.%s", metricPrefix, backend.Addr), nil)
-	backendMetric.Mark(1)
+	return reply, err
+}
 
-	var args []interface{}
-	for _, arg := range cmd.Args[1:] {
-		args = append(args, arg)
+// Do from redis
+func (sb *SummitDBBalancer) Do(conn redcon.Conn, cmd redcon.Command, ci commandInfo) {
+	if sh := sb.forwards(ci, cmd); sh != nil {
+		sb.forward(conn, getSession(conn), sh, ci, cmd)
+		return
 	}
 
-	reply, err := client.Do(string(cmd.Args[0]), args...)
+	reply, err := sb.dispatch(getSession(conn), ci, cmd)
 	if err != nil {
-		return errors.New("ERR " + err.Error())
+		conn.WriteError("ERR " + err.Error())
+		return
 	}
 
-	switch val := reply.(type) {
-	case redis.Error:
-		return errors.New(string(val))
-	case string:
-		return nil
-	default:
-		log.Debug("Invalid response from backend", "response-type", reflect.TypeOf(reply))
-		return errors.New("ERR invalid response")
-	}
+	writeReply(conn, reply)
 }
 
-// Do from redis
-func (sb *SummitDBBalancer) Do(conn redcon.Conn, cmd redcon.Command) {
-	var backend *balancer.Backend
-
-	switch qcmdlower(cmd.Args[0]) {
-	case "set", "jset", "incr":
-		if config.LoadBalancer.Routing {
-			backend = sb.balancer.Leader()
-		} else {
-			backend = sb.balancer.Next()
-		}
-	default:
-		backend = sb.balancer.Next()
-	}
-
-	client := backend.Pool.Get()
-	defer client.Close()
+func newSummitDBBalancer(c *Config) *SummitDBBalancer {
+	sb := new(SummitDBBalancer)
+	sb.updateShards(c)
 
-	backendMetric := metrics.GetOrRegisterMeter(fmt.Sprintf("%s.backend.%s", metricPrefix, backend.Addr), nil)
-	backendMetric.Mark(1)
+	return sb
+}
 
-	var args []interface{}
-	for _, arg := range cmd.Args[1:] {
-		args = append(args, arg)
-	}
+// reload re-reads the config file and applies it to the running balancer
+func (sb *SummitDBBalancer) reload() error {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
 
-	reply, err := client.Do(string(cmd.Args[0]), args...)
+	c, err := readConfig(*flagconfig)
 	if err != nil {
-		conn.WriteError("ERR " + err.Error())
-		return
+		return err
 	}
 
-	switch val := reply.(type) {
-	case redis.Error:
-		conn.WriteError(string(val))
-	case string:
-		conn.WriteString(val)
-	case []byte:
-		conn.WriteBulk(val)
-	case int64:
-		conn.WriteInt64(val)
-	case []interface{}:
-		writeArray(conn, val)
-	case nil:
-		conn.WriteNull()
-	default:
-		log.Debug("Invalid response from backend", "response-type", reflect.TypeOf(reply))
-		conn.WriteError("ERR invalid response")
+	shards := c.LoadBalancer.shards()
+	for _, sc := range shards {
+		if len(sc.Upstream) == 0 {
+			return fmt.Errorf("no upstream in config for shard %s", sc.Name)
+		}
 	}
-}
 
-func runBalancer() {
-	sb := new(SummitDBBalancer)
+	sb.updateShards(c)
+	config.Store(c)
 
+	log.Info("Config reloaded", "path", *flagconfig, "shards", len(shards))
+
+	return nil
+}
+
+func backendOptions(c *Config, upstream []backend) []*balancer.Options {
 	var options []*balancer.Options
-	for _, backend := range config.LoadBalancer.Upstream {
+	for _, backend := range upstream {
 		option := &balancer.Options{
 			Network:       "tcp",
 			Addr:          backend.Host,
@@ -275,20 +343,54 @@ func runBalancer() {
 			Rise:          backend.Rise,
 			CheckInterval: backend.CheckInterval,
 
-			MaxIdle: config.LoadBalancer.MaxIdle,
+			MaxIdle: c.LoadBalancer.MaxIdle,
+			Outlier: c.LoadBalancer.Outlier,
+
+			DialTimeout:  orDefault(backend.DialTimeout, c.LoadBalancer.DialTimeout),
+			ReadTimeout:  orDefault(backend.ReadTimeout, c.LoadBalancer.ReadTimeout),
+			WriteTimeout: orDefault(backend.WriteTimeout, c.LoadBalancer.WriteTimeout),
+
+			TLS: c.LoadBalancer.TLS,
+
+			Username: c.LoadBalancer.Username,
+			Password: c.LoadBalancer.Password,
+		}
+		if backend.ServerName != "" {
+			option.TLS.ServerName = backend.ServerName
+		}
+		if backend.Password != "" {
+			option.Username, option.Password = backend.Username, backend.Password
 		}
 		options = append(options, option)
 	}
+	return options
+}
 
-	sb.balancer = balancer.New(options, config.LoadBalancer.Routing, modeFromString(config.LoadBalancer.Mode))
-	defer sb.balancer.Close()
+func runBalancer(sb *SummitDBBalancer, ln net.Listener, served chan<- struct{}) {
+	defer close(served)
 
-	err := redcon.ListenAndServe(*flagaddr, sb.onRedisCommand, sb.onRedisConnect, sb.onRedisClose)
+	server := redcon.NewServer(*flagaddr, sb.onRedisCommand, sb.onRedisConnect, sb.onRedisClose)
+
+	err := server.Serve(ln)
 	if err != nil {
-		log.Crit("Redis server startup failed", "error", err.Error())
+		log.Crit("Redis server failed", "error", err.Error())
 	}
 }
 
+// listen opens the client listener, wrapped for draining on shutdown
+func listen(tlsConfig *tls.Config) (*drainListener, net.Listener, error) {
+	ln, err := net.Listen("tcp", *flagaddr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dl := newDrainListener(ln)
+	if tlsConfig != nil {
+		return dl, tls.NewListener(dl, tlsConfig), nil
+	}
+	return dl, dl, nil
+}
+
 func main() {
 	flag.Parse()
 
@@ -305,12 +407,33 @@ func main() {
 
 	log.Root().SetHandler(log.LvlFilterHandler(lvl, log.StdoutHandler))
 
-	config, err = readConfig(*flagconfig)
+	c, err := readConfig(*flagconfig)
 	if err != nil {
 		log.Crit("Config read failed", "error", err.Error())
 	}
+	config.Store(c)
 
-	go runBalancer()
+	sb := newSummitDBBalancer(c)
+	prometheus.MustRegister(balancer.Collector(func() []*balancer.Balancer {
+		return sb.shards().balancers()
+	}))
+
+	tlsConfig, err := c.TLS.config()
+	if err != nil {
+		log.Crit("Listener TLS config failed", "error", err.Error())
+	}
+
+	dl, ln, err := listen(tlsConfig)
+	if err != nil {
+		log.Crit("Redis server startup failed", "error", err.Error())
+	}
+
+	served := make(chan struct{})
+	go runBalancer(sb, ln, served)
+
+	if c.Admin.Addr != "" {
+		go runAdmin(sb, c.Admin.Addr)
+	}
 
 	if *flagpprof {
 		go func() {
@@ -321,12 +444,28 @@ func main() {
 		}()
 	}
 
-	log.Info("SummitDB balancer service started", "version", version, "addr", *flagaddr)
+	log.Info("SummitDB balancer service started", "version", version, "addr", *flagaddr, "tls", tlsConfig != nil)
 
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, os.Kill)
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
 
-	<-c
+	for s := range sig {
+		if s != syscall.SIGHUP {
+			break
+		}
+
+		if err := sb.reload(); err != nil {
+			log.Error("Config reload failed", "error", err.Error())
+		}
+	}
+
+	timeout := getConfig().getShutdownTimeout()
+	log.Info("SummitDB balancer service stopping", "timeout", timeout)
+
+	if !sb.shutdown(dl, served, timeout) {
+		log.Error("SummitDB balancer service stopped before in-flight commands finished")
+		os.Exit(1)
+	}
 
-	log.Info("SummitDB balancer service stopping")
+	log.Info("SummitDB balancer service stopped")
 }
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/masomo/summitdb-balancer/summitdbtest"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/tidwall/redcon"
+)
+
+func TestSuite(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "summitdb-balancer")
+}
+
+// proxy is a balancer serving clients on a free local port
+type proxy struct {
+	sb     *SummitDBBalancer
+	server *redcon.Server
+	addr   string
+}
+
+// startProxy applies the config and starts serving it
+func startProxy(c *Config) (*proxy, error) {
+	config.Store(c)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	sb := newSummitDBBalancer(c)
+	server := redcon.NewServer(ln.Addr().String(), sb.onRedisCommand, sb.onRedisConnect, sb.onRedisClose)
+	go server.Serve(ln)
+
+	return &proxy{sb: sb, server: server, addr: ln.Addr().String()}, nil
+}
+
+// dial connects a client
+func (p *proxy) dial() (redis.Conn, error) { return redis.Dial("tcp", p.addr) }
+
+// close stops serving and closes the backends
+func (p *proxy) close() {
+	p.server.Close()
+	p.sb.shards().close()
+}
+
+// upstreams returns backends for the addresses that rise on their first
+// check
+func upstreams(addrs []string) []backend {
+	var upstream []backend
+	for _, addr := range addrs {
+		upstream = append(upstream, backend{
+			Host: addr, Rise: 1, Fall: 1, CheckInterval: 100 * time.Millisecond,
+			DialTimeout: 200 * time.Millisecond,
+		})
+	}
+	return upstream
+}
+
+// startClusterProxy starts a proxy in front of the clusters, one shard
+// each when there are several, the mode and a missing upstream of the
+// config are filled in. It returns once the backends are up and the leaders
+// known.
+func startClusterProxy(c *Config, clusters ...*summitdbtest.Cluster) *proxy {
+	if c.LoadBalancer.Mode == "" {
+		c.LoadBalancer.Mode = "roundrobin"
+	}
+
+	if len(clusters) == 1 {
+		if len(c.LoadBalancer.Upstream) == 0 {
+			c.LoadBalancer.Upstream = upstreams(clusters[0].Addrs())
+		}
+	} else {
+		for i, cluster := range clusters {
+			c.LoadBalancer.Shards = append(c.LoadBalancer.Shards, shardConfig{
+				Name: fmt.Sprintf("shard%d", i), Upstream: upstreams(cluster.Addrs()),
+			})
+		}
+	}
+
+	p, err := startProxy(c)
+	Expect(err).NotTo(HaveOccurred())
+
+	Eventually(func() bool {
+		for _, sh := range p.sb.shards().shards {
+			leader := false
+			for _, s := range sh.balancer.Stats() {
+				if !s.Up {
+					return false
+				}
+				leader = leader || s.Leader
+			}
+			if !leader {
+				return false
+			}
+		}
+		return true
+	}, time.Second, 10*time.Millisecond).Should(BeTrue())
+
+	return p
+}
+
+// keyOn returns a key with the prefix that hashes to the shard
+func (p *proxy) keyOn(shard int, prefix string) string {
+	for i := 0; ; i++ {
+		key := fmt.Sprintf("%s:%d", prefix, i)
+		if p.sb.shards().ring.Get([]byte(key)) == shard {
+			return key
+		}
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/semihalev/log"
+	"github.com/tidwall/match"
+	"github.com/tidwall/redcon"
+)
+
+// monitorBuffer is the number of events buffered for each monitor client,
+// events are dropped while the buffer is full
+const monitorBuffer = 1024
+
+// monitors broadcasts the commands served by the balancer to MONITOR clients
+var monitors = newMonitorHub()
+
+// monitorEvent is a command served by the balancer
+type monitorEvent struct {
+	time    time.Time
+	remote  string
+	args    [][]byte
+	backend string
+	latency time.Duration
+}
+
+func (e *monitorEvent) String() string {
+	backend := e.backend
+	if backend == "" {
+		backend = "local"
+	}
+
+	return fmt.Sprintf("- %s [%s] [%s %s] |%s|",
+		e.time.Format("2006/01/02 15:04:05.00"), e.remote, backend, e.latency,
+		string(bytes.Join(e.args, []byte(" "))))
+}
+
+// monitorFilter selects the events sent to a monitor client, empty fields
+// match everything
+type monitorFilter struct {
+	commands []string
+	key      string
+	remote   string
+	backend  string
+}
+
+// parseMonitorFilter parses MONITOR [COMMAND name[,name]] [KEY pattern]
+// [CLIENT addr] [BACKEND addr]
+func parseMonitorFilter(args [][]byte) (monitorFilter, error) {
+	var f monitorFilter
+	for i := 1; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			return f, fmt.Errorf("ERR MONITOR option '%s' needs a value", args[i])
+		}
+
+		value := string(args[i+1])
+		switch qcmdlower(args[i]) {
+		case "command":
+			f.commands = strings.Split(strings.ToLower(value), ",")
+		case "key":
+			f.key = value
+		case "client":
+			f.remote = value
+		case "backend":
+			f.backend = value
+		default:
+			return f, fmt.Errorf("ERR unknown MONITOR option '%s'", args[i])
+		}
+	}
+	return f, nil
+}
+
+func (f *monitorFilter) match(e *monitorEvent) bool {
+	if len(f.commands) > 0 && !contains(f.commands, qcmdlower(e.args[0])) {
+		return false
+	}
+
+	if f.remote != "" && e.remote != f.remote && !strings.HasPrefix(e.remote, f.remote+":") {
+		return false
+	}
+
+	if f.backend != "" && e.backend != f.backend {
+		return false
+	}
+
+	if f.key != "" {
+		for _, key := range lookupCommand(qcmdlower(e.args[0])).keys(e.args) {
+			if match.Match(string(key), f.key) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return true
+}
+
+// monitorSubscriber is a MONITOR client
+type monitorSubscriber struct {
+	remote string
+	filter monitorFilter
+	events chan *monitorEvent
+
+	// dropped counts events lost to a full buffer since the last notice
+	dropped int64
+}
+
+// monitorHub fans events out to all subscribers without blocking the
+// command path
+type monitorHub struct {
+	mu          sync.RWMutex
+	subscribers map[*monitorSubscriber]struct{}
+	active      int32
+}
+
+func newMonitorHub() *monitorHub {
+	return &monitorHub{subscribers: make(map[*monitorSubscriber]struct{})}
+}
+
+// enabled returns true if anyone is monitoring
+func (h *monitorHub) enabled() bool { return atomic.LoadInt32(&h.active) > 0 }
+
+func (h *monitorHub) subscribe(remote string, filter monitorFilter) *monitorSubscriber {
+	sub := &monitorSubscriber{
+		remote: remote,
+		filter: filter,
+		events: make(chan *monitorEvent, monitorBuffer),
+	}
+
+	h.mu.Lock()
+	h.subscribers[sub] = struct{}{}
+	atomic.StoreInt32(&h.active, int32(len(h.subscribers)))
+	h.mu.Unlock()
+
+	monitorSubscribers.Inc()
+	return sub
+}
+
+func (h *monitorHub) unsubscribe(sub *monitorSubscriber) {
+	h.mu.Lock()
+	delete(h.subscribers, sub)
+	atomic.StoreInt32(&h.active, int32(len(h.subscribers)))
+	h.mu.Unlock()
+
+	monitorSubscribers.Dec()
+}
+
+// redacted replaces the credentials of AUTH commands, like Redis does
+var redacted = []byte("(redacted)")
+
+// publish sends the event to every matching subscriber, the args are copied
+// as redcon reuses its buffers. MONITOR itself is not published.
+func (h *monitorHub) publish(e *monitorEvent) {
+	name := qcmdlower(e.args[0])
+	if name == "monitor" {
+		return
+	}
+
+	args := make([][]byte, len(e.args))
+	for i, arg := range e.args {
+		if i > 0 && name == "auth" {
+			args[i] = redacted
+			continue
+		}
+		args[i] = append([]byte(nil), arg...)
+	}
+	e.args = args
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for sub := range h.subscribers {
+		if !sub.filter.match(e) {
+			continue
+		}
+
+		select {
+		case sub.events <- e:
+		default:
+			atomic.AddInt64(&sub.dropped, 1)
+			monitorDropped.Inc()
+		}
+	}
+}
+
+// closeAll closes the connections of all subscribers
+func (h *monitorHub) closeAll() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for sub := range h.subscribers {
+		close(sub.events)
+	}
+	h.subscribers = make(map[*monitorSubscriber]struct{})
+	atomic.StoreInt32(&h.active, 0)
+}
+
+// monitor detaches the connection and streams events to it until the
+// client goes away
+func (sb *SummitDBBalancer) monitor(conn redcon.Conn, cmd redcon.Command) {
+	filter, err := parseMonitorFilter(cmd.Args)
+	if err != nil {
+		conn.WriteError(err.Error())
+		return
+	}
+
+	sub := monitors.subscribe(conn.RemoteAddr(), filter)
+	dc := conn.Detach()
+
+	log.Info("Monitor started", "remote", sub.remote)
+
+	go func() {
+		defer func() {
+			monitors.unsubscribe(sub)
+			dc.Close()
+
+			log.Info("Monitor stopped", "remote", sub.remote)
+		}()
+
+		// detect the client going away while no events arrive
+		gone := make(chan struct{})
+		go func() {
+			for {
+				if _, err := dc.ReadCommand(); err != nil {
+					close(gone)
+					return
+				}
+			}
+		}()
+
+		dc.WriteString("OK")
+		if dc.Flush() != nil {
+			return
+		}
+
+		for {
+			select {
+			case <-gone:
+				return
+			case e, ok := <-sub.events:
+				if !ok {
+					return
+				}
+
+				if n := atomic.SwapInt64(&sub.dropped, 0); n > 0 {
+					dc.WriteString(fmt.Sprintf("- dropped %d events, monitor too slow", n))
+				}
+				dc.WriteString(e.String())
+
+				if dc.Flush() != nil {
+					return
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/masomo/summitdb-balancer/summitdbtest"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("monitor", func() {
+	var event = func(remote, backend, command string) *monitorEvent {
+		var args [][]byte
+		for _, arg := range strings.Fields(command) {
+			args = append(args, []byte(arg))
+		}
+		return &monitorEvent{time: time.Now(), remote: remote, args: args, backend: backend}
+	}
+
+	var filter = func(options string) monitorFilter {
+		f, err := parseMonitorFilter(event("", "", "monitor "+options).args)
+		Expect(err).NotTo(HaveOccurred())
+		return f
+	}
+
+	DescribeTable("should filter events",
+		func(options, remote, backend, command string, matched bool) {
+			f := filter(options)
+			Expect(f.match(event(remote, backend, command))).To(Equal(matched))
+		},
+		Entry("without a filter", "", "10.0.0.1:5000", "", "get a", true),
+		Entry("by command", "command GET,mget", "10.0.0.1:5000", "", "MGET a b", true),
+		Entry("by another command", "command get", "10.0.0.1:5000", "", "set a 1", false),
+		Entry("by key", "key user:*", "10.0.0.1:5000", "", "mget a user:1", true),
+		Entry("by another key", "key user:*", "10.0.0.1:5000", "", "get a", false),
+		Entry("by key without keys", "key *", "10.0.0.1:5000", "", "ping", false),
+		Entry("by client address", "client 10.0.0.1:5000", "10.0.0.1:5000", "", "get a", true),
+		Entry("by client ip", "client 10.0.0.1", "10.0.0.1:5000", "", "get a", true),
+		Entry("by another client", "client 10.0.0.1", "10.0.0.10:5000", "", "get a", false),
+		Entry("by backend", "backend 127.0.0.1:7481", "10.0.0.1:5000", "127.0.0.1:7481", "get a", true),
+		Entry("by another backend", "backend 127.0.0.1:7481", "10.0.0.1:5000", "127.0.0.1:7482", "get a", false),
+		Entry("by command and key", "command get key a", "10.0.0.1:5000", "", "set a 1", false),
+	)
+
+	It("should reject invalid filters", func() {
+		_, err := parseMonitorFilter(event("", "", "monitor key").args)
+		Expect(err).To(MatchError("ERR MONITOR option 'key' needs a value"))
+
+		_, err = parseMonitorFilter(event("", "", "monitor user a").args)
+		Expect(err).To(MatchError("ERR unknown MONITOR option 'user'"))
+	})
+
+	It("should format events", func() {
+		e := event("10.0.0.1:5000", "", "get a")
+		e.time = time.Date(2020, 1, 2, 3, 4, 5, 60e7, time.UTC)
+		e.latency = time.Millisecond
+		Expect(e.String()).To(Equal("- 2020/01/02 03:04:05.60 [10.0.0.1:5000] [local 1ms] |get a|"))
+	})
+
+	Context("hub", func() {
+		var hub *monitorHub
+
+		BeforeEach(func() {
+			hub = newMonitorHub()
+		})
+
+		It("should publish to matching subscribers only", func() {
+			Expect(hub.enabled()).To(BeFalse())
+
+			all := hub.subscribe("a:1", monitorFilter{})
+			gets := hub.subscribe("b:1", filter("command get"))
+			Expect(hub.enabled()).To(BeTrue())
+
+			hub.publish(event("c:1", "", "set a 1"))
+			hub.publish(event("c:1", "", "get a"))
+
+			Expect(all.events).To(HaveLen(2))
+			Expect(gets.events).To(HaveLen(1))
+			Expect(string((<-gets.events).args[0])).To(Equal("get"))
+
+			hub.unsubscribe(all)
+			hub.unsubscribe(gets)
+			Expect(hub.enabled()).To(BeFalse())
+		})
+
+		It("should copy the args", func() {
+			sub := hub.subscribe("a:1", monitorFilter{})
+			defer hub.unsubscribe(sub)
+
+			e := event("c:1", "", "get a")
+			args := e.args
+			hub.publish(e)
+			args[1][0] = 'b'
+
+			Expect(string((<-sub.events).args[1])).To(Equal("a"))
+		})
+
+		It("should redact AUTH and skip MONITOR", func() {
+			sub := hub.subscribe("a:1", monitorFilter{})
+			defer hub.unsubscribe(sub)
+
+			hub.publish(event("c:1", "", "auth app secret"))
+			hub.publish(event("c:1", "", "MONITOR"))
+
+			Expect(sub.events).To(HaveLen(1))
+			Expect((<-sub.events).String()).To(HaveSuffix("|auth (redacted) (redacted)|"))
+		})
+
+		It("should count events dropped to a full buffer", func() {
+			sub := hub.subscribe("a:1", monitorFilter{})
+			defer hub.unsubscribe(sub)
+
+			for i := 0; i < monitorBuffer+3; i++ {
+				hub.publish(event("c:1", "", "get a"))
+			}
+
+			Expect(sub.events).To(HaveLen(monitorBuffer))
+			Expect(sub.dropped).To(BeEquivalentTo(3))
+		})
+
+		It("should close all subscribers", func() {
+			sub := hub.subscribe("a:1", monitorFilter{})
+			hub.closeAll()
+
+			Expect(hub.enabled()).To(BeFalse())
+			Eventually(sub.events).Should(BeClosed())
+		})
+	})
+
+	Context("through the proxy", func() {
+		var cluster *summitdbtest.Cluster
+		var p *proxy
+		var client, monitor redis.Conn
+
+		BeforeEach(func() {
+			var err error
+			cluster, err = summitdbtest.NewCluster(2)
+			Expect(err).NotTo(HaveOccurred())
+
+			p = startClusterProxy(&Config{
+				Auth:         auth{Password: "secret"},
+				LoadBalancer: loadBalancer{MaxIdle: 4, Routing: true},
+			}, cluster)
+
+			monitor, err = p.dial()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(monitor.Do("AUTH", "secret")).To(Equal("OK"))
+			Expect(monitor.Do("MONITOR")).To(Equal("OK"))
+
+			client, err = p.dial()
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			client.Close()
+			monitor.Close()
+			p.close()
+			Expect(cluster.Close()).To(Succeed())
+		})
+
+		It("should stream other clients' commands with AUTH redacted", func() {
+			Expect(client.Do("AUTH", "secret")).To(Equal("OK"))
+			Expect(client.Do("SET", "a", "1")).To(Equal("OK"))
+
+			auth, err := redis.String(monitor.Receive())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(auth).To(HaveSuffix("[local 0s] |AUTH (redacted)|"))
+			Expect(auth).NotTo(ContainSubstring("secret"))
+
+			set, err := redis.String(monitor.Receive())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(set).To(ContainSubstring("[" + cluster.Nodes[0].Addr() + " "))
+			Expect(set).To(HaveSuffix("|SET a 1|"))
+		})
+	})
+})
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/masomo/summitdb-balancer/balancer"
+	metrics "github.com/rcrowley/go-metrics"
+	"github.com/tidwall/redcon"
+)
+
+// pipeline coalesces the command and the rest of the client pipeline into
+// batched backend round trips. Consecutive commands with the same shard and
+// route are sent on one backend connection, replies are written back in
+// order with their own errors. It returns false when the pipeline holds
+// commands that must be dispatched one by one.
+func (sb *SummitDBBalancer) pipeline(conn redcon.Conn, cmd redcon.Command) bool {
+	pcmds := conn.PeekPipeline()
+	if len(pcmds) == 0 {
+		return false
+	}
+
+	set := sb.shards()
+	s := getSession(conn)
+
+	// reads after a write of the connection see it, including writes
+	// earlier in the pipeline
+	stale, writes := s.readsLeader(), false
+
+	cmds := append([]redcon.Command{cmd}, pcmds...)
+	shards := make([]*shard, len(cmds))
+	targets := make([]readPref, len(cmds))
+	for i, pcmd := range cmds {
+		ci := lookupCommand(qcmdlower(pcmd.Args[0]))
+		if ci.class != classRead && !ci.leader() {
+			return false
+		}
+
+		// spanning, fanned out and streamed commands get their own reply path
+		if shards[i] = set.forCommand(ci, pcmd.Args); shards[i] == nil || (ci.fanOut && !set.single()) || ci.stream {
+			return false
+		}
+
+		targets[i] = target(shards[i].balancer, ci, s.pref, stale)
+
+		// fenced reads are sent one by one
+		if fences(ci, targets[i], stale) {
+			return false
+		}
+
+		if ci.class == classWrite {
+			writes = true
+			stale = stale || getConfig().LoadBalancer.ReadYourWrites.Window > 0
+		}
+	}
+
+	// remove the peeked items off the pipeline
+	conn.ReadPipeline()
+
+	pipelineMetric := metrics.GetOrRegisterHistogram(fmt.Sprintf("%s.pipeline", metricPrefix), nil, metrics.NewUniformSample(1028))
+	pipelineMetric.Update(int64(len(cmds)))
+
+	replies := make([]interface{}, len(cmds))
+	for start := 0; start < len(cmds); {
+		b, pref := shards[start].balancer, targets[start]
+
+		end := start + 1
+		for end < len(cmds) && shards[end] == shards[start] && targets[end] == pref {
+			end++
+		}
+
+		sb.batch(s, b, cmds[start:end], replies[start:end], pref)
+
+		r := route{backend: s.backend, latency: s.latency}
+		for i := start; i < end; i++ {
+			s.piped = append(s.piped, r)
+		}
+		start = end
+	}
+
+	if writes {
+		s.wrote()
+	}
+
+	for _, reply := range replies {
+		writeReply(conn, reply)
+	}
+
+	return true
+}
+
+// batch sends the commands on a single backend connection and stores the
+// replies, failed commands get an error reply. From the first redirected
+// command on, the batch is sent to the leader again.
+func (sb *SummitDBBalancer) batch(s *session, b *balancer.Balancer, cmds []redcon.Command, replies []interface{}, pref readPref) {
+	backend := pref.pick(b)
+
+	client := backend.Pool.Get()
+	defer client.Close()
+
+	markBackend(backend, len(cmds))
+
+	start := time.Now()
+
+	var err error
+	for _, cmd := range cmds {
+		if err = client.Send(string(cmd.Args[0]), commandArgs(cmd)...); err != nil {
+			break
+		}
+	}
+
+	if err == nil {
+		err = client.Flush()
+	}
+
+	// the connection is unusable after an error, the rest is left
+	// unanswered. Each reply is observed with the time since the previous
+	// one, so slow commands stand out.
+	received, last := 0, start
+	for err == nil && received < len(cmds) {
+		var reply interface{}
+		if reply, err = backendReply(receiveWithDeadline(client)); err == nil {
+			replies[received] = reply
+			received++
+
+			now := time.Now()
+			b.Observe(backend.Addr, now.Sub(last), false)
+			last = now
+		}
+	}
+
+	for i := received; i < len(cmds); i++ {
+		b.Observe(backend.Addr, time.Since(last), true)
+	}
+
+	latency := time.Since(start) / time.Duration(len(cmds))
+	s.routed(backend.Addr, latency)
+
+	// once a command is redirected, it and the commands after it are sent
+	// to the leader again in order, so later reads see its write
+	var leader *balancer.Backend
+	for i, cmd := range cmds {
+		name, args := string(cmd.Args[0]), commandArgs(cmd)
+
+		var reply interface{}
+		var rerr error
+		if leader != nil {
+			reply, leader, rerr = sb.doFollow(s, b, leader, name, args)
+		} else if i >= received {
+			reply, rerr = sb.retry(s, b, lookupCommand(qcmdlower(cmd.Args[0])), backend, err, name, args)
+		} else if addr, ok := redirectAddr(replies[i]); ok {
+			reply, leader, rerr = sb.doFollow(s, b, b.Redirect(addr), name, args)
+		} else {
+			continue
+		}
+
+		if rerr != nil {
+			reply = redis.Error("ERR " + rerr.Error())
+		}
+		replies[i] = reply
+	}
+}
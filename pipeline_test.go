@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/masomo/summitdb-balancer/balancer"
+	"github.com/masomo/summitdb-balancer/summitdbtest"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("pipelines", func() {
+	var cluster *summitdbtest.Cluster
+	var p *proxy
+	var client redis.Conn
+
+	// pipe sends the commands in one go and returns their replies, error
+	// replies included
+	var pipe = func(cmds ...[]interface{}) []interface{} {
+		for _, cmd := range cmds {
+			Expect(client.Send(cmd[0].(string), cmd[1:]...)).To(Succeed())
+		}
+		Expect(client.Flush()).To(Succeed())
+
+		replies := make([]interface{}, len(cmds))
+		for i := range cmds {
+			reply, err := client.Receive()
+			if rerr, ok := err.(redis.Error); ok {
+				reply, err = rerr, nil
+			}
+			Expect(err).NotTo(HaveOccurred())
+			replies[i] = reply
+		}
+		return replies
+	}
+
+	BeforeEach(func() {
+		var err error
+		cluster, err = summitdbtest.NewCluster(3)
+		Expect(err).NotTo(HaveOccurred())
+
+		p = startClusterProxy(&Config{LoadBalancer: loadBalancer{MaxIdle: 4, Routing: true}}, cluster)
+
+		client, err = p.dial()
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		client.Close()
+		p.close()
+		Expect(cluster.Close()).To(Succeed())
+	})
+
+	It("should answer mixed pipelines in order", func() {
+		Expect(pipe(
+			[]interface{}{"SET", "a", "1"},
+			[]interface{}{"MSET", "b", "2", "c", "3"},
+			[]interface{}{"GET", "a"},
+			[]interface{}{"MGET", "b", "c"},
+			[]interface{}{"PING"},
+		)).To(Equal([]interface{}{
+			"OK", "OK", []byte("1"), []interface{}{[]byte("2"), []byte("3")}, "PONG",
+		}))
+	})
+
+	It("should keep error replies to their own command", func() {
+		Expect(pipe(
+			[]interface{}{"SET", "a", "1"},
+			[]interface{}{"MSET", "b"},
+			[]interface{}{"SET", "b", "2"},
+			[]interface{}{"GET", "a"},
+			[]interface{}{"JSET", "doc", "a", "[", "RAW"},
+			[]interface{}{"GET", "b"},
+		)).To(Equal([]interface{}{
+			"OK",
+			redis.Error("ERR wrong number of arguments for 'mset' command"),
+			"OK",
+			[]byte("1"),
+			redis.Error("ERR json not valid"),
+			[]byte("2"),
+		}))
+	})
+
+	It("should follow redirects of commands in a batch", func() {
+		Expect(pipe([]interface{}{"SET", "a", "1"}, []interface{}{"GET", "a"})).To(Equal([]interface{}{"OK", []byte("1")}))
+
+		// the balancer still takes the old leader for the leader
+		cluster.Elect(1)
+
+		Expect(pipe(
+			[]interface{}{"SET", "a", "2"},
+			[]interface{}{"JSET", "doc", "a", "1"},
+		)).To(Equal([]interface{}{"OK", "OK"}))
+		Expect(redis.String(client.Do("GET", "a"))).To(Equal("2"))
+	})
+
+	It("should read redirected writes later in the batch", func() {
+		client.Close()
+		p.close()
+
+		// without routing the batches take turns on the nodes, followers
+		// included
+		p = startClusterProxy(&Config{LoadBalancer: loadBalancer{MaxIdle: 4}}, cluster)
+
+		var err error
+		client, err = p.dial()
+		Expect(err).NotTo(HaveOccurred())
+
+		for i := 0; i < 6; i++ {
+			key := fmt.Sprintf("k%d", i)
+			Expect(pipe(
+				[]interface{}{"SET", key, "1"},
+				[]interface{}{"GET", key},
+			)).To(Equal([]interface{}{"OK", []byte("1")}))
+		}
+		Expect(cluster.Nodes[1].Count("get") + cluster.Nodes[2].Count("get")).NotTo(BeZero())
+	})
+})
+
+var _ = Describe("batched outlier detection", func() {
+	var cluster *summitdbtest.Cluster
+	var p *proxy
+	var client redis.Conn
+
+	BeforeEach(func() {
+		var err error
+		cluster, err = summitdbtest.NewCluster(2)
+		Expect(err).NotTo(HaveOccurred())
+
+		p = startClusterProxy(&Config{LoadBalancer: loadBalancer{
+			MaxIdle: 4,
+			Routing: true,
+			Outlier: balancer.OutlierOptions{Interval: 50 * time.Millisecond, MinRequests: 4, Latency: 10 * time.Millisecond},
+		}}, cluster)
+
+		client, err = p.dial()
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		client.Close()
+		p.close()
+		Expect(cluster.Close()).To(Succeed())
+	})
+
+	It("should observe every command of a batch", func() {
+		follower := cluster.Nodes[1]
+		follower.SetFault("", summitdbtest.Fault{Latency: 20 * time.Millisecond})
+
+		for _, args := range [][]interface{}{{"a"}, {"a", "b"}, {"a"}, {"a", "b"}} {
+			name := "GET"
+			if len(args) > 1 {
+				name = "MGET"
+			}
+			Expect(client.Send(name, args...)).To(Succeed())
+		}
+		Expect(client.Flush()).To(Succeed())
+		for i := 0; i < 4; i++ {
+			_, err := client.Receive()
+			Expect(err).NotTo(HaveOccurred())
+		}
+
+		// the next command ends the interval, the batch alone reaches the
+		// minimum requests
+		time.Sleep(50 * time.Millisecond)
+		Expect(client.Do("GET", "a")).To(BeNil())
+
+		ejected := false
+		for _, s := range p.sb.shards().shards[0].balancer.Stats() {
+			if s.Addr == follower.Addr() {
+				ejected = s.Ejected
+			}
+		}
+		Expect(ejected).To(BeTrue())
+	})
+})
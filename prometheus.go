@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/masomo/summitdb-balancer/balancer"
+	"github.com/prometheus/client_golang/prometheus"
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+var (
+	commandDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricPrefix,
+		Name:      "command_duration_seconds",
+		Help:      "Latency of client commands including the backend round trip.",
+		Buckets:   prometheus.ExponentialBuckets(0.0001, 2, 16),
+	}, []string{"command"})
+
+	backendCommands = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricPrefix,
+		Name:      "backend_commands_total",
+		Help:      "Commands sent to backends by backend and raft role.",
+	}, []string{"backend", "role"})
+
+	retriesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricPrefix,
+		Name:      "retries_total",
+		Help:      "Commands retried after a connection error by failed backend and command class.",
+	}, []string{"backend", "class"})
+
+	aclDenied = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricPrefix,
+		Name:      "acl_denied_total",
+		Help:      "Commands denied by ACL rules by user and reason.",
+	}, []string{"user", "reason"})
+
+	rateLimited = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricPrefix,
+		Name:      "rate_limited_total",
+		Help:      "Commands rejected by rate limits by scope and class.",
+	}, []string{"scope", "class"})
+
+	monitorSubscribers = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricPrefix,
+		Name:      "monitor_clients",
+		Help:      "Connected MONITOR clients.",
+	})
+
+	monitorDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricPrefix,
+		Name:      "monitor_dropped_total",
+		Help:      "Events dropped for MONITOR clients that could not keep up.",
+	})
+
+	pubsubClients = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricPrefix,
+		Name:      "pubsub_clients",
+		Help:      "Clients in subscribe mode.",
+	})
+
+	pubsubResubscribes = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricPrefix,
+		Name:      "pubsub_resubscribes_total",
+		Help:      "Subscriptions moved to another backend after a failure.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(commandDuration, backendCommands, retriesTotal, aclDenied, rateLimited, monitorSubscribers, monitorDropped, pubsubClients, pubsubResubscribes)
+}
+
+// markBackend counts n commands sent to the backend
+func markBackend(backend *balancer.Backend, n int) {
+	backendMetric := metrics.GetOrRegisterMeter(fmt.Sprintf("%s.backend.%s", metricPrefix, backend.Addr), nil)
+	backendMetric.Mark(int64(n))
+
+	role := "follower"
+	if backend.Leader {
+		role = "leader"
+	}
+	backendCommands.WithLabelValues(backend.Addr, role).Add(float64(n))
+}
+
+// markRetry counts a command retried after failing on the backend
+func markRetry(backend *balancer.Backend, ci commandInfo) {
+	retryMetric := metrics.GetOrRegisterMeter(fmt.Sprintf("%s.retry", metricPrefix), nil)
+	retryMetric.Mark(1)
+
+	retriesTotal.WithLabelValues(backend.Addr, ci.class.String()).Inc()
+}
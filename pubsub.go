@@ -0,0 +1,421 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/semihalev/log"
+	"github.com/tidwall/redcon"
+)
+
+const (
+	// pubsubKeepAlive is how often subscription connections are pinged, they
+	// are replaced when nothing arrived for two intervals
+	pubsubKeepAlive = 5 * time.Second
+
+	// resubscribeDelay is the wait between attempts to move a subscription
+	resubscribeDelay = 250 * time.Millisecond
+
+	// keepAliveToken marks the pings of the balancer, their replies are not
+	// relayed
+	keepAliveToken = "sb:keepalive"
+)
+
+// subscriptions holds the clients in subscribe mode
+var subscriptions = newSubscriptionHub()
+
+type subscriptionHub struct {
+	mu   sync.Mutex
+	subs map[*subscription]struct{}
+}
+
+func newSubscriptionHub() *subscriptionHub {
+	return &subscriptionHub{subs: make(map[*subscription]struct{})}
+}
+
+func (h *subscriptionHub) add(sub *subscription) {
+	h.mu.Lock()
+	h.subs[sub] = struct{}{}
+	h.mu.Unlock()
+
+	pubsubClients.Inc()
+}
+
+func (h *subscriptionHub) remove(sub *subscription) {
+	h.mu.Lock()
+	delete(h.subs, sub)
+	h.mu.Unlock()
+
+	pubsubClients.Dec()
+}
+
+// closeAll closes the connections of all subscribers
+func (h *subscriptionHub) closeAll() {
+	h.mu.Lock()
+	subs := make([]*subscription, 0, len(h.subs))
+	for sub := range h.subs {
+		subs = append(subs, sub)
+	}
+	h.mu.Unlock()
+
+	for _, sub := range subs {
+		sub.close()
+	}
+}
+
+// subscription is a client in subscribe mode. Its channels and patterns are
+// held on a dedicated connection to the backend PUBLISH is routed to, and
+// subscribed again on the new one when that backend goes down.
+type subscription struct {
+	sb     *SummitDBBalancer
+	dc     redcon.DetachedConn
+	remote string
+
+	// wmu serializes writes to the client
+	wmu sync.Mutex
+
+	// mu guards the backend connection and the subscriptions
+	mu       sync.Mutex
+	backend  redis.Conn
+	addr     string
+	channels map[string]struct{}
+	patterns map[string]struct{}
+
+	// swallow counts the confirmations of resubscribes, which the client
+	// must not see
+	swallow int
+
+	// seen is the time anything last arrived from the backend, unix nanos
+	seen int64
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// subscribe dials a dedicated backend connection and detaches the client
+// connection into subscribe mode, which it stays in until it quits. Like on
+// SummitDB, unsubscribing from everything does not leave subscribe mode.
+func (sb *SummitDBBalancer) subscribe(conn redcon.Conn, cmd redcon.Command) {
+	sub := &subscription{
+		sb:       sb,
+		remote:   conn.RemoteAddr(),
+		channels: make(map[string]struct{}),
+		patterns: make(map[string]struct{}),
+		done:     make(chan struct{}),
+	}
+
+	var err error
+	sub.backend, sub.addr, err = sub.dial()
+	if err != nil {
+		conn.WriteError("ERR " + err.Error())
+		return
+	}
+	sub.touch()
+
+	sub.dc = conn.Detach()
+	subscriptions.add(sub)
+
+	log.Info("Subscribe mode started", "remote", sub.remote, "node", sub.addr)
+
+	go sub.read(cmd)
+	go sub.relay()
+	go sub.keepAlive()
+}
+
+// unsubscribe answers UNSUBSCRIBE and PUNSUBSCRIBE outside subscribe mode
+func (sb *SummitDBBalancer) unsubscribe(conn redcon.Conn, cmd redcon.Command) {
+	kind := qcmdlower(cmd.Args[0])
+	if len(cmd.Args) == 1 {
+		conn.WriteArray(3)
+		conn.WriteBulkString(kind)
+		conn.WriteNull()
+		conn.WriteInt(0)
+		return
+	}
+
+	for _, arg := range cmd.Args[1:] {
+		conn.WriteArray(3)
+		conn.WriteBulkString(kind)
+		conn.WriteBulk(arg)
+		conn.WriteInt(0)
+	}
+}
+
+// dial connects to the backend PUBLISH is routed to, channels are not keys
+// so pub/sub runs on the first shard
+func (sub *subscription) dial() (redis.Conn, string, error) {
+	b := sub.sb.shards().shards[0].balancer
+	backend := target(b, lookupCommand("publish"), prefDefault, false).pick(b)
+
+	c, err := backend.Pool.Dial()
+	if err != nil {
+		return nil, backend.Addr, err
+	}
+	return c, backend.Addr, nil
+}
+
+// read handles the commands of the client until it goes away
+func (sub *subscription) read(cmd redcon.Command) {
+	defer sub.close()
+
+	for {
+		if !sub.command(cmd) {
+			return
+		}
+
+		var err error
+		if cmd, err = sub.dc.ReadCommand(); err != nil {
+			return
+		}
+	}
+}
+
+// command forwards a subscribe mode command to the backend, it returns
+// false when the client quit
+func (sub *subscription) command(cmd redcon.Command) bool {
+	name := qcmdlower(cmd.Args[0])
+	switch name {
+	case "subscribe", "psubscribe", "unsubscribe", "punsubscribe", "ping":
+	case "quit":
+		sub.write(func() { sub.dc.WriteString("OK") })
+		return false
+	default:
+		return sub.write(func() {
+			sub.dc.WriteError(fmt.Sprintf("ERR Can't execute '%s': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT are allowed in this context", name))
+		})
+	}
+
+	permitted := true
+	if !sub.write(func() { permitted = sub.sb.permitted(sub.dc, cmd) }) {
+		return false
+	}
+	if !permitted {
+		return true
+	}
+
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+
+	sub.track(name, cmd.Args[1:])
+
+	// a failed send is noticed by relay, which subscribes again
+	if sub.backend.Send(string(cmd.Args[0]), commandArgs(cmd)...) == nil {
+		sub.backend.Flush()
+	}
+	return true
+}
+
+// track records the subscriptions of the client, the caller holds mu
+func (sub *subscription) track(name string, args [][]byte) {
+	set := sub.channels
+	if name == "psubscribe" || name == "punsubscribe" {
+		set = sub.patterns
+	}
+
+	switch name {
+	case "subscribe", "psubscribe":
+		for _, arg := range args {
+			set[string(arg)] = struct{}{}
+		}
+	case "unsubscribe", "punsubscribe":
+		if len(args) == 0 {
+			for key := range set {
+				delete(set, key)
+			}
+		}
+		for _, arg := range args {
+			delete(set, string(arg))
+		}
+	}
+}
+
+// relay copies the messages of the backend to the client
+func (sub *subscription) relay() {
+	defer sub.close()
+
+	for {
+		sub.mu.Lock()
+		c := sub.backend
+		sub.mu.Unlock()
+
+		reply, err := backendReply(redis.ReceiveWithTimeout(c, 0))
+		if err != nil {
+			if !sub.resubscribe(err) {
+				return
+			}
+			continue
+		}
+		sub.touch()
+
+		if sub.swallowed(reply) {
+			continue
+		}
+
+		if !sub.write(func() { writeReply(sub.dc, reply) }) {
+			return
+		}
+	}
+}
+
+// swallowed returns true for replies to commands of the balancer
+func (sub *subscription) swallowed(reply interface{}) bool {
+	switch val := reply.(type) {
+	case []byte:
+		// PING outside subscribe mode, after everything was unsubscribed
+		return string(val) == keepAliveToken
+	case []interface{}:
+		if len(val) < 2 {
+			return false
+		}
+
+		kind, _ := val[0].([]byte)
+		switch string(kind) {
+		case "pong":
+			data, _ := val[1].([]byte)
+			return string(data) == keepAliveToken
+		case "subscribe", "psubscribe":
+			sub.mu.Lock()
+			defer sub.mu.Unlock()
+
+			if sub.swallow > 0 {
+				sub.swallow--
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// resubscribe replaces the failed backend connection, the subscriptions are
+// restored on the backend PUBLISH is routed to now. It returns false once
+// the client is gone.
+func (sub *subscription) resubscribe(cause error) bool {
+	select {
+	case <-sub.done:
+		return false
+	default:
+	}
+
+	sub.mu.Lock()
+	failed := sub.addr
+	sub.backend.Close()
+	sub.mu.Unlock()
+
+	sub.sb.shards().shards[0].balancer.MarkFailed(failed)
+	log.Warn("Subscription backend failed", "remote", sub.remote, "node", failed, "error", cause.Error())
+
+	for {
+		select {
+		case <-sub.done:
+			return false
+		case <-time.After(resubscribeDelay):
+		}
+
+		c, addr, err := sub.dial()
+		if err != nil {
+			log.Debug("Subscription backend dial failed", "remote", sub.remote, "node", addr, "error", err.Error())
+			continue
+		}
+
+		sub.mu.Lock()
+		if err = sub.restore(c); err != nil {
+			sub.mu.Unlock()
+			c.Close()
+			continue
+		}
+		sub.backend, sub.addr = c, addr
+		sub.mu.Unlock()
+
+		sub.touch()
+		pubsubResubscribes.Inc()
+
+		log.Info("Subscription moved", "remote", sub.remote, "failed", failed, "node", addr)
+		return true
+	}
+}
+
+// restore subscribes the connection to the channels and patterns of the
+// client, the caller holds mu
+func (sub *subscription) restore(c redis.Conn) error {
+	sub.swallow = 0
+
+	for name, set := range map[string]map[string]struct{}{"SUBSCRIBE": sub.channels, "PSUBSCRIBE": sub.patterns} {
+		if len(set) == 0 {
+			continue
+		}
+
+		args := make([]interface{}, 0, len(set))
+		for key := range set {
+			args = append(args, key)
+		}
+
+		if err := c.Send(name, args...); err != nil {
+			return err
+		}
+		sub.swallow += len(args)
+	}
+
+	return c.Flush()
+}
+
+// keepAlive pings the backend, and closes its connection for relay to
+// replace when it went silent
+func (sub *subscription) keepAlive() {
+	ticker := time.NewTicker(pubsubKeepAlive)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-sub.done:
+			return
+		case <-ticker.C:
+		}
+
+		sub.mu.Lock()
+		if time.Since(time.Unix(0, atomic.LoadInt64(&sub.seen))) > 2*pubsubKeepAlive {
+			sub.backend.Close()
+		} else if sub.backend.Send("PING", keepAliveToken) == nil {
+			sub.backend.Flush()
+		}
+		sub.mu.Unlock()
+	}
+}
+
+// touch records that the backend is alive
+func (sub *subscription) touch() { atomic.StoreInt64(&sub.seen, time.Now().UnixNano()) }
+
+// write runs fn writing to the client and flushes, it returns false and
+// closes the subscription when the client is gone
+func (sub *subscription) write(fn func()) bool {
+	sub.wmu.Lock()
+	defer sub.wmu.Unlock()
+
+	fn()
+	if sub.dc.Flush() != nil {
+		go sub.close()
+		return false
+	}
+	return true
+}
+
+// close ends subscribe mode, closing both connections
+func (sub *subscription) close() {
+	sub.closeOnce.Do(func() {
+		close(sub.done)
+
+		sub.wmu.Lock()
+		sub.dc.Close()
+		sub.wmu.Unlock()
+
+		sub.mu.Lock()
+		sub.backend.Close()
+		sub.mu.Unlock()
+
+		subscriptions.remove(sub)
+
+		log.Info("Subscribe mode stopped", "remote", sub.remote)
+	})
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/masomo/summitdb-balancer/summitdbtest"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("pub/sub", func() {
+	var cluster *summitdbtest.Cluster
+	var p *proxy
+	var client, sub redis.Conn
+
+	// frame returns the reply as an array of strings and integers
+	var frame = func(values ...interface{}) []interface{} {
+		for i, v := range values {
+			if s, ok := v.(string); ok {
+				values[i] = []byte(s)
+			}
+		}
+		return values
+	}
+
+	var receive = func() interface{} {
+		reply, err := sub.Receive()
+		if rerr, ok := err.(redis.Error); ok {
+			return rerr
+		}
+		Expect(err).NotTo(HaveOccurred())
+		return reply
+	}
+
+	BeforeEach(func() {
+		var err error
+		cluster, err = summitdbtest.NewCluster(3)
+		Expect(err).NotTo(HaveOccurred())
+
+		p = startClusterProxy(&Config{LoadBalancer: loadBalancer{MaxIdle: 4, Routing: true}}, cluster)
+
+		client, err = p.dial()
+		Expect(err).NotTo(HaveOccurred())
+		sub, err = p.dial()
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		sub.Close()
+		client.Close()
+		p.close()
+		Expect(cluster.Close()).To(Succeed())
+	})
+
+	It("should relay messages of channels and patterns", func() {
+		Expect(sub.Do("SUBSCRIBE", "news", "sport")).To(Equal(frame("subscribe", "news", int64(1))))
+		Expect(receive()).To(Equal(frame("subscribe", "sport", int64(2))))
+		Expect(sub.Do("PSUBSCRIBE", "app:*")).To(Equal(frame("psubscribe", "app:*", int64(1))))
+
+		// subscribers are held on the leader, where PUBLISH goes
+		Expect(client.Do("PUBLISH", "news", "hi")).NotTo(BeZero())
+		Expect(receive()).To(Equal(frame("message", "news", "hi")))
+
+		Expect(client.Do("PUBLISH", "app:1", "ho")).NotTo(BeZero())
+		Expect(receive()).To(Equal(frame("pmessage", "app:*", "app:1", "ho")))
+		Expect(cluster.Nodes[0].Count("publish")).To(Equal(2))
+	})
+
+	It("should answer PING and reject other commands in subscribe mode", func() {
+		Expect(sub.Do("SUBSCRIBE", "news")).To(Equal(frame("subscribe", "news", int64(1))))
+
+		Expect(sub.Do("PING")).To(Equal(frame("pong", "")))
+		Expect(sub.Do("PING", "x")).To(Equal(frame("pong", "x")))
+
+		_, err := sub.Do("GET", "a")
+		Expect(err).To(MatchError("ERR Can't execute 'get': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT are allowed in this context"))
+	})
+
+	It("should unsubscribe and stay in subscribe mode", func() {
+		Expect(sub.Do("SUBSCRIBE", "news", "sport")).To(Equal(frame("subscribe", "news", int64(1))))
+		Expect(receive()).To(Equal(frame("subscribe", "sport", int64(2))))
+
+		Expect(sub.Do("UNSUBSCRIBE", "news")).To(Equal(frame("unsubscribe", "news", int64(1))))
+		Expect(client.Do("PUBLISH", "news", "hi")).To(BeZero())
+
+		Expect(sub.Do("UNSUBSCRIBE")).To(Equal(frame("unsubscribe", "sport", int64(0))))
+		Expect(client.Do("PUBLISH", "sport", "hi")).To(BeZero())
+
+		_, err := sub.Do("GET", "a")
+		Expect(err).To(MatchError(HavePrefix("ERR Can't execute 'get'")))
+
+		Expect(sub.Do("SUBSCRIBE", "news")).To(Equal(frame("subscribe", "news", int64(1))))
+		Expect(client.Do("PUBLISH", "news", "again")).To(BeEquivalentTo(1))
+		Expect(receive()).To(Equal(frame("message", "news", "again")))
+
+		Expect(sub.Do("QUIT")).To(Equal("OK"))
+	})
+
+	It("should answer UNSUBSCRIBE outside subscribe mode", func() {
+		Expect(sub.Do("UNSUBSCRIBE")).To(Equal([]interface{}{[]byte("unsubscribe"), nil, int64(0)}))
+		Expect(sub.Do("PUNSUBSCRIBE", "a:*")).To(Equal(frame("punsubscribe", "a:*", int64(0))))
+		Expect(sub.Do("GET", "a")).To(BeNil())
+	})
+
+	It("should subscribe again after the backend connection fails", func() {
+		Expect(sub.Do("SUBSCRIBE", "news")).To(Equal(frame("subscribe", "news", int64(1))))
+		Expect(sub.Do("PSUBSCRIBE", "app:*")).To(Equal(frame("psubscribe", "app:*", int64(1))))
+
+		cluster.Nodes[0].Disconnect()
+
+		// PUBLISH counts are no use here, the node still counts the closed
+		// connection until writing to it fails. It counts only the first
+		// command of a connection in subscribe mode.
+		Eventually(func() int {
+			return cluster.Nodes[0].Count("subscribe") + cluster.Nodes[0].Count("psubscribe")
+		}, 2*time.Second).Should(Equal(2))
+
+		// the confirmations of the resubscribe are not relayed, the PING is
+		// answered after them on the new connection
+		Expect(sub.Do("PING")).To(Equal(frame("pong", "")))
+
+		Expect(client.Do("PUBLISH", "news", "back")).NotTo(BeZero())
+		Expect(receive()).To(Equal(frame("message", "news", "back")))
+		Expect(client.Do("PUBLISH", "app:1", "ho")).NotTo(BeZero())
+		Expect(receive()).To(Equal(frame("pmessage", "app:*", "app:1", "ho")))
+	})
+
+	It("should move subscriptions to the new leader", func() {
+		Expect(sub.Do("SUBSCRIBE", "news")).To(Equal(frame("subscribe", "news", int64(1))))
+
+		Expect(cluster.Nodes[0].Stop()).To(Succeed())
+		cluster.Elect(1)
+
+		Eventually(func() interface{} {
+			reply, _ := client.Do("PUBLISH", "news", "moved")
+			return reply
+		}, 3*time.Second, 50*time.Millisecond).Should(BeEquivalentTo(1))
+
+		Expect(receive()).To(Equal(frame("message", "news", "moved")))
+		Expect(cluster.Nodes[1].Count("subscribe")).NotTo(BeZero())
+	})
+})
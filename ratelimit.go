@@ -0,0 +1,502 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/tidwall/redcon"
+)
+
+// limiterSweep is how often idle buckets are dropped
+const limiterSweep = time.Minute
+
+// limits holds the token buckets of all clients and users
+var limits = newLimiter()
+
+// rateLimits configures token bucket limits, separately for reads and
+// writes, and the number of commands served at once. Admin commands count
+// as writes, commands answered by the balancer are not limited.
+type rateLimits struct {
+	Global rateLimit
+
+	// Clients limit each client IP, the first rule matching it applies
+	Clients []clientRateLimit
+
+	// Users limit each authenticated user
+	Users []userRateLimit
+}
+
+// rateLimit is the number of commands per second, 0 for no limit. Burst is
+// the bucket size as time at the rate, 1s when not set. Concurrency is the
+// number of commands served at once, 0 for no limit.
+type rateLimit struct {
+	Reads       float64
+	Writes      float64
+	Burst       time.Duration
+	Concurrency int
+}
+
+type clientRateLimit struct {
+	CIDR  string
+	Limit rateLimit `yaml:",inline"`
+
+	network *net.IPNet
+}
+
+type userRateLimit struct {
+	Name  string
+	Limit rateLimit `yaml:",inline"`
+}
+
+// parse validates the client rules
+func (r *rateLimits) parse() error {
+	for i := range r.Clients {
+		_, network, err := net.ParseCIDR(r.Clients[i].CIDR)
+		if err != nil {
+			return fmt.Errorf("ratelimit: %v", err)
+		}
+		r.Clients[i].network = network
+	}
+	return nil
+}
+
+// enabled returns true if any limit is set
+func (r *rateLimits) enabled() bool {
+	return r.Global.set() || len(r.Clients) > 0 || len(r.Users) > 0
+}
+
+func (l rateLimit) set() bool { return l.Reads > 0 || l.Writes > 0 || l.Concurrency > 0 }
+
+// rate returns the rate and bucket size for the class
+func (l rateLimit) rate(class string) (float64, float64) {
+	rate := l.Writes
+	if class == classRead.String() {
+		rate = l.Reads
+	}
+
+	burst := l.Burst
+	if burst <= 0 {
+		burst = time.Second
+	}
+
+	return rate, math.Max(1, rate*burst.Seconds())
+}
+
+// scopes returns the buckets a command of the connection is charged to
+func (r *rateLimits) scopes(remote, user string) []limitScope {
+	var scopes []limitScope
+	if r.Global.set() {
+		scopes = append(scopes, limitScope{scope: "global", limit: r.Global})
+	}
+
+	if len(r.Clients) > 0 {
+		host, _, err := net.SplitHostPort(remote)
+		if err != nil {
+			host = remote
+		}
+
+		if ip := net.ParseIP(host); ip != nil {
+			for _, rule := range r.Clients {
+				if rule.network != nil && rule.network.Contains(ip) {
+					scopes = append(scopes, limitScope{scope: "client", name: host, limit: rule.Limit})
+					break
+				}
+			}
+		}
+	}
+
+	if user != "" {
+		for _, rule := range r.Users {
+			if rule.Name == user {
+				scopes = append(scopes, limitScope{scope: "user", name: user, limit: rule.Limit})
+				break
+			}
+		}
+	}
+
+	return scopes
+}
+
+// limitScope names a bucket, the limit is read from the config on each use
+// so reloads apply to running buckets
+type limitScope struct {
+	scope, name string
+	limit       rateLimit
+}
+
+func (s *limitScope) String() string {
+	if s.name == "" {
+		return s.scope
+	}
+	return s.scope + " " + s.name
+}
+
+type bucket struct {
+	rate, size, tokens float64
+	last               time.Time
+
+	allowed, denied uint64
+}
+
+// refill adds the tokens earned since the last use
+func (b *bucket) refill(now time.Time, rate, size float64) {
+	b.rate, b.size = rate, size
+	b.tokens = math.Min(size, b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+}
+
+// slots counts the commands in flight of a scope
+type slots struct {
+	limit, used int
+
+	allowed, denied uint64
+}
+
+// limiter keeps the token buckets, keyed by scope, name and class, and the
+// commands in flight, keyed by scope and name
+type limiter struct {
+	mu       sync.Mutex
+	buckets  map[[3]string]*bucket
+	inflight map[[2]string]*slots
+	swept    time.Time
+}
+
+func newLimiter() *limiter {
+	return &limiter{
+		buckets:  make(map[[3]string]*bucket),
+		inflight: make(map[[2]string]*slots),
+		swept:    time.Now(),
+	}
+}
+
+// take takes n tokens of the class from every bucket. Unless force is set
+// nothing is taken when a bucket is short, the denying bucket is returned.
+// Forced takes may leave buckets in debt, for commands already served.
+func (l *limiter) take(scopes []limitScope, class string, n float64, force bool) *limitScope {
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sweep(now)
+
+	buckets := make([]*bucket, 0, len(scopes))
+	for i, scope := range scopes {
+		rate, size := scope.limit.rate(class)
+		if rate <= 0 {
+			continue
+		}
+
+		id := [3]string{scope.scope, scope.name, class}
+		b, ok := l.buckets[id]
+		if !ok {
+			b = &bucket{tokens: size, last: now}
+			l.buckets[id] = b
+		}
+		b.refill(now, rate, size)
+
+		if !force && b.tokens < n {
+			b.denied++
+			return &scopes[i]
+		}
+		buckets = append(buckets, b)
+	}
+
+	for _, b := range buckets {
+		b.tokens -= n
+		b.allowed += uint64(n)
+	}
+	return nil
+}
+
+// short returns the first bucket short of n tokens of the class, nil when
+// all of them have enough. Nothing is taken.
+func (l *limiter) short(scopes []limitScope, class string, n float64) *limitScope {
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for i, scope := range scopes {
+		rate, size := scope.limit.rate(class)
+		if rate <= 0 {
+			continue
+		}
+
+		tokens := size
+		if b, ok := l.buckets[[3]string{scope.scope, scope.name, class}]; ok {
+			b.refill(now, rate, size)
+			tokens = b.tokens
+		}
+
+		if tokens < n {
+			return &scopes[i]
+		}
+	}
+	return nil
+}
+
+// acquire counts n more commands in flight in every scope with a
+// concurrency limit. Nothing is counted when a scope has no room for them,
+// the full scope is returned.
+func (l *limiter) acquire(scopes []limitScope, n int) *limitScope {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sweep(time.Now())
+
+	used := make([]*slots, 0, len(scopes))
+	for i, scope := range scopes {
+		if scope.limit.Concurrency <= 0 {
+			continue
+		}
+
+		id := [2]string{scope.scope, scope.name}
+		s, ok := l.inflight[id]
+		if !ok {
+			s = &slots{}
+			l.inflight[id] = s
+		}
+		s.limit = scope.limit.Concurrency
+
+		if s.used+n > s.limit {
+			s.denied++
+			return &scopes[i]
+		}
+		used = append(used, s)
+	}
+
+	for _, s := range used {
+		s.used += n
+		s.allowed += uint64(n)
+	}
+	return nil
+}
+
+// release ends n commands counted by acquire with the same scopes
+func (l *limiter) release(scopes []limitScope, n int) {
+	if n == 0 {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, scope := range scopes {
+		if scope.limit.Concurrency <= 0 {
+			continue
+		}
+
+		if s, ok := l.inflight[[2]string{scope.scope, scope.name}]; ok {
+			s.used -= n
+		}
+	}
+}
+
+// sweep drops buckets that were refilled completely and idle scopes
+func (l *limiter) sweep(now time.Time) {
+	if now.Sub(l.swept) < limiterSweep {
+		return
+	}
+	l.swept = now
+
+	for id, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*b.rate >= b.size {
+			delete(l.buckets, id)
+		}
+	}
+
+	for id, s := range l.inflight {
+		if s.used <= 0 {
+			delete(l.inflight, id)
+		}
+	}
+}
+
+// limiterState is a bucket as reported by the admin api, or the commands
+// in flight of a scope with the concurrency class
+type limiterState struct {
+	Scope       string  `json:"scope"`
+	Name        string  `json:"name,omitempty"`
+	Class       string  `json:"class"`
+	Rate        float64 `json:"rate,omitempty"`
+	Burst       float64 `json:"burst,omitempty"`
+	Tokens      float64 `json:"tokens"`
+	Concurrency int     `json:"concurrency,omitempty"`
+	InFlight    int     `json:"inflight"`
+	Allowed     uint64  `json:"allowed"`
+	Denied      uint64  `json:"denied"`
+}
+
+// state returns a snapshot of all buckets
+func (l *limiter) state() []limiterState {
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	states := make([]limiterState, 0, len(l.buckets)+len(l.inflight))
+	for id, b := range l.buckets {
+		states = append(states, limiterState{
+			Scope:   id[0],
+			Name:    id[1],
+			Class:   id[2],
+			Rate:    b.rate,
+			Burst:   b.size,
+			Tokens:  math.Min(b.size, b.tokens+now.Sub(b.last).Seconds()*b.rate),
+			Allowed: b.allowed,
+			Denied:  b.denied,
+		})
+	}
+
+	for id, s := range l.inflight {
+		states = append(states, limiterState{
+			Scope:       id[0],
+			Name:        id[1],
+			Class:       limitConcurrency,
+			Concurrency: s.limit,
+			InFlight:    s.used,
+			Allowed:     s.allowed,
+			Denied:      s.denied,
+		})
+	}
+
+	sort.Slice(states, func(i, j int) bool {
+		a, b := states[i], states[j]
+		if a.Scope != b.Scope {
+			return a.Scope < b.Scope
+		}
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		return a.Class < b.Class
+	})
+
+	return states
+}
+
+// limitConcurrency is the class of concurrency limits in errors, metrics
+// and the admin api
+const limitConcurrency = "concurrency"
+
+// limitClass returns the class a command is limited as, empty when it is
+// not limited
+func limitClass(cmd redcon.Command) string {
+	switch category := lookupCommand(qcmdlower(cmd.Args[0])).category(); category {
+	case "read":
+		return category
+	case "write", "admin":
+		return classWrite.String()
+	}
+	return ""
+}
+
+// limitedCommands counts the commands limited as reads and writes
+func limitedCommands(cmds []redcon.Command) (reads, writes float64) {
+	for _, cmd := range cmds {
+		switch limitClass(cmd) {
+		case "read":
+			reads++
+		case "write":
+			writes++
+		}
+	}
+	return reads, writes
+}
+
+// limitError replies with a RATELIMIT error for the class of the scope
+func limitError(conn redcon.Conn, scope *limitScope, class string) {
+	rateLimited.WithLabelValues(scope.scope, class).Inc()
+
+	limit := class
+	if class != limitConcurrency {
+		limit += " rate"
+	}
+	conn.WriteError(fmt.Sprintf("RATELIMIT %s limit exceeded for %s", limit, scope))
+}
+
+// pipelineAllowed returns true if the command and the pipeline waiting
+// behind it are within the rate limits of the connection as a whole, so
+// they can be batched. Nothing is taken.
+func (sb *SummitDBBalancer) pipelineAllowed(conn redcon.Conn, cmd redcon.Command) bool {
+	r := getConfig().RateLimit
+	pcmds := conn.PeekPipeline()
+	if !r.enabled() || len(pcmds) == 0 {
+		return true
+	}
+
+	scopes := r.scopes(conn.RemoteAddr(), getSession(conn).user)
+	reads, writes := limitedCommands(append([]redcon.Command{cmd}, pcmds...))
+	return (reads == 0 || limits.short(scopes, "read", reads) == nil) &&
+		(writes == 0 || limits.short(scopes, "write", writes) == nil)
+}
+
+// admit counts the command in flight, with the pipeline waiting behind it
+// when it is batched, and takes the token of the command. A pipeline
+// without room to be in flight as a whole is not batched. It replies with
+// a RATELIMIT error if the command is over the limits of the connection,
+// otherwise release must be called once the commands are served.
+func (sb *SummitDBBalancer) admit(conn redcon.Conn, cmd redcon.Command, batch bool) (release func(), batched bool, ok bool) {
+	r := getConfig().RateLimit
+	if !r.enabled() {
+		return func() {}, batch, true
+	}
+
+	scopes := r.scopes(conn.RemoteAddr(), getSession(conn).user)
+	class := limitClass(cmd)
+
+	n, acquired := 0, false
+	if class != "" {
+		n = 1
+	}
+
+	if batch {
+		reads, writes := limitedCommands(conn.PeekPipeline())
+		if pn := int(reads + writes); pn > 0 {
+			if limits.acquire(scopes, n+pn) == nil {
+				n, acquired = n+pn, true
+			} else {
+				batch = false
+			}
+		}
+	}
+
+	if !acquired && n > 0 {
+		if denied := limits.acquire(scopes, n); denied != nil {
+			limitError(conn, denied, limitConcurrency)
+			return nil, false, false
+		}
+	}
+
+	if class != "" {
+		if denied := limits.take(scopes, class, 1, false); denied != nil {
+			limits.release(scopes, n)
+			limitError(conn, denied, class)
+			return nil, false, false
+		}
+	}
+
+	return func() { limits.release(scopes, n) }, batch, true
+}
+
+// charge takes the tokens of pipelined commands served along with the
+// command admitted
+func (sb *SummitDBBalancer) charge(conn redcon.Conn, pcmds []redcon.Command) {
+	if len(pcmds) == 0 {
+		return
+	}
+
+	reads, writes := limitedCommands(pcmds)
+
+	scopes := getConfig().RateLimit.scopes(conn.RemoteAddr(), getSession(conn).user)
+	if reads > 0 {
+		limits.take(scopes, "read", reads, true)
+	}
+	if writes > 0 {
+		limits.take(scopes, "write", writes, true)
+	}
+}
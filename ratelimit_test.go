@@ -0,0 +1,207 @@
+package main
+
+import (
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/masomo/summitdb-balancer/summitdbtest"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("rate limits", func() {
+	It("should pick the scopes of a connection", func() {
+		r := rateLimits{
+			Global: rateLimit{Writes: 10},
+			Clients: []clientRateLimit{
+				{CIDR: "10.0.0.0/8", Limit: rateLimit{Reads: 1}},
+				{CIDR: "0.0.0.0/0", Limit: rateLimit{Reads: 2}},
+			},
+			Users: []userRateLimit{{Name: "app", Limit: rateLimit{Concurrency: 1}}},
+		}
+		Expect(r.parse()).To(Succeed())
+
+		scopes := r.scopes("10.1.2.3:5000", "app")
+		Expect(scopes).To(HaveLen(3))
+		Expect(scopes[0].String()).To(Equal("global"))
+		Expect(scopes[1].String()).To(Equal("client 10.1.2.3"))
+		Expect(scopes[1].limit.Reads).To(BeEquivalentTo(1))
+		Expect(scopes[2].String()).To(Equal("user app"))
+
+		scopes = r.scopes("192.168.1.1:5000", "other")
+		Expect(scopes).To(HaveLen(2))
+		Expect(scopes[1].limit.Reads).To(BeEquivalentTo(2))
+
+		Expect((&rateLimits{Clients: []clientRateLimit{{CIDR: "10.0.0.0"}}}).parse()).NotTo(Succeed())
+	})
+
+	Context("limiter", func() {
+		var l *limiter
+		var scopes []limitScope
+
+		BeforeEach(func() {
+			l = newLimiter()
+			scopes = []limitScope{
+				{scope: "global", limit: rateLimit{Reads: 2, Writes: 100, Concurrency: 3}},
+				{scope: "user", name: "app", limit: rateLimit{Reads: 100, Concurrency: 2}},
+			}
+		})
+
+		It("should take tokens until a bucket is short", func() {
+			Expect(l.short(scopes, "read", 2)).To(BeNil())
+			Expect(l.short(scopes, "read", 3)).To(Equal(&scopes[0]))
+
+			Expect(l.take(scopes, "read", 1, false)).To(BeNil())
+			Expect(l.take(scopes, "read", 1, false)).To(BeNil())
+			Expect(l.take(scopes, "read", 1, false)).To(Equal(&scopes[0]))
+			Expect(l.short(scopes, "read", 1)).To(Equal(&scopes[0]))
+
+			// writes have their own buckets
+			Expect(l.take(scopes, "write", 1, false)).To(BeNil())
+
+			// forced takes leave the bucket in debt
+			Expect(l.take(scopes, "read", 2, true)).To(BeNil())
+			time.Sleep(600 * time.Millisecond)
+			Expect(l.take(scopes, "read", 1, false)).To(Equal(&scopes[0]))
+		})
+
+		It("should refill buckets at the rate", func() {
+			Expect(l.take(scopes, "read", 2, false)).To(BeNil())
+			Expect(l.take(scopes, "read", 1, false)).NotTo(BeNil())
+
+			time.Sleep(550 * time.Millisecond)
+			Expect(l.take(scopes, "read", 1, false)).To(BeNil())
+		})
+
+		It("should count commands in flight", func() {
+			Expect(l.acquire(scopes, 2)).To(BeNil())
+			Expect(l.acquire(scopes, 1)).To(Equal(&scopes[1]))
+
+			l.release(scopes, 1)
+			Expect(l.acquire(scopes, 1)).To(BeNil())
+
+			// nothing is counted when a scope is full
+			Expect(l.acquire(scopes[:1], 2)).To(Equal(&scopes[0]))
+			Expect(l.acquire(scopes[:1], 1)).To(BeNil())
+
+			state := l.state()
+			Expect(state).To(ContainElement(limiterState{
+				Scope: "global", Class: limitConcurrency, Concurrency: 3, InFlight: 3, Allowed: 4, Denied: 1,
+			}))
+			Expect(state).To(ContainElement(limiterState{
+				Scope: "user", Name: "app", Class: limitConcurrency, Concurrency: 2, InFlight: 2, Allowed: 3, Denied: 1,
+			}))
+		})
+	})
+
+	Context("through the proxy", func() {
+		var cluster *summitdbtest.Cluster
+		var p *proxy
+		var client redis.Conn
+
+		var start = func(r rateLimits) {
+			Expect(r.parse()).To(Succeed())
+
+			p = startClusterProxy(&Config{
+				Auth:         auth{Password: "secret"},
+				RateLimit:    r,
+				LoadBalancer: loadBalancer{MaxIdle: 4, Routing: true},
+			}, cluster)
+
+			var err error
+			client, err = p.dial()
+			Expect(err).NotTo(HaveOccurred())
+		}
+
+		BeforeEach(func() {
+			limits = newLimiter()
+
+			var err error
+			cluster, err = summitdbtest.NewCluster(2)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			client.Close()
+			p.close()
+			Expect(cluster.Close()).To(Succeed())
+		})
+
+		It("should authenticate before limiting", func() {
+			start(rateLimits{Global: rateLimit{Writes: 1}})
+
+			_, err := client.Do("SET", "a", "1")
+			Expect(err).To(MatchError("NOAUTH Authentication required."))
+
+			Expect(client.Do("AUTH", "secret")).To(Equal("OK"))
+			Expect(client.Do("SET", "a", "1")).To(Equal("OK"))
+
+			state := limits.state()
+			Expect(state).To(HaveLen(1))
+			Expect(state[0].Allowed).To(BeEquivalentTo(1))
+			Expect(state[0].Denied).To(BeZero())
+		})
+
+		It("should reply RATELIMIT once a bucket is empty", func() {
+			start(rateLimits{Users: []userRateLimit{{Name: defaultUser, Limit: rateLimit{Writes: 1, Burst: time.Second}}}})
+			Expect(client.Do("AUTH", "secret")).To(Equal("OK"))
+
+			Expect(client.Do("SET", "a", "1")).To(Equal("OK"))
+			_, err := client.Do("SET", "a", "2")
+			Expect(err).To(MatchError("RATELIMIT write rate limit exceeded for user " + defaultUser))
+
+			// reads have their own bucket
+			Expect(redis.String(client.Do("GET", "a"))).To(Equal("1"))
+			Expect(cluster.Nodes[0].Count("set")).To(Equal(1))
+		})
+
+		It("should dispatch pipelines over the limits one by one", func() {
+			start(rateLimits{Global: rateLimit{Reads: 2, Burst: time.Second}})
+			Expect(client.Do("AUTH", "secret")).To(Equal("OK"))
+
+			for i := 0; i < 4; i++ {
+				Expect(client.Send("GET", "a")).To(Succeed())
+			}
+			Expect(client.Flush()).To(Succeed())
+
+			for i := 0; i < 4; i++ {
+				_, err := client.Receive()
+				if i < 2 {
+					Expect(err).NotTo(HaveOccurred())
+				} else {
+					Expect(err).To(MatchError("RATELIMIT read rate limit exceeded for global"))
+				}
+			}
+			Expect(cluster.Nodes[1].Count("get")).To(Equal(2))
+		})
+
+		It("should limit the commands of a client in flight", func() {
+			start(rateLimits{Clients: []clientRateLimit{{CIDR: "127.0.0.0/8", Limit: rateLimit{Concurrency: 1}}}})
+			Expect(client.Do("AUTH", "secret")).To(Equal("OK"))
+
+			other, err := p.dial()
+			Expect(err).NotTo(HaveOccurred())
+			defer other.Close()
+			Expect(other.Do("AUTH", "secret")).To(Equal("OK"))
+
+			for _, node := range cluster.Nodes {
+				node.SetFault("get", summitdbtest.Fault{Latency: 300 * time.Millisecond})
+			}
+
+			done := make(chan error)
+			go func() {
+				_, err := client.Do("GET", "a")
+				done <- err
+			}()
+
+			time.Sleep(100 * time.Millisecond)
+			_, err = other.Do("GET", "a")
+			Expect(err).To(MatchError("RATELIMIT concurrency limit exceeded for client 127.0.0.1"))
+			Expect(<-done).NotTo(HaveOccurred())
+
+			// commands answered by the balancer are not limited
+			Expect(other.Do("PING")).To(Equal("PONG"))
+			Expect(other.Do("GET", "a")).To(BeNil())
+		})
+	})
+})
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"github.com/masomo/summitdb-balancer/balancer"
+	"github.com/tidwall/redcon"
+)
+
+// readPref is where the reads of a connection go, set by SB.READPREF
+type readPref int
+
+const (
+	// prefDefault follows the routing of the balancer
+	prefDefault readPref = iota
+	prefLeader
+	prefFollower
+	prefAny
+)
+
+var readPrefs = map[string]readPref{
+	"default":  prefDefault,
+	"leader":   prefLeader,
+	"follower": prefFollower,
+	"any":      prefAny,
+}
+
+func (p readPref) String() string {
+	for name, pref := range readPrefs {
+		if pref == p {
+			return name
+		}
+	}
+	return "unknown"
+}
+
+// pick returns the backend of the balancer for the preference, the default
+// is the next backend the balance mode picks
+func (p readPref) pick(b *balancer.Balancer) *balancer.Backend {
+	switch p {
+	case prefLeader:
+		return b.Leader()
+	case prefFollower:
+		return b.NextFollower()
+	case prefAny:
+		return b.NextAny()
+	}
+	return b.Next()
+}
+
+// target returns the preference picking the backend of a command. Reads
+// follow the read preference, the routing otherwise, where stale reads go
+// to the leader to see the writes of the connection.
+func target(b *balancer.Balancer, ci commandInfo, pref readPref, stale bool) readPref {
+	if ci.class == classRead && pref != prefDefault {
+		return pref
+	}
+
+	if b.Routing() && (ci.leader() || ci.class == classRead && stale) {
+		return prefLeader
+	}
+	return prefDefault
+}
+
+// fenceToken is the key of the FENCE committed through the log before a
+// fenced read, so the read sees the writes committed before it
+const fenceToken = "sb:readyourwrites"
+
+// fences returns true if a stale read sent to the target has to be fenced
+func fences(ci commandInfo, target readPref, stale bool) bool {
+	return ci.class == classRead && stale && target == prefLeader &&
+		getConfig().LoadBalancer.ReadYourWrites.Fence
+}
+
+// readPreference handles SB.READPREF [leader|follower|any|default] [NEXT],
+// NEXT applies the preference to the next command only. Without arguments
+// it replies the preference of the connection.
+func (sb *SummitDBBalancer) readPreference(conn redcon.Conn, cmd redcon.Command) {
+	s := getSession(conn)
+
+	if len(cmd.Args) == 1 {
+		conn.WriteString(s.pref.String())
+		return
+	}
+
+	if len(cmd.Args) > 3 {
+		conn.WriteError("ERR wrong number of arguments for 'sb.readpref' command")
+		return
+	}
+
+	pref, ok := readPrefs[qcmdlower(cmd.Args[1])]
+	if !ok {
+		conn.WriteError("ERR read preference must be leader, follower, any or default")
+		return
+	}
+
+	if len(cmd.Args) == 3 {
+		if qcmdlower(cmd.Args[2]) != "next" {
+			conn.WriteError("ERR syntax error")
+			return
+		}
+
+		s.prefNext, s.prefOnce = pref, true
+		conn.WriteString("OK")
+		return
+	}
+
+	s.pref, s.prefOnce = pref, false
+	conn.WriteString("OK")
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"github.com/gomodule/redigo/redis"
+	"github.com/masomo/summitdb-balancer/summitdbtest"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("read preference", func() {
+	var cluster *summitdbtest.Cluster
+	var p *proxy
+	var client redis.Conn
+
+	var start = func(routing bool) {
+		p = startClusterProxy(&Config{LoadBalancer: loadBalancer{MaxIdle: 4, Routing: routing}}, cluster)
+
+		var err error
+		client, err = p.dial()
+		Expect(err).NotTo(HaveOccurred())
+	}
+
+	var gets = func(n int) (leader, followers int) {
+		for _, node := range cluster.Nodes {
+			node.ResetCounts()
+		}
+		for i := 0; i < n; i++ {
+			Expect(client.Do("GET", "a")).To(BeNil())
+		}
+		return cluster.Nodes[0].Count("get"), cluster.Nodes[1].Count("get") + cluster.Nodes[2].Count("get")
+	}
+
+	BeforeEach(func() {
+		var err error
+		cluster, err = summitdbtest.NewCluster(3)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		client.Close()
+		p.close()
+		Expect(cluster.Close()).To(Succeed())
+	})
+
+	It("should reply and validate the preference", func() {
+		start(true)
+
+		Expect(client.Do("SB.READPREF")).To(Equal("default"))
+		Expect(client.Do("SB.READPREF", "LEADER")).To(Equal("OK"))
+		Expect(client.Do("SB.READPREF")).To(Equal("leader"))
+
+		_, err := client.Do("SB.READPREF", "nearest")
+		Expect(err).To(MatchError("ERR read preference must be leader, follower, any or default"))
+		_, err = client.Do("SB.READPREF", "leader", "later")
+		Expect(err).To(MatchError("ERR syntax error"))
+		_, err = client.Do("SB.READPREF", "leader", "next", "x")
+		Expect(err).To(MatchError("ERR wrong number of arguments for 'sb.readpref' command"))
+	})
+
+	It("should send reads to the leader", func() {
+		start(true)
+
+		Expect(client.Do("SB.READPREF", "leader")).To(Equal("OK"))
+		Expect(gets(6)).To(Equal(6))
+
+		Expect(client.Do("SB.READPREF", "default")).To(Equal("OK"))
+		leader, followers := gets(6)
+		Expect(leader).To(BeZero())
+		Expect(followers).To(Equal(6))
+	})
+
+	It("should send reads to followers without routing", func() {
+		start(false)
+
+		leader, _ := gets(6)
+		Expect(leader).NotTo(BeZero())
+
+		Expect(client.Do("SB.READPREF", "follower")).To(Equal("OK"))
+		leader, followers := gets(6)
+		Expect(leader).To(BeZero())
+		Expect(followers).To(Equal(6))
+	})
+
+	It("should send reads to any node", func() {
+		start(true)
+
+		Expect(client.Do("SB.READPREF", "any")).To(Equal("OK"))
+		leader, followers := gets(6)
+		Expect(leader).NotTo(BeZero())
+		Expect(followers).NotTo(BeZero())
+	})
+
+	It("should keep writes on the leader", func() {
+		start(true)
+
+		Expect(client.Do("SB.READPREF", "follower")).To(Equal("OK"))
+		Expect(client.Do("SET", "a", "1")).To(Equal("OK"))
+		Expect(cluster.Nodes[1].Count("set") + cluster.Nodes[2].Count("set")).To(BeZero())
+	})
+
+	It("should apply NEXT to the next command only", func() {
+		start(true)
+
+		Expect(client.Do("SB.READPREF", "leader", "NEXT")).To(Equal("OK"))
+		Expect(client.Do("SB.READPREF")).To(Equal("default"))
+
+		Expect(client.Do("SB.READPREF", "leader", "NEXT")).To(Equal("OK"))
+		Expect(gets(1)).To(Equal(1))
+
+		leader, followers := gets(3)
+		Expect(leader).To(BeZero())
+		Expect(followers).To(Equal(3))
+	})
+
+	It("should not batch the pipeline behind a NEXT preference", func() {
+		start(true)
+		for _, node := range cluster.Nodes {
+			node.ResetCounts()
+		}
+
+		Expect(client.Send("SB.READPREF", "leader", "NEXT")).To(Succeed())
+		Expect(client.Send("GET", "a")).To(Succeed())
+		Expect(client.Send("GET", "a")).To(Succeed())
+		Expect(client.Send("GET", "a")).To(Succeed())
+		Expect(client.Flush()).To(Succeed())
+
+		Expect(client.Receive()).To(Equal("OK"))
+		for i := 0; i < 3; i++ {
+			Expect(client.Receive()).To(BeNil())
+		}
+
+		Expect(cluster.Nodes[0].Count("get")).To(Equal(1))
+		Expect(cluster.Nodes[0].Count("mget")).To(BeZero())
+		Expect(cluster.Nodes[1].Count("get") + cluster.Nodes[1].Count("mget") +
+			cluster.Nodes[2].Count("get") + cluster.Nodes[2].Count("mget")).NotTo(BeZero())
+	})
+})
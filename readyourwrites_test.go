@@ -0,0 +1,127 @@
+package main
+
+import (
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/masomo/summitdb-balancer/summitdbtest"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("read your writes", func() {
+	var cluster *summitdbtest.Cluster
+	var p *proxy
+	var client redis.Conn
+
+	var start = func(ryw readYourWrites) {
+		// the checks don't move the leader back after an election
+		upstream := upstreams(cluster.Addrs())
+		for i := range upstream {
+			upstream[i].CheckInterval = time.Hour
+		}
+
+		p = startClusterProxy(&Config{LoadBalancer: loadBalancer{
+			MaxIdle:        4,
+			Routing:        true,
+			ReadYourWrites: ryw,
+			Upstream:       upstream,
+		}}, cluster)
+
+		var err error
+		client, err = p.dial()
+		Expect(err).NotTo(HaveOccurred())
+	}
+
+	var followerGets = func() int {
+		return cluster.Nodes[1].Count("get") + cluster.Nodes[2].Count("get")
+	}
+
+	BeforeEach(func() {
+		var err error
+		cluster, err = summitdbtest.NewCluster(3)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		client.Close()
+		p.close()
+		Expect(cluster.Close()).To(Succeed())
+	})
+
+	It("should read from followers without a window", func() {
+		start(readYourWrites{})
+
+		Expect(client.Do("SET", "a", "1")).To(Equal("OK"))
+		Expect(redis.String(client.Do("GET", "a"))).To(Equal("1"))
+
+		Expect(cluster.Nodes[0].Count("get")).To(BeZero())
+		Expect(followerGets()).To(Equal(1))
+	})
+
+	It("should read from the leader within the window", func() {
+		start(readYourWrites{Window: 200 * time.Millisecond})
+
+		other, err := p.dial()
+		Expect(err).NotTo(HaveOccurred())
+		defer other.Close()
+
+		Expect(client.Do("SET", "a", "1")).To(Equal("OK"))
+		Expect(redis.String(client.Do("GET", "a"))).To(Equal("1"))
+		Expect(cluster.Nodes[0].Count("get")).To(Equal(1))
+
+		// the window is per connection
+		Expect(redis.String(other.Do("GET", "a"))).To(Equal("1"))
+		Expect(followerGets()).To(Equal(1))
+
+		time.Sleep(250 * time.Millisecond)
+		Expect(redis.String(client.Do("GET", "a"))).To(Equal("1"))
+		Expect(cluster.Nodes[0].Count("get")).To(Equal(1))
+		Expect(followerGets()).To(Equal(2))
+		Expect(cluster.Nodes[0].Count("fence")).To(BeZero())
+	})
+
+	It("should fence each read within the window", func() {
+		start(readYourWrites{Window: time.Second, Fence: true})
+
+		Expect(client.Do("SET", "a", "1")).To(Equal("OK"))
+		Expect(redis.String(client.Do("GET", "a"))).To(Equal("1"))
+		Expect(redis.String(client.Do("GET", "a"))).To(Equal("1"))
+
+		Expect(cluster.Nodes[0].Count("fence")).To(Equal(2))
+		Expect(cluster.Nodes[0].Count("get")).To(Equal(2))
+
+		// pipelined reads are fenced one by one
+		Expect(client.Send("SET", "b", "2")).To(Succeed())
+		Expect(client.Send("GET", "b")).To(Succeed())
+		Expect(client.Flush()).To(Succeed())
+		Expect(client.Receive()).To(Equal("OK"))
+		Expect(redis.String(client.Receive())).To(Equal("2"))
+		Expect(cluster.Nodes[0].Count("fence")).To(Equal(3))
+	})
+
+	It("should not read when the FENCE fails", func() {
+		start(readYourWrites{Window: time.Second, Fence: true})
+		Expect(client.Do("SET", "a", "1")).To(Equal("OK"))
+
+		cluster.Nodes[0].SetFault("fence", summitdbtest.Fault{Error: "ERR fence failed"})
+
+		_, err := client.Do("GET", "a")
+		Expect(err).To(MatchError("ERR fence failed"))
+		Expect(cluster.Nodes[0].Count("get")).To(BeZero())
+		Expect(followerGets()).To(BeZero())
+	})
+
+	It("should read from the node that served the FENCE after a redirect", func() {
+		start(readYourWrites{Window: time.Second, Fence: true})
+		Expect(client.Do("SET", "a", "1")).To(Equal("OK"))
+
+		// the balancer still takes the old leader for the leader
+		cluster.Elect(1)
+
+		Expect(redis.String(client.Do("GET", "a"))).To(Equal("1"))
+		Expect(cluster.Nodes[1].Count("fence")).To(Equal(1))
+		Expect(cluster.Nodes[1].Count("get")).To(Equal(1))
+		Expect(cluster.Nodes[0].Count("get")).To(BeZero())
+	})
+})
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"github.com/gomodule/redigo/redis"
+	"github.com/masomo/summitdb-balancer/summitdbtest"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("redirects", func() {
+	var cluster *summitdbtest.Cluster
+	var p *proxy
+	var client redis.Conn
+
+	BeforeEach(func() {
+		var err error
+		cluster, err = summitdbtest.NewCluster(3)
+		Expect(err).NotTo(HaveOccurred())
+
+		// without routing writes land on followers too
+		p = startClusterProxy(&Config{LoadBalancer: loadBalancer{MaxIdle: 4}}, cluster)
+
+		client, err = p.dial()
+		Expect(err).NotTo(HaveOccurred())
+
+		for _, node := range cluster.Nodes {
+			node.ResetCounts()
+		}
+	})
+
+	AfterEach(func() {
+		client.Close()
+		p.close()
+		Expect(cluster.Close()).To(Succeed())
+	})
+
+	It("should follow the TRY replies of followers", func() {
+		for i := 0; i < 9; i++ {
+			Expect(client.Do("SET", "a", i)).To(Equal("OK"))
+		}
+
+		Expect(cluster.Nodes[1].Count("set") + cluster.Nodes[2].Count("set")).To(Equal(6))
+		Expect(cluster.Nodes[0].Count("set")).To(Equal(9))
+		Expect(redis.String(client.Do("GET", "a"))).To(Equal("8"))
+	})
+
+	It("should follow redirects of batched writes", func() {
+		for i := 0; i < 3; i++ {
+			client.Send("SET", "a", i)
+			client.Send("SET", "b", i)
+		}
+		Expect(client.Flush()).To(Succeed())
+
+		for i := 0; i < 6; i++ {
+			Expect(client.Receive()).To(Equal("OK"))
+		}
+		Expect(redis.String(client.Do("GET", "b"))).To(Equal("2"))
+	})
+
+	It("should relay redirects it can't follow", func() {
+		cluster.Election()
+
+		_, err := client.Do("SET", "a", "1")
+		Expect(err).To(MatchError("ERR leader not known"))
+	})
+})
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/masomo/summitdb-balancer/summitdbtest"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("reload", func() {
+	var cluster *summitdbtest.Cluster
+	var p *proxy
+	var client redis.Conn
+	var dir, path, saved string
+
+	// writeConfig writes a config file with the nodes as upstreams
+	var writeConfig = func(nodes ...int) {
+		var upstream []string
+		for _, i := range nodes {
+			upstream = append(upstream, fmt.Sprintf("    - {host: %s, fall: 1, rise: 1, checkinterval: 100ms}", cluster.Nodes[i].Addr()))
+		}
+
+		config := "loadbalancer:\n  mode: roundrobin\n  maxidle: 4\n  upstream:\n" + strings.Join(upstream, "\n") + "\n"
+		Expect(ioutil.WriteFile(path, []byte(config), 0600)).To(Succeed())
+	}
+
+	// backends returns the upstreams of the running balancer
+	var backends = func() []string {
+		var addrs []string
+		for _, s := range p.sb.shards().shards[0].balancer.Stats() {
+			addrs = append(addrs, s.Addr)
+		}
+		sort.Strings(addrs)
+		return addrs
+	}
+
+	var addrs = func(nodes ...int) []string {
+		var addrs []string
+		for _, i := range nodes {
+			addrs = append(addrs, cluster.Nodes[i].Addr())
+		}
+		sort.Strings(addrs)
+		return addrs
+	}
+
+	BeforeEach(func() {
+		var err error
+		cluster, err = summitdbtest.NewCluster(3)
+		Expect(err).NotTo(HaveOccurred())
+
+		dir, err = ioutil.TempDir("", "sb")
+		Expect(err).NotTo(HaveOccurred())
+		path = filepath.Join(dir, "sb.yaml")
+		saved, *flagconfig = *flagconfig, path
+
+		writeConfig(0)
+		c, err := readConfig(path)
+		Expect(err).NotTo(HaveOccurred())
+		p = startClusterProxy(c, cluster)
+
+		client, err = p.dial()
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		client.Close()
+		p.close()
+		*flagconfig = saved
+		Expect(os.RemoveAll(dir)).To(Succeed())
+		Expect(cluster.Close()).To(Succeed())
+	})
+
+	It("should apply the config on RELOAD", func() {
+		Expect(backends()).To(Equal(addrs(0)))
+
+		writeConfig(0, 1, 2)
+		Expect(client.Do("RELOAD")).To(Equal("OK"))
+		Expect(backends()).To(Equal(addrs(0, 1, 2)))
+
+		writeConfig(1, 2)
+		Expect(client.Do("RELOAD")).To(Equal("OK"))
+		Expect(backends()).To(Equal(addrs(1, 2)))
+		Expect(getConfig().LoadBalancer.Upstream).To(HaveLen(2))
+
+		for _, node := range cluster.Nodes {
+			node.ResetCounts()
+		}
+		for i := 0; i < 4; i++ {
+			Expect(client.Do("GET", "a")).To(BeNil())
+		}
+		Expect(cluster.Nodes[0].Count("get")).To(BeZero())
+	})
+
+	It("should keep the running config when the new one is invalid", func() {
+		Expect(ioutil.WriteFile(path, []byte("loadbalancer:\n  mode: roundrobin\n"), 0600)).To(Succeed())
+
+		_, err := client.Do("RELOAD")
+		Expect(err).To(MatchError("ERR no upstream in config for shard " + defaultShard))
+
+		Expect(ioutil.WriteFile(path, []byte("loadbalancer: ["), 0600)).To(Succeed())
+		_, err = client.Do("RELOAD")
+		Expect(err).To(HaveOccurred())
+
+		Expect(backends()).To(Equal(addrs(0)))
+		Expect(getConfig().LoadBalancer.Upstream).To(HaveLen(1))
+	})
+
+	It("should let in-flight commands of removed backends finish", func() {
+		Expect(client.Do("SET", "a", "1")).To(Equal("OK"))
+		cluster.Nodes[0].SetFault("get", summitdbtest.Fault{Latency: 300 * time.Millisecond})
+
+		reply := make(chan interface{}, 1)
+		go func() {
+			defer GinkgoRecover()
+
+			c, err := p.dial()
+			Expect(err).NotTo(HaveOccurred())
+			defer c.Close()
+
+			value, err := redis.String(c.Do("GET", "a"))
+			Expect(err).NotTo(HaveOccurred())
+			reply <- value
+		}()
+		Eventually(func() int { return cluster.Nodes[0].Count("get") }).Should(Equal(1))
+
+		// the removed backend is drained while the GET is in flight
+		writeConfig(1, 2)
+		Expect(p.sb.reload()).To(Succeed())
+		Expect(backends()).To(Equal(addrs(1, 2)))
+
+		Eventually(reply, time.Second).Should(Receive(Equal("1")))
+		Expect(redis.String(client.Do("GET", "a"))).To(Equal("1"))
+	})
+})
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"net"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/masomo/summitdb-balancer/balancer"
+	"github.com/semihalev/log"
+)
+
+// do sends a command to the backend of the shard balancer the session
+// targets, failures are retried according to the retry policy
+func (sb *SummitDBBalancer) do(s *session, b *balancer.Balancer, ci commandInfo, name string, args []interface{}) (interface{}, error) {
+	backend := s.target(b, ci).pick(b)
+
+	var reply interface{}
+	var err error
+	// the read goes where the FENCE was committed, which may be the leader
+	// a redirect pointed to
+	if s.fences(b, ci) {
+		reply, backend, err = sb.doFollow(s, b, backend, "FENCE", []interface{}{fenceToken})
+		if rerr, ok := reply.(redis.Error); ok && err == nil {
+			return rerr, nil
+		}
+	}
+
+	if err == nil {
+		reply, err = sb.doBackend(s, b, backend, name, args)
+	}
+
+	if err != nil {
+		reply, err = sb.retry(s, b, ci, backend, err, name, args)
+	}
+
+	if err == nil && ci.class == classWrite {
+		s.wrote()
+	}
+
+	return reply, err
+}
+
+// retry reruns a command that failed on backend with a connection error.
+// The backend gets a passive failure. Reads are retried on other backends,
+// writes only on the leader when the connection could not be made, so the
+// command was provably not applied.
+func (sb *SummitDBBalancer) retry(s *session, b *balancer.Balancer, ci commandInfo, backend *balancer.Backend, err error, name string, args []interface{}) (interface{}, error) {
+	var tried []string
+	for attempt := 0; ; attempt++ {
+		b.MarkFailed(backend.Addr)
+		tried = append(tried, backend.Addr)
+
+		next := retryBackend(b, ci, attempt, tried, err)
+		if next == nil {
+			return nil, err
+		}
+
+		log.Debug("Retrying command", "command", name, "failed", backend.Addr, "node", next.Addr, "error", err.Error())
+		markRetry(backend, ci)
+
+		backend = next
+
+		reply, rerr := sb.doBackend(s, b, backend, name, args)
+		if rerr == nil {
+			return reply, nil
+		}
+		err = rerr
+	}
+}
+
+// retryBackend returns the backend for the retry of a command that failed
+// on the tried backends, nil when the retry policy does not allow another
+func retryBackend(b *balancer.Balancer, ci commandInfo, attempt int, tried []string, err error) *balancer.Backend {
+	policy := getConfig().LoadBalancer.Retry
+
+	switch {
+	case ci.class == classRead && attempt < policy.Reads:
+		return b.NextExcept(tried...)
+	case ci.class != classRead && attempt < policy.Writes && isDialError(err):
+		// only the leader applies writes, followers would redirect them
+		// back to the leader that failed
+		if next := b.KnownLeader(); next != nil && !contains(tried, next.Addr) {
+			return next
+		}
+	}
+	return nil
+}
+
+// isDialError returns true if the connection to the backend failed
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/masomo/summitdb-balancer/summitdbtest"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("retries", func() {
+	var cluster *summitdbtest.Cluster
+	var p *proxy
+	var client redis.Conn
+
+	BeforeEach(func() {
+		var err error
+		cluster, err = summitdbtest.NewCluster(3)
+		Expect(err).NotTo(HaveOccurred())
+
+		// the checks don't notice a stopped node
+		upstream := upstreams(cluster.Addrs())
+		for i := range upstream {
+			upstream[i].CheckInterval, upstream[i].Fall = time.Hour, 3
+		}
+
+		p = startClusterProxy(&Config{LoadBalancer: loadBalancer{
+			Routing:  true,
+			Retry:    retry{Reads: 2, Writes: 2},
+			Upstream: upstream,
+		}}, cluster)
+
+		client, err = p.dial()
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		client.Close()
+		p.close()
+		Expect(cluster.Close()).To(Succeed())
+	})
+
+	It("should retry reads on another follower", func() {
+		Expect(cluster.Nodes[2].Stop()).To(Succeed())
+
+		for i := 0; i < 6; i++ {
+			Expect(client.Do("GET", "a")).To(BeNil())
+		}
+		Expect(cluster.Nodes[1].Count("get")).To(Equal(6))
+	})
+
+	It("should not retry writes on followers", func() {
+		Expect(cluster.Nodes[0].Stop()).To(Succeed())
+		for _, node := range cluster.Nodes {
+			node.ResetCounts()
+		}
+
+		// the idle connection fails first, then dialing it
+		_, err := client.Do("SET", "a", "1")
+		Expect(err).To(HaveOccurred())
+		_, err = client.Do("SET", "a", "1")
+		Expect(err).To(MatchError(ContainSubstring("connection refused")))
+
+		Expect(cluster.Nodes[1].Count("set")).To(BeZero())
+		Expect(cluster.Nodes[2].Count("set")).To(BeZero())
+	})
+})
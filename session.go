@@ -0,0 +1,292 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/masomo/summitdb-balancer/balancer"
+	"github.com/semihalev/log"
+	"github.com/tidwall/redcon"
+)
+
+// session holds the state of a client connection
+type session struct {
+	// txOpen is set between MULTI and EXEC/DISCARD
+	txOpen bool
+
+	// tx is the leader connection pinned by the first queued command, on
+	// the shard owning its keys
+	tx      redis.Conn
+	txShard *shard
+	txAddr  string
+
+	// txAbort is set when a queued command was rejected, EXEC discards the
+	// transaction
+	txAbort bool
+
+	// user is the name the client authenticated as, empty until AUTH
+	user string
+
+	// lastWrite is when the connection last wrote, set with read-your-writes on
+	lastWrite time.Time
+
+	// pref is the read preference of the connection, prefNext overrides it
+	// for the next command when prefOnce is set
+	pref, prefNext readPref
+	prefOnce       bool
+
+	// backend and latency of the last backend round trip of the current
+	// command, reported to monitors
+	backend string
+	latency time.Duration
+
+	// piped holds the route of each command of a batched pipeline
+	piped []route
+
+	// busy is set while a batch of commands read from the client is served
+	busy bool
+}
+
+// route is the backend round trip of a command
+type route struct {
+	backend string
+	latency time.Duration
+}
+
+func getSession(conn redcon.Conn) *session {
+	if s, ok := conn.Context().(*session); ok {
+		return s
+	}
+
+	s := new(session)
+	conn.SetContext(s)
+
+	return s
+}
+
+// routed records the backend round trip of the current command
+func (s *session) routed(addr string, latency time.Duration) {
+	s.backend, s.latency = addr, latency
+}
+
+// route returns the route of the i-th command served by the current one
+func (s *session) route(i int) route {
+	if i < len(s.piped) {
+		return s.piped[i]
+	}
+	return route{backend: s.backend, latency: s.latency}
+}
+
+// wrote records a write of the connection when read-your-writes is on
+func (s *session) wrote() {
+	if getConfig().LoadBalancer.ReadYourWrites.Window > 0 {
+		s.lastWrite = time.Now()
+	}
+}
+
+// readsLeader returns true if reads must go to the leader for the
+// connection to see its own writes
+func (s *session) readsLeader() bool {
+	window := getConfig().LoadBalancer.ReadYourWrites.Window
+	return window > 0 && time.Since(s.lastWrite) < window
+}
+
+// preference returns the read preference of the current command
+func (s *session) preference() readPref {
+	if s.prefOnce {
+		return s.prefNext
+	}
+	return s.pref
+}
+
+// target returns the preference picking the backend of a command of the
+// connection
+func (s *session) target(b *balancer.Balancer, ci commandInfo) readPref {
+	return target(b, ci, s.preference(), s.readsLeader())
+}
+
+// fences returns true if a FENCE must precede the command for the
+// connection to see its own writes
+func (s *session) fences(b *balancer.Balancer, ci commandInfo) bool {
+	return fences(ci, s.target(b, ci), s.readsLeader())
+}
+
+// inTx returns true while a MULTI block is open
+func (s *session) inTx() bool { return s.txOpen }
+
+// release ends the transaction and returns the pinned connection to its pool
+func (s *session) release() {
+	if s.tx != nil {
+		s.tx.Close()
+	}
+
+	s.txOpen, s.txAbort = false, false
+	s.tx, s.txShard, s.txAddr = nil, nil, ""
+}
+
+// multi opens a transaction, the leader connection is pinned once the
+// first command shows which shard it runs on
+func (sb *SummitDBBalancer) multi(conn redcon.Conn) {
+	getSession(conn).txOpen = true
+	conn.WriteString("OK")
+}
+
+// txBegin pins a leader connection of the shard and starts the transaction
+// on it, whatever the routing. The MULTI follows leader redirects like any
+// other write when no leader is known.
+func (sb *SummitDBBalancer) txBegin(conn redcon.Conn, s *session, sh *shard) bool {
+	b := sh.balancer
+
+	backend := b.KnownLeader()
+	if backend == nil {
+		backend = b.Next()
+	}
+
+	for hops := 0; ; hops++ {
+		client := backend.Pool.Get()
+
+		reply, err := backendReply(doWithDeadline(client, "MULTI"))
+		if err != nil {
+			client.Close()
+			conn.WriteError("ERR " + err.Error())
+			return false
+		}
+
+		if addr, ok := redirectAddr(reply); ok && hops < maxRedirects {
+			client.Close()
+			backend = b.Redirect(addr)
+			continue
+		}
+
+		if _, ok := reply.(redis.Error); ok {
+			client.Close()
+			writeReply(conn, reply)
+			return false
+		}
+
+		log.Debug("Transaction started", "remote", conn.RemoteAddr(), "shard", sh.name, "node", backend.Addr)
+
+		s.tx, s.txShard, s.txAddr = client, sh, backend.Addr
+		return true
+	}
+}
+
+// txCommand handles a command received while a MULTI block is open
+func (sb *SummitDBBalancer) txCommand(conn redcon.Conn, cmd redcon.Command, ci commandInfo) {
+	switch {
+	case ci.name == "multi":
+		conn.WriteError("ERR MULTI calls can not be nested")
+	case ci.name == "quit":
+		getSession(conn).release()
+		conn.WriteString("OK")
+		conn.Close()
+	case ci.name == "exec", ci.name == "discard":
+		sb.txDo(conn, cmd, ci)
+	case ci.leader(), ci.class == classRead:
+		sb.txQueue(conn, cmd, ci)
+	default:
+		// like a queued command the backend rejects, EXEC aborts
+		getSession(conn).txAbort = true
+
+		switch ci.class {
+		case classUnknown, classUnsupported:
+			conn.WriteError(commandError(ci))
+		default:
+			conn.WriteError(fmt.Sprintf("ERR command '%s' not allowed in MULTI", ci.name))
+		}
+	}
+}
+
+// txQueue queues a command on the shard of the transaction, commands
+// without keys or over the whole keyspace run on that shard only
+func (sb *SummitDBBalancer) txQueue(conn redcon.Conn, cmd redcon.Command, ci commandInfo) {
+	s := getSession(conn)
+
+	// the block is discarded on EXEC, later commands are not sent
+	if s.txAbort {
+		conn.WriteString("QUEUED")
+		return
+	}
+
+	sh := s.txShard
+	switch {
+	case ci.indexRead && !sb.shards().single():
+		s.txAbort = true
+		writeReply(conn, errShardedIndex)
+		return
+	case ci.fanOut || len(ci.keys(cmd.Args)) == 0:
+		if sh == nil {
+			sh = sb.shards().shards[0]
+		}
+	default:
+		sh = sb.shards().forCommand(ci, cmd.Args)
+	}
+
+	if sh == nil || (s.txShard != nil && sh != s.txShard) {
+		s.txAbort = true
+		writeReply(conn, errCrossShard)
+		return
+	}
+
+	if s.tx == nil && !sb.txBegin(conn, s, sh) {
+		s.txAbort = true
+		return
+	}
+
+	sb.txDo(conn, cmd, ci)
+}
+
+// txDo sends a command to the pinned transaction connection. EXEC and
+// DISCARD end the transaction and release the connection.
+func (sb *SummitDBBalancer) txDo(conn redcon.Conn, cmd redcon.Command, ci commandInfo) {
+	s := getSession(conn)
+	if !s.inTx() {
+		conn.WriteError(fmt.Sprintf("ERR %s without MULTI", strings.ToUpper(ci.name)))
+		return
+	}
+
+	if s.tx == nil || s.txAbort {
+		sb.txEnd(conn, s, ci)
+		return
+	}
+
+	start := time.Now()
+	reply, err := backendReply(doWithDeadline(s.tx, string(cmd.Args[0]), commandArgs(cmd)...))
+	s.routed(s.txAddr, time.Since(start))
+
+	if err != nil || ci.name == "exec" || ci.name == "discard" {
+		s.release()
+	}
+
+	if err == nil && ci.name == "exec" {
+		s.wrote()
+	}
+
+	if err != nil {
+		conn.WriteError("ERR " + err.Error())
+		return
+	}
+
+	writeReply(conn, reply)
+}
+
+// txEnd answers EXEC and DISCARD of a transaction that queued nothing or
+// was aborted, the backend side is discarded
+func (sb *SummitDBBalancer) txEnd(conn redcon.Conn, s *session, ci commandInfo) {
+	aborted := s.txAbort
+	if s.tx != nil {
+		doWithDeadline(s.tx, "DISCARD")
+	}
+	s.release()
+
+	switch {
+	case ci.name == "discard":
+		conn.WriteString("OK")
+	case aborted:
+		conn.WriteError("EXECABORT Transaction discarded because of previous errors.")
+	default:
+		conn.WriteArray(0)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"github.com/gomodule/redigo/redis"
+	"github.com/masomo/summitdb-balancer/summitdbtest"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("transactions", func() {
+	var clusters []*summitdbtest.Cluster
+	var p *proxy
+	var client redis.Conn
+
+	BeforeEach(func() {
+		clusters = nil
+		for i := 0; i < 2; i++ {
+			cluster, err := summitdbtest.NewCluster(2)
+			Expect(err).NotTo(HaveOccurred())
+			clusters = append(clusters, cluster)
+		}
+
+		// a single idle connection shows whether the pinned one came back
+		// clean
+		p = startClusterProxy(&Config{LoadBalancer: loadBalancer{MaxIdle: 1, Routing: true}}, clusters...)
+
+		var err error
+		client, err = p.dial()
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		client.Close()
+		p.close()
+		for _, cluster := range clusters {
+			Expect(cluster.Close()).To(Succeed())
+		}
+	})
+
+	It("should queue commands on the leader until EXEC", func() {
+		key := p.keyOn(1, "tx")
+		clusters[1].Nodes[0].ResetCounts()
+
+		Expect(client.Do("MULTI")).To(Equal("OK"))
+		Expect(client.Do("SET", key, "1")).To(Equal("QUEUED"))
+		Expect(client.Do("GET", key)).To(Equal("QUEUED"))
+		Expect(redis.Values(client.Do("EXEC"))).To(Equal([]interface{}{"OK", []byte("1")}))
+
+		Expect(clusters[1].Nodes[0].Count("multi")).To(Equal(1))
+		Expect(clusters[1].Nodes[0].Count("get")).To(Equal(1))
+		Expect(clusters[0].Nodes[0].Count("multi")).To(BeZero())
+	})
+
+	It("should relay rejected commands and abort on EXEC", func() {
+		Expect(client.Do("MULTI")).To(Equal("OK"))
+
+		_, err := client.Do("SET", "a")
+		Expect(err).To(MatchError("ERR wrong number of arguments for 'set' command"))
+
+		_, err = client.Do("EXEC")
+		Expect(err).To(MatchError("EXECABORT Transaction discarded because of previous errors."))
+
+		_, err = client.Do("EXEC")
+		Expect(err).To(MatchError("ERR EXEC without MULTI"))
+	})
+
+	It("should abort transactions spanning shards", func() {
+		Expect(client.Do("MULTI")).To(Equal("OK"))
+		Expect(client.Do("SET", p.keyOn(0, "tx"), "1")).To(Equal("QUEUED"))
+
+		_, err := client.Do("SET", p.keyOn(1, "tx"), "1")
+		Expect(err).To(MatchError(string(errCrossShard)))
+
+		_, err = client.Do("EXEC")
+		Expect(err).To(MatchError("EXECABORT Transaction discarded because of previous errors."))
+		Expect(client.Do("GET", p.keyOn(0, "tx"))).To(BeNil())
+	})
+
+	It("should abort on EXEC after unknown commands", func() {
+		key := p.keyOn(0, "tx")
+
+		Expect(client.Do("MULTI")).To(Equal("OK"))
+		_, err := client.Do("BOGUS", key)
+		Expect(err).To(MatchError(commandError(lookupCommand("bogus"))))
+		Expect(client.Do("SET", key, "1")).To(Equal("QUEUED"))
+
+		_, err = client.Do("EXEC")
+		Expect(err).To(MatchError("EXECABORT Transaction discarded because of previous errors."))
+		Expect(client.Do("GET", key)).To(BeNil())
+	})
+
+	It("should pin the leader without routing", func() {
+		client.Close()
+		p.close()
+
+		p = startClusterProxy(&Config{LoadBalancer: loadBalancer{MaxIdle: 1}}, clusters...)
+		var err error
+		client, err = p.dial()
+		Expect(err).NotTo(HaveOccurred())
+
+		key := p.keyOn(0, "tx")
+		for i := 0; i < 4; i++ {
+			Expect(client.Do("MULTI")).To(Equal("OK"))
+			Expect(client.Do("SET", key, i)).To(Equal("QUEUED"))
+			Expect(redis.Values(client.Do("EXEC"))).To(Equal([]interface{}{"OK"}))
+		}
+
+		Expect(clusters[0].Nodes[0].Count("multi")).To(Equal(4))
+		Expect(clusters[0].Nodes[1].Count("multi")).To(BeZero())
+	})
+
+	It("should discard and reject commands not allowed in MULTI", func() {
+		key := p.keyOn(0, "tx")
+
+		Expect(client.Do("MULTI")).To(Equal("OK"))
+		_, err := client.Do("MULTI")
+		Expect(err).To(MatchError("ERR MULTI calls can not be nested"))
+		_, err = client.Do("SUBSCRIBE", "news")
+		Expect(err).To(MatchError("ERR command 'subscribe' not allowed in MULTI"))
+
+		Expect(client.Do("SET", key, "1")).To(Equal("QUEUED"))
+		Expect(client.Do("DISCARD")).To(Equal("OK"))
+		Expect(client.Do("GET", key)).To(BeNil())
+	})
+
+	It("should release the pinned connection when the client goes away", func() {
+		key := p.keyOn(0, "tx")
+
+		Expect(client.Do("MULTI")).To(Equal("OK"))
+		Expect(client.Do("SET", key, "1")).To(Equal("QUEUED"))
+		client.Close()
+
+		var err error
+		client, err = p.dial()
+		Expect(err).NotTo(HaveOccurred())
+
+		// the transaction was discarded before the connection was reused
+		Eventually(func() interface{} {
+			reply, _ := client.Do("SET", p.keyOn(0, "other"), "2")
+			return reply
+		}).Should(Equal("OK"))
+		Expect(client.Do("GET", key)).To(BeNil())
+	})
+})
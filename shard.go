@@ -0,0 +1,286 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/masomo/summitdb-balancer/balancer"
+	"github.com/semihalev/log"
+	"github.com/tidwall/redcon"
+)
+
+// errCrossShard is replied to commands with keys on more than one shard
+const errCrossShard = redis.Error("CROSSSLOT Keys in request don't hash to the same shard")
+
+// errShardedIndex is replied to index reads while keys are spread over
+// shards
+const errShardedIndex = redis.Error("ERR ITER, RITER and RECT are not supported with more than one shard")
+
+// defaultShard names the shard of the top level upstream list
+const defaultShard = "default"
+
+// shard is an independent SummitDB cluster
+type shard struct {
+	name     string
+	balancer *balancer.Balancer
+}
+
+// shardSet maps keys to shards. Commands without keys go to the first
+// shard, except the fanOut ones.
+type shardSet struct {
+	shards []*shard
+	ring   *balancer.Ring
+}
+
+func newShardSet(shards []*shard) *shardSet {
+	names := make([]string, len(shards))
+	for i, sh := range shards {
+		names[i] = sh.name
+	}
+
+	return &shardSet{shards: shards, ring: balancer.NewRing(names)}
+}
+
+// single returns true if there is nothing to shard
+func (set *shardSet) single() bool { return len(set.shards) == 1 }
+
+// index returns the index of the shard owning the key
+func (set *shardSet) index(key []byte) int {
+	if set.single() {
+		return 0
+	}
+	return set.ring.Get(key)
+}
+
+// forCommand returns the shard owning all keys of the command, nil when
+// they span shards or the command reads an index of all shards
+func (set *shardSet) forCommand(ci commandInfo, args [][]byte) *shard {
+	if set.single() {
+		return set.shards[0]
+	}
+
+	keys := ci.keys(args)
+	if len(keys) == 0 {
+		if ci.indexRead {
+			return nil
+		}
+		return set.shards[0]
+	}
+
+	i := set.index(keys[0])
+	for _, key := range keys[1:] {
+		if set.index(key) != i {
+			return nil
+		}
+	}
+	return set.shards[i]
+}
+
+// balancers returns the balancers of all shards
+func (set *shardSet) balancers() []*balancer.Balancer {
+	balancers := make([]*balancer.Balancer, len(set.shards))
+	for i, sh := range set.shards {
+		balancers[i] = sh.balancer
+	}
+	return balancers
+}
+
+// close stops the balancers of all shards
+func (set *shardSet) close() {
+	for _, sh := range set.shards {
+		sh.balancer.Close()
+	}
+}
+
+// shards returns the current shard set
+func (sb *SummitDBBalancer) shards() *shardSet { return sb.shardSet.Load().(*shardSet) }
+
+// updateShards applies the config to the shard set, shards are matched
+// by name, removed ones are closed
+func (sb *SummitDBBalancer) updateShards(c *Config) {
+	current := make(map[string]*shard)
+	if set, ok := sb.shardSet.Load().(*shardSet); ok {
+		for _, sh := range set.shards {
+			current[sh.name] = sh
+		}
+	}
+
+	routing, mode := c.LoadBalancer.Routing, modeFromString(c.LoadBalancer.Mode)
+
+	var shards []*shard
+	for _, sc := range c.LoadBalancer.shards() {
+		opts := backendOptions(c, sc.Upstream)
+
+		sh, ok := current[sc.Name]
+		if ok {
+			sh.balancer.Update(opts, routing, mode)
+		} else {
+			if len(current) > 0 {
+				log.Info("Shard added", "shard", sc.Name)
+			}
+			sh = &shard{name: sc.Name, balancer: balancer.New(opts, routing, mode)}
+		}
+		sh.balancer.Discover(c.LoadBalancer.getDiscoveryInterval())
+
+		delete(current, sc.Name)
+		shards = append(shards, sh)
+	}
+
+	sb.shardSet.Store(newShardSet(shards))
+
+	for name, sh := range current {
+		log.Info("Shard removed", "shard", name)
+		go sh.balancer.Close()
+	}
+}
+
+// dispatch sends the command to the shard owning its keys
+func (sb *SummitDBBalancer) dispatch(s *session, ci commandInfo, cmd redcon.Command) (interface{}, error) {
+	set := sb.shards()
+	name, args := string(cmd.Args[0]), commandArgs(cmd)
+
+	if !set.single() {
+		switch {
+		case ci.fanOut:
+			return sb.fanOut(s, set, ci, name, args)
+		case ci.indexRead:
+			return errShardedIndex, nil
+		case ci.name == "mget":
+			reply, err := sb.mget(s, cmd.Args[1:])
+			if rerr, ok := err.(redis.Error); ok {
+				return rerr, nil
+			}
+			return reply, err
+		}
+	}
+
+	sh := set.forCommand(ci, cmd.Args)
+	if sh == nil {
+		return errCrossShard, nil
+	}
+
+	return sb.do(s, sh.balancer, ci, name, args)
+}
+
+// fanOut runs the command on every shard and merges the replies, arrays
+// are joined, integers summed. It goes on after a shard failed, as writes
+// are applied by the others anyway, and replies with the first error and
+// the names of the failed shards.
+func (sb *SummitDBBalancer) fanOut(s *session, set *shardSet, ci commandInfo, name string, args []interface{}) (interface{}, error) {
+	var merged interface{}
+	var failure string
+	var failed []string
+	for _, sh := range set.shards {
+		reply, err := sb.do(s, sh.balancer, ci, name, args)
+		if err != nil {
+			reply = redis.Error("ERR " + err.Error())
+		}
+
+		switch val := reply.(type) {
+		case redis.Error:
+			if failure == "" {
+				failure = string(val)
+			}
+			failed = append(failed, sh.name)
+		case []interface{}:
+			prev, _ := merged.([]interface{})
+			merged = append(prev, val...)
+		case int64:
+			prev, _ := merged.(int64)
+			merged = prev + val
+		default:
+			merged = val
+		}
+	}
+
+	if len(failed) > 0 {
+		log.Warn("Command failed on shards", "command", name, "shards", strings.Join(failed, ","), "error", failure)
+		return redis.Error(fmt.Sprintf("%s (failed on shards %s)", failure, strings.Join(failed, ", "))), nil
+	}
+	return merged, nil
+}
+
+// mget gets the keys from their shards, replies are in the order of keys.
+// Error replies are returned as redis.Error.
+func (sb *SummitDBBalancer) mget(s *session, keys [][]byte) ([]interface{}, error) {
+	set := sb.shards()
+	ci := lookupCommand("mget")
+
+	groups := make(map[int][]int)
+	for i, key := range keys {
+		idx := set.index(key)
+		groups[idx] = append(groups[idx], i)
+	}
+
+	replies := make([]interface{}, len(keys))
+	for idx, positions := range groups {
+		args := make([]interface{}, len(positions))
+		for j, pos := range positions {
+			args[j] = keys[pos]
+		}
+
+		reply, err := sb.do(s, set.shards[idx].balancer, ci, "MGET", args)
+		if err != nil {
+			return nil, err
+		}
+
+		vals, ok := reply.([]interface{})
+		if !ok || len(vals) != len(positions) {
+			return nil, invalidReply(reply)
+		}
+
+		for j, pos := range positions {
+			replies[pos] = vals[j]
+		}
+	}
+
+	return replies, nil
+}
+
+// mset sets the key value pairs on their shards, it is only atomic within
+// a shard. Error replies are returned as redis.Error.
+func (sb *SummitDBBalancer) mset(s *session, pairs [][]byte) error {
+	set := sb.shards()
+	ci := lookupCommand("mset")
+
+	groups := make(map[int][]interface{})
+	for i := 0; i+1 < len(pairs); i += 2 {
+		idx := set.index(pairs[i])
+		groups[idx] = append(groups[idx], pairs[i], pairs[i+1])
+	}
+
+	for idx, args := range groups {
+		reply, err := sb.do(s, set.shards[idx].balancer, ci, "MSET", args)
+		if err != nil {
+			return err
+		}
+
+		if _, ok := reply.(string); !ok {
+			return invalidReply(reply)
+		}
+	}
+
+	return nil
+}
+
+// invalidReply returns the error for an unexpected backend reply, error
+// replies as they are
+func invalidReply(reply interface{}) error {
+	if err, ok := reply.(redis.Error); ok {
+		return err
+	}
+
+	log.Debug("Invalid response from backend", "response-type", fmt.Sprintf("%T", reply))
+	return errors.New("invalid response")
+}
+
+// clientError returns the error text sent to the client, error replies of
+// the backend are relayed as they are
+func clientError(err error) string {
+	if rerr, ok := err.(redis.Error); ok {
+		return string(rerr)
+	}
+	return "ERR " + err.Error()
+}
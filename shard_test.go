@@ -0,0 +1,162 @@
+package main
+
+import (
+	"github.com/gomodule/redigo/redis"
+	"github.com/masomo/summitdb-balancer/summitdbtest"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("shards", func() {
+	var clusters []*summitdbtest.Cluster
+	var p *proxy
+	var client redis.Conn
+
+	var value = func(shard int, key string) string {
+		val, _ := clusters[shard].Nodes[0].Get(key)
+		return val
+	}
+
+	var receive = func() (interface{}, error) {
+		reply, err := client.Receive()
+		if rerr, ok := err.(redis.Error); ok {
+			return rerr, nil
+		}
+		return reply, err
+	}
+
+	BeforeEach(func() {
+		clusters = make([]*summitdbtest.Cluster, 2)
+		for i := range clusters {
+			var err error
+			clusters[i], err = summitdbtest.NewCluster(1)
+			Expect(err).NotTo(HaveOccurred())
+		}
+
+		p = startClusterProxy(&Config{LoadBalancer: loadBalancer{MaxIdle: 4, Routing: true}}, clusters...)
+
+		var err error
+		client, err = p.dial()
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		client.Close()
+		p.close()
+		for _, cluster := range clusters {
+			Expect(cluster.Close()).To(Succeed())
+		}
+	})
+
+	It("should place keys on the shard of the ring", func() {
+		a, b := p.keyOn(0, "a"), p.keyOn(1, "b")
+		Expect(client.Do("SET", a, "1")).To(Equal("OK"))
+		Expect(client.Do("SET", b, "2")).To(Equal("OK"))
+
+		Expect(value(0, a)).To(Equal("1"))
+		Expect(value(1, b)).To(Equal("2"))
+		Expect(value(0, b)).To(BeEmpty())
+
+		// keys with the tag of a stay with it
+		Expect(client.Do("MSET", "{"+a+"}.x", "3", "{"+a+"}.y", "4")).To(Equal("OK"))
+		Expect(value(0, "{"+a+"}.y")).To(Equal("4"))
+
+		_, err := client.Do("MSET", a, "1", b, "2")
+		Expect(err).To(MatchError(string(errCrossShard)))
+	})
+
+	It("should split MGET and reassemble the replies in order", func() {
+		a0, a1, b0 := p.keyOn(0, "a"), p.keyOn(0, "c"), p.keyOn(1, "b")
+		Expect(client.Do("SET", a0, "1")).To(Equal("OK"))
+		Expect(client.Do("SET", a1, "2")).To(Equal("OK"))
+		Expect(client.Do("SET", b0, "3")).To(Equal("OK"))
+
+		Expect(client.Do("MGET", b0, a0, "missing", a1)).To(Equal([]interface{}{
+			[]byte("3"), []byte("1"), nil, []byte("2"),
+		}))
+		Expect(clusters[0].Nodes[0].Count("mget")).To(Equal(1))
+		Expect(clusters[1].Nodes[0].Count("mget")).To(Equal(1))
+	})
+
+	It("should split pipelined GETs and SETs", func() {
+		keys := []string{p.keyOn(1, "b"), p.keyOn(0, "a"), p.keyOn(1, "c")}
+
+		for i, key := range keys {
+			Expect(client.Send("SET", key, i)).To(Succeed())
+		}
+		Expect(client.Flush()).To(Succeed())
+		for range keys {
+			Expect(receive()).To(Equal("OK"))
+		}
+		Expect(clusters[0].Nodes[0].Count("mset")).To(Equal(1))
+		Expect(clusters[1].Nodes[0].Count("mset")).To(Equal(1))
+		Expect(value(1, keys[2])).To(Equal("2"))
+
+		for _, key := range append(keys, "missing") {
+			Expect(client.Send("GET", key)).To(Succeed())
+		}
+		Expect(client.Flush()).To(Succeed())
+		for i := range keys {
+			Expect(redis.String(receive())).To(Equal(string(rune('0' + i))))
+		}
+		Expect(receive()).To(BeNil())
+	})
+
+	It("should relay shard errors without another prefix", func() {
+		a, b := p.keyOn(0, "a"), p.keyOn(1, "b")
+		clusters[1].Nodes[0].SetFault("mget", summitdbtest.Fault{Error: "ERR boom"})
+
+		_, err := client.Do("MGET", a, b)
+		Expect(err).To(MatchError("ERR boom"))
+
+		Expect(client.Send("GET", a)).To(Succeed())
+		Expect(client.Send("GET", b)).To(Succeed())
+		Expect(client.Flush()).To(Succeed())
+		Expect(receive()).To(Equal(redis.Error("ERR boom")))
+		Expect(receive()).To(Equal(redis.Error("ERR boom")))
+
+		clusters[1].Nodes[0].SetFault("mget", summitdbtest.Fault{Drop: true})
+		_, err = client.Do("MGET", a, b)
+		Expect(err).To(MatchError(HavePrefix("ERR ")))
+		Expect(err).NotTo(MatchError(HavePrefix("ERR ERR")))
+	})
+
+	It("should run fanned out commands on every shard", func() {
+		Expect(client.Do("SET", p.keyOn(0, "a"), "1")).To(Equal("OK"))
+		Expect(client.Do("SET", p.keyOn(1, "b"), "2")).To(Equal("OK"))
+		Expect(client.Do("SET", p.keyOn(1, "c"), "3")).To(Equal("OK"))
+
+		Expect(client.Do("DBSIZE")).To(BeEquivalentTo(3))
+
+		clusters[0].Nodes[0].SetFault("flushdb", summitdbtest.Fault{Error: "ERR boom"})
+
+		_, err := client.Do("FLUSHDB")
+		Expect(err).To(MatchError("ERR boom (failed on shards shard0)"))
+
+		// the other shard applied it anyway
+		Expect(clusters[1].Nodes[0].Count("flushdb")).To(Equal(1))
+		Expect(client.Do("DBSIZE")).To(BeEquivalentTo(1))
+
+		clusters[1].Nodes[0].SetFault("dbsize", summitdbtest.Fault{Drop: true})
+		_, err = client.Do("DBSIZE")
+		Expect(err).To(MatchError(HaveSuffix("(failed on shards shard1)")))
+		Expect(err).NotTo(MatchError(HavePrefix("ERR ERR")))
+	})
+
+	It("should reject index reads over all shards", func() {
+		for _, cmd := range [][]interface{}{{"ITER", "idx"}, {"RITER", "idx"}, {"RECT", "idx", "[1]", "[2]"}} {
+			_, err := client.Do(cmd[0].(string), cmd[1:]...)
+			Expect(err).To(MatchError(string(errShardedIndex)))
+		}
+
+		Expect(client.Send("GET", "a")).To(Succeed())
+		Expect(client.Send("ITER", "idx")).To(Succeed())
+		Expect(client.Flush()).To(Succeed())
+		Expect(receive()).To(BeNil())
+		Expect(receive()).To(Equal(errShardedIndex))
+
+		for _, cluster := range clusters {
+			Expect(cluster.Nodes[0].Count("iter")).To(BeZero())
+		}
+	})
+})
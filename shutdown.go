@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/tidwall/redcon"
+)
+
+// defaultShutdownTimeout bounds the wait for in-flight commands on shutdown
+const defaultShutdownTimeout = 10 * time.Second
+
+// inflight tracks the client command batches being served
+var inflight = newGate()
+
+// gate counts command batches in flight and turns new ones away once
+// draining started
+type gate struct {
+	mu       sync.Mutex
+	active   int
+	draining bool
+	idle     chan struct{}
+}
+
+func newGate() *gate { return &gate{idle: make(chan struct{})} }
+
+// enter starts a batch, returns false while draining
+func (g *gate) enter() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.draining {
+		return false
+	}
+	g.active++
+	return true
+}
+
+// leave ends a batch
+func (g *gate) leave() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.active--
+	if g.draining && g.active == 0 {
+		close(g.idle)
+	}
+}
+
+// drain turns new batches away and waits for the active ones, returns
+// false if they did not finish within the timeout
+func (g *gate) drain(timeout time.Duration) bool {
+	g.mu.Lock()
+	if !g.draining {
+		g.draining = true
+		if g.active == 0 {
+			close(g.idle)
+		}
+	}
+	g.mu.Unlock()
+
+	select {
+	case <-g.idle:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// enterBatch starts a batch for the first command read from the client,
+// the rest of its pipeline belongs to the same batch. It replies with an
+// error and closes the connection when shutting down.
+func enterBatch(conn redcon.Conn, s *session) bool {
+	if s.busy {
+		return true
+	}
+
+	if !inflight.enter() {
+		conn.WriteError("ERR balancer is shutting down")
+		conn.Close()
+		return false
+	}
+
+	s.busy = true
+	return true
+}
+
+// leaveBatch ends the batch once its pipeline is done
+func leaveBatch(conn redcon.Conn, s *session) {
+	if s.busy && len(conn.PeekPipeline()) == 0 {
+		s.busy = false
+		inflight.leave()
+	}
+}
+
+// drainListener stops accepting connections on Close, but holds the redcon
+// accept loop, which closes all client connections as soon as it returns,
+// until released
+type drainListener struct {
+	net.Listener
+	release chan struct{}
+}
+
+func newDrainListener(ln net.Listener) *drainListener {
+	return &drainListener{Listener: ln, release: make(chan struct{})}
+}
+
+func (l *drainListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if errors.Is(err, net.ErrClosed) {
+		<-l.release
+	}
+	return conn, err
+}
+
+// Release lets the accept loop return
+func (l *drainListener) Release() { close(l.release) }
+
+// shutdown stops accepting clients, waits for in-flight commands, then
+// closes all client connections, monitors, subscribers and backend pools.
+// It returns false if commands were still running at the timeout.
+func (sb *SummitDBBalancer) shutdown(ln *drainListener, served <-chan struct{}, timeout time.Duration) bool {
+	ln.Close()
+
+	drained := inflight.drain(timeout)
+
+	monitors.closeAll()
+	subscriptions.closeAll()
+
+	ln.Release()
+	<-served
+
+	sb.shards().close()
+
+	return drained
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"net"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/masomo/summitdb-balancer/summitdbtest"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/tidwall/redcon"
+)
+
+var _ = Describe("shutdown", func() {
+	It("should turn batches away once draining", func() {
+		g := newGate()
+		Expect(g.enter()).To(BeTrue())
+
+		drained := make(chan bool)
+		go func() { drained <- g.drain(time.Second) }()
+
+		Eventually(func() bool {
+			g.mu.Lock()
+			defer g.mu.Unlock()
+			return g.draining
+		}).Should(BeTrue())
+		Expect(g.enter()).To(BeFalse())
+		Consistently(drained).ShouldNot(Receive())
+
+		g.leave()
+		Eventually(drained).Should(Receive(BeTrue()))
+	})
+
+	It("should give up draining at the timeout", func() {
+		g := newGate()
+		Expect(g.enter()).To(BeTrue())
+		Expect(g.drain(50 * time.Millisecond)).To(BeFalse())
+	})
+
+	Context("through the proxy", func() {
+		var cluster *summitdbtest.Cluster
+		var sb *SummitDBBalancer
+		var dl *drainListener
+		var served chan struct{}
+		var addr string
+
+		BeforeEach(func() {
+			inflight = newGate()
+
+			var err error
+			cluster, err = summitdbtest.NewCluster(2)
+			Expect(err).NotTo(HaveOccurred())
+
+			// the proxy only provides a balancer waiting for its backends
+			p := startClusterProxy(&Config{LoadBalancer: loadBalancer{MaxIdle: 4, Routing: true}}, cluster)
+			p.server.Close()
+			sb = p.sb
+
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).NotTo(HaveOccurred())
+			addr = ln.Addr().String()
+
+			dl = newDrainListener(ln)
+			served = make(chan struct{})
+			go func() {
+				defer close(served)
+				redcon.NewServer(addr, sb.onRedisCommand, sb.onRedisConnect, sb.onRedisClose).Serve(dl)
+			}()
+
+			// batched GETs are sent as MGET
+			for _, node := range cluster.Nodes {
+				node.SetFault("get", summitdbtest.Fault{Latency: 300 * time.Millisecond})
+				node.SetFault("mget", summitdbtest.Fault{Latency: 300 * time.Millisecond})
+			}
+		})
+
+		AfterEach(func() {
+			Expect(cluster.Close()).To(Succeed())
+			inflight = newGate()
+		})
+
+		It("should finish in-flight commands and turn new ones away", func() {
+			busy, err := redis.Dial("tcp", addr)
+			Expect(err).NotTo(HaveOccurred())
+			defer busy.Close()
+
+			idle, err := redis.Dial("tcp", addr)
+			Expect(err).NotTo(HaveOccurred())
+			defer idle.Close()
+			Expect(idle.Do("PING")).To(Equal("PONG"))
+
+			Expect(busy.Send("GET", "a")).To(Succeed())
+			Expect(busy.Send("GET", "b")).To(Succeed())
+			Expect(busy.Flush()).To(Succeed())
+			time.Sleep(100 * time.Millisecond)
+
+			drained := make(chan bool)
+			go func() { drained <- sb.shutdown(dl, served, 2*time.Second) }()
+
+			Eventually(func() error {
+				conn, err := net.Dial("tcp", addr)
+				if err == nil {
+					conn.Close()
+				}
+				return err
+			}).Should(HaveOccurred())
+
+			_, err = idle.Do("PING")
+			Expect(err).To(MatchError("ERR balancer is shutting down"))
+
+			// the whole pipeline of the busy client is served
+			Expect(busy.Receive()).To(BeNil())
+			Expect(busy.Receive()).To(BeNil())
+
+			Eventually(drained, time.Second).Should(Receive(BeTrue()))
+			Expect(served).To(BeClosed())
+
+			_, err = busy.Do("PING")
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("should report commands still running at the timeout", func() {
+			client, err := redis.Dial("tcp", addr)
+			Expect(err).NotTo(HaveOccurred())
+			defer client.Close()
+
+			Expect(client.Send("GET", "a")).To(Succeed())
+			Expect(client.Flush()).To(Succeed())
+			time.Sleep(100 * time.Millisecond)
+
+			Expect(sb.shutdown(dl, served, 50*time.Millisecond)).To(BeFalse())
+
+			_, err = client.Receive()
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
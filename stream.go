@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/masomo/summitdb-balancer/balancer"
+	metrics "github.com/rcrowley/go-metrics"
+	"github.com/semihalev/log"
+	"github.com/tidwall/redcon"
+)
+
+// streamChunk is how much of a streamed reply is buffered before it is
+// flushed to the client
+const streamChunk = 64 * 1024
+
+// errProtocol is returned for backend replies that are not valid RESP
+var errProtocol = errors.New("invalid reply from backend")
+
+// forwards returns the shard of a command that is forwarded as received,
+// its reply relayed to the client without decoding, nil when it takes the
+// buffered path. The commands flagged in the command table are streamed,
+// other reads with a stream threshold, every command with passthrough.
+func (sb *SummitDBBalancer) forwards(ci commandInfo, cmd redcon.Command) *shard {
+	lb := getConfig().LoadBalancer
+
+	switch {
+	case ci.class == classRead && (ci.stream || lb.StreamThreshold > 0):
+	case lb.Passthrough && (ci.class == classRead || ci.leader()):
+	default:
+		return nil
+	}
+
+	set := sb.shards()
+	if ci.fanOut && !set.single() {
+		return nil
+	}
+	return set.forCommand(ci, cmd.Args)
+}
+
+// forward sends the raw command to a backend of the shard and relays the
+// reply frames to the client. Replies are flushed to the client every
+// chunk, or once the stream threshold is crossed for reads not flagged in
+// the command table, so they never sit in memory whole. Failures before
+// anything was flushed are retried like buffered commands, later ones close
+// the client connection.
+func (sb *SummitDBBalancer) forward(conn redcon.Conn, s *session, sh *shard, ci commandInfo, cmd redcon.Command) {
+	b := sh.balancer
+	backend := s.target(b, ci).pick(b)
+
+	if s.fences(b, ci) {
+		var reply interface{}
+		var err error
+		reply, backend, err = sb.doFollow(s, b, backend, "FENCE", []interface{}{fenceToken})
+		if err != nil {
+			conn.WriteError("ERR " + err.Error())
+			return
+		}
+		if _, ok := reply.(redis.Error); ok {
+			writeReply(conn, reply)
+			return
+		}
+	}
+
+	limit := streamChunk
+	if threshold := getConfig().LoadBalancer.StreamThreshold; threshold > 0 && ci.class == classRead && !ci.stream {
+		limit = threshold
+	}
+
+	r := &relay{w: redcon.BaseWriter(conn), limit: limit}
+
+	var tried []string
+	for attempt := 0; ; attempt++ {
+		err := sb.relayBackend(s, b, backend, cmd, r)
+		if err == nil {
+			if ci.class == classWrite {
+				s.wrote()
+			}
+			return
+		}
+
+		if r.flushed {
+			log.Warn("Relayed reply failed", "command", ci.name, "node", backend.Addr, "error", err.Error())
+			conn.Close()
+			return
+		}
+		r.discard()
+
+		b.MarkFailed(backend.Addr)
+		tried = append(tried, backend.Addr)
+
+		next := retryBackend(b, ci, attempt, tried, err)
+		if next == nil {
+			conn.WriteError("ERR " + err.Error())
+			return
+		}
+
+		log.Debug("Retrying command", "command", ci.name, "failed", backend.Addr, "node", next.Addr, "error", err.Error())
+		markRetry(backend, ci)
+
+		backend = next
+	}
+}
+
+// relayBackend relays the reply of the backend to the client, following
+// leader redirects from followers for at most maxRedirects hops
+func (sb *SummitDBBalancer) relayBackend(s *session, b *balancer.Balancer, backend *balancer.Backend, cmd redcon.Command, r *relay) error {
+	for hops := 0; ; hops++ {
+		addr, err := sb.relayOnce(s, b, backend, cmd, r, hops < maxRedirects)
+		if err != nil || addr == "" {
+			return err
+		}
+
+		log.Debug("Backend redirected command", "node", backend.Addr, "leader", addr, "command", qcmdlower(cmd.Args[0]))
+
+		redirectMetric := metrics.GetOrRegisterMeter(fmt.Sprintf("%s.redirect", metricPrefix), nil)
+		redirectMetric.Mark(1)
+
+		backend = b.Redirect(addr)
+	}
+}
+
+// relayOnce forwards the command on a raw connection of the backend and
+// relays its reply. A redirect is not relayed but returned when follow is
+// set.
+func (sb *SummitDBBalancer) relayOnce(s *session, b *balancer.Balancer, backend *balancer.Backend, cmd redcon.Command, r *relay, follow bool) (string, error) {
+	markBackend(backend, 1)
+
+	start := time.Now()
+	addr, err := relayCommand(backend.Raw, cmd.Raw, r, follow)
+	latency := time.Since(start)
+
+	// the client going away is no failure of the backend
+	b.Observe(backend.Addr, latency, err != nil && err != r.err)
+	s.routed(backend.Addr, latency)
+
+	return addr, err
+}
+
+// relayCommand writes the raw command to a connection of the pool and
+// copies the reply frames to the relay, each read must make progress
+// within the command timeout
+func relayCommand(pool *balancer.RawPool, raw []byte, r *relay, follow bool) (string, error) {
+	c, err := pool.Get()
+	if err != nil {
+		return "", err
+	}
+	defer c.Close()
+
+	timeout := getConfig().LoadBalancer.CommandTimeout
+	r.deadline = func() {
+		if timeout > 0 {
+			c.SetDeadline(time.Now().Add(timeout))
+		}
+	}
+	r.deadline()
+
+	if _, err = c.Writer().Write(raw); err == nil {
+		err = c.Writer().Flush()
+	}
+	if err != nil {
+		c.Fail(err)
+		return "", err
+	}
+
+	line, err := readLine(c.Reader())
+	if err != nil {
+		c.Fail(err)
+		return "", err
+	}
+
+	if follow && strings.HasPrefix(string(line), "-TRY ") {
+		if addr := strings.TrimSpace(string(line[5 : len(line)-2])); addr != "" {
+			return addr, nil
+		}
+	}
+
+	if err = copyFrame(r, c.Reader(), line); err != nil {
+		c.Fail(err)
+	}
+	return "", err
+}
+
+// copyFrame copies the RESP frame starting with line, and the frames nested
+// in it, from the reader to the relay. Bulk strings are copied in pieces of
+// the reader buffer.
+func copyFrame(r *relay, br *bufio.Reader, line []byte) error {
+	switch line[0] {
+	case '+', '-', ':':
+		return r.write(line)
+	case '$':
+		n, err := strconv.Atoi(string(line[1 : len(line)-2]))
+		if err != nil {
+			return errProtocol
+		}
+		if err = r.write(line); err != nil || n < 0 {
+			return err
+		}
+		return r.copyN(br, n+2)
+	case '*':
+		n, err := strconv.Atoi(string(line[1 : len(line)-2]))
+		if err != nil {
+			return errProtocol
+		}
+		if err = r.write(line); err != nil {
+			return err
+		}
+
+		for i := 0; i < n; i++ {
+			if line, err = readLine(br); err != nil {
+				return err
+			}
+			if err = copyFrame(r, br, line); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return errProtocol
+}
+
+// readLine reads a RESP line, the slice is valid until the next read. Lines
+// longer than the reader buffer, like long error replies, are copied.
+func readLine(br *bufio.Reader) ([]byte, error) {
+	line, err := br.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		line = append([]byte(nil), line...)
+		for err == bufio.ErrBufferFull {
+			var more []byte
+			more, err = br.ReadSlice('\n')
+			line = append(line, more...)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errProtocol
+	}
+	return line, nil
+}
+
+// relay writes reply bytes to the client, flushing once more than limit
+// bytes are buffered
+type relay struct {
+	w     *redcon.Writer
+	limit int
+
+	// pending is the number of bytes buffered since the last flush, until
+	// the first flush they follow the replies of earlier pipelined commands
+	pending int
+	flushed bool
+
+	// err is the error writing to the client
+	err error
+
+	// deadline extends the backend deadline after progress
+	deadline func()
+}
+
+func (r *relay) write(p []byte) error {
+	r.w.WriteRaw(p)
+	r.pending += len(p)
+
+	if r.pending < r.limit {
+		return nil
+	}
+
+	r.pending, r.flushed = 0, true
+	if r.err = r.w.Flush(); r.err != nil {
+		return r.err
+	}
+
+	r.deadline()
+	return nil
+}
+
+// discard drops the bytes of a failed attempt, which were not flushed
+func (r *relay) discard() {
+	buf := r.w.Buffer()
+	r.w.SetBuffer(buf[:len(buf)-r.pending])
+	r.pending = 0
+}
+
+// copyN copies n bytes from the reader to the client
+func (r *relay) copyN(br *bufio.Reader, n int) error {
+	for n > 0 {
+		size := n
+		if size > br.Size() {
+			size = br.Size()
+		}
+
+		p, err := br.Peek(size)
+		if err != nil {
+			return err
+		}
+		if err = r.write(p); err != nil {
+			return err
+		}
+
+		br.Discard(size)
+		n -= size
+	}
+	return nil
+}
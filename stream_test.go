@@ -0,0 +1,434 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/masomo/summitdb-balancer/summitdbtest"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	"github.com/tidwall/redcon"
+)
+
+var _ = Describe("streaming", func() {
+	// newRelay returns a relay to out flushing past limit bytes
+	var newRelay = func(out io.Writer, limit int) *relay {
+		return &relay{w: redcon.NewWriter(out), limit: limit, deadline: func() {}}
+	}
+
+	// reader returns a reader of the smallest buffer size over the frames
+	var reader = func(frames string) *bufio.Reader {
+		return bufio.NewReaderSize(strings.NewReader(frames), 16)
+	}
+
+	var copyAll = func(frames string, limit int) (string, error) {
+		var out bytes.Buffer
+		r := newRelay(&out, limit)
+		br := reader(frames)
+
+		line, err := readLine(br)
+		if err != nil {
+			return "", err
+		}
+		if err = copyFrame(r, br, line); err != nil {
+			return "", err
+		}
+		Expect(r.w.Flush()).To(Succeed())
+		return out.String(), nil
+	}
+
+	DescribeTable("should copy frames unchanged",
+		func(frames string) {
+			for _, limit := range []int{streamChunk, 8} {
+				Expect(copyAll(frames, limit)).To(Equal(frames))
+			}
+		},
+		Entry("a status", "+OK\r\n"),
+		Entry("an error", "-ERR boom\r\n"),
+		Entry("a redirect", "-TRY 127.0.0.1:7481\r\n"),
+		Entry("an integer", ":42\r\n"),
+		Entry("a bulk string", "$5\r\nhello\r\n"),
+		Entry("an empty bulk string", "$0\r\n\r\n"),
+		Entry("a null bulk string", "$-1\r\n"),
+		Entry("an empty array", "*0\r\n"),
+		Entry("a null array", "*-1\r\n"),
+		Entry("nested arrays", "*3\r\n*2\r\n$1\r\na\r\n:1\r\n$-1\r\n*1\r\n*0\r\n"),
+		Entry("a bulk string larger than the reader buffer", "$40\r\n"+strings.Repeat("x", 40)+"\r\n"),
+		Entry("a status line larger than the reader buffer", "+"+strings.Repeat("x", 40)+"\r\n"),
+		Entry("an error line larger than the reader buffer", "-ERR "+strings.Repeat("x", 40)+"\r\n"),
+	)
+
+	DescribeTable("should reject invalid frames",
+		func(frames string, expected error) {
+			_, err := copyAll(frames, streamChunk)
+			Expect(err).To(Equal(expected))
+		},
+		Entry("an unknown type", "?1\r\n", errProtocol),
+		Entry("a bad bulk length", "$x\r\n", errProtocol),
+		Entry("a bad array length", "*x\r\n", errProtocol),
+		Entry("a line without CR", "+OK\n", errProtocol),
+		Entry("a line too short", "\r\n", errProtocol),
+		Entry("nothing", "", io.EOF),
+		Entry("a truncated array", "*2\r\n:1\r\n", io.EOF),
+	)
+
+	It("should read lines longer than the reader buffer whole", func() {
+		br := reader("+" + strings.Repeat("x", 40) + "\r\n:1\r\n")
+
+		line, err := readLine(br)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(line)).To(Equal("+" + strings.Repeat("x", 40) + "\r\n"))
+
+		line, err = readLine(br)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(line)).To(Equal(":1\r\n"))
+	})
+
+	It("should flush once the limit is crossed", func() {
+		var out bytes.Buffer
+		r := newRelay(&out, 8)
+
+		Expect(r.write([]byte("+OK\r\n"))).To(Succeed())
+		Expect(r.flushed).To(BeFalse())
+		Expect(out.Len()).To(BeZero())
+
+		Expect(r.write([]byte(":1\r\n"))).To(Succeed())
+		Expect(r.flushed).To(BeTrue())
+		Expect(out.String()).To(Equal("+OK\r\n:1\r\n"))
+	})
+
+	It("should discard only the bytes of the failed attempt", func() {
+		var out bytes.Buffer
+		r := newRelay(&out, streamChunk)
+
+		// the reply of an earlier pipelined command
+		r.w.WriteRaw([]byte("+OK\r\n"))
+
+		Expect(r.write([]byte("*2\r\n$1\r\na\r\n"))).To(Succeed())
+		r.discard()
+		Expect(r.write([]byte(":1\r\n"))).To(Succeed())
+
+		Expect(r.w.Flush()).To(Succeed())
+		Expect(out.String()).To(Equal("+OK\r\n:1\r\n"))
+	})
+
+	Context("through the proxy", func() {
+		var cluster *summitdbtest.Cluster
+		var p *proxy
+		var client redis.Conn
+
+		BeforeEach(func() {
+			var err error
+			cluster, err = summitdbtest.NewCluster(3)
+			Expect(err).NotTo(HaveOccurred())
+
+			// without routing writes land on followers too, all reads are
+			// streamed past 1KB
+			p = startClusterProxy(&Config{LoadBalancer: loadBalancer{
+				MaxIdle:         4,
+				Passthrough:     true,
+				StreamThreshold: 1024,
+				Retry:           retry{Reads: 2},
+			}}, cluster)
+
+			client, err = p.dial()
+			Expect(err).NotTo(HaveOccurred())
+
+			for _, node := range cluster.Nodes {
+				node.ResetCounts()
+			}
+		})
+
+		AfterEach(func() {
+			client.Close()
+			p.close()
+			Expect(cluster.Close()).To(Succeed())
+		})
+
+		It("should relay large bulk strings, nulls and arrays", func() {
+			big := strings.Repeat("x", 3*streamChunk+1)
+			Expect(client.Do("SET", "big", big)).To(Equal("OK"))
+
+			for i := 0; i < 3; i++ {
+				Expect(redis.String(client.Do("GET", "big"))).To(Equal(big))
+			}
+			Expect(client.Do("GET", "missing")).To(BeNil())
+			Expect(client.Do("MGET", "big", "missing")).To(Equal([]interface{}{[]byte(big), nil}))
+		})
+
+		It("should follow the TRY replies of followers", func() {
+			for i := 0; i < 9; i++ {
+				Expect(client.Do("SET", "a", i)).To(Equal("OK"))
+			}
+
+			Expect(cluster.Nodes[1].Count("set") + cluster.Nodes[2].Count("set")).To(Equal(6))
+			Expect(cluster.Nodes[0].Count("set")).To(Equal(9))
+		})
+
+		It("should relay error lines longer than the reader buffer", func() {
+			long := "ERR " + strings.Repeat("x", 64*1024)
+			for _, node := range cluster.Nodes {
+				node.SetFault("get", summitdbtest.Fault{Error: long})
+			}
+
+			_, err := client.Do("GET", "a")
+			Expect(err).To(MatchError(long))
+		})
+
+		It("should retry reads that failed before anything was flushed", func() {
+			Expect(client.Do("SET", "a", "1")).To(Equal("OK"))
+			cluster.Nodes[1].SetFault("get", summitdbtest.Fault{Drop: true})
+			cluster.Nodes[2].SetFault("get", summitdbtest.Fault{Drop: true})
+
+			// the PINGs keep the GETs out of batches, their replies are
+			// buffered before the retried GET
+			for i := 0; i < 3; i++ {
+				client.Send("PING")
+				client.Send("GET", "a")
+			}
+			Expect(client.Flush()).To(Succeed())
+
+			for i := 0; i < 3; i++ {
+				Expect(client.Receive()).To(Equal("PONG"))
+				Expect(redis.String(client.Receive())).To(Equal("1"))
+			}
+			Expect(cluster.Nodes[1].Count("get") + cluster.Nodes[2].Count("get")).NotTo(BeZero())
+			Expect(cluster.Nodes[0].Count("get")).To(Equal(3))
+		})
+	})
+})
+
+var _ = Describe("passthrough", func() {
+	var cluster *summitdbtest.Cluster
+
+	BeforeEach(func() {
+		var err error
+		cluster, err = summitdbtest.NewCluster(3)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(cluster.Close()).To(Succeed())
+	})
+
+	// script is run through both paths, on an empty store each time
+	var big = strings.Repeat("x", 2*streamChunk)
+	var script = [][]interface{}{
+		{"SET", "a", "1"},
+		{"GET", "a"},
+		{"GET", "missing"},
+		{"SET", "big", big},
+		{"GET", "big"},
+		{"MSET", "b", "2", "c", "3"},
+		{"MGET", "a", "missing", "c"},
+		{"JSET", "user", "name", "Tom"},
+		{"GET", "user"},
+		{"DBSIZE"},
+		{"SET", "a"},
+		{"GET", "a", "b"},
+	}
+
+	// run sends the script through a proxy and returns the replies, error
+	// replies included
+	var run = func(passthrough bool) []interface{} {
+		p := startClusterProxy(&Config{LoadBalancer: loadBalancer{MaxIdle: 4, Routing: true, Passthrough: passthrough}}, cluster)
+		defer p.close()
+
+		client, err := p.dial()
+		Expect(err).NotTo(HaveOccurred())
+		defer client.Close()
+
+		Expect(client.Do("FLUSHDB")).To(Equal("OK"))
+
+		replies := make([]interface{}, len(script))
+		for i, args := range script {
+			name := strings.ToLower(args[0].(string))
+			cargs := make([][]byte, len(args))
+			for j, arg := range args {
+				cargs[j] = []byte(arg.(string))
+			}
+
+			// the commands take the raw path only with passthrough
+			forwarded := p.sb.forwards(lookupCommand(name), redcon.Command{Args: cargs}) != nil
+			Expect(forwarded).To(Equal(passthrough), name)
+
+			reply, err := client.Do(args[0].(string), args[1:]...)
+			if rerr, ok := err.(redis.Error); ok {
+				reply, err = rerr, nil
+			}
+			Expect(err).NotTo(HaveOccurred())
+			replies[i] = reply
+		}
+		return replies
+	}
+
+	It("should reply like the Do path", func() {
+		expected := run(false)
+		Expect(expected[4]).To(Equal([]byte(big)))
+
+		Expect(run(true)).To(Equal(expected))
+	})
+
+	It("should follow the TRY replies of followers", func() {
+		// without routing writes land on followers too
+		p := startClusterProxy(&Config{LoadBalancer: loadBalancer{MaxIdle: 4, Passthrough: true}}, cluster)
+		defer p.close()
+
+		client, err := p.dial()
+		Expect(err).NotTo(HaveOccurred())
+		defer client.Close()
+
+		for _, node := range cluster.Nodes {
+			node.ResetCounts()
+		}
+
+		for i := 0; i < 9; i++ {
+			Expect(client.Do("SET", "a", i)).To(Equal("OK"))
+		}
+
+		Expect(cluster.Nodes[1].Count("set") + cluster.Nodes[2].Count("set")).To(Equal(6))
+		Expect(cluster.Nodes[0].Count("set")).To(Equal(9))
+		Expect(redis.String(client.Do("GET", "a"))).To(Equal("8"))
+	})
+
+	It("should retry reads on other backends", func() {
+		p := startClusterProxy(&Config{LoadBalancer: loadBalancer{MaxIdle: 4, Routing: true, Passthrough: true, Retry: retry{Reads: 2}}}, cluster)
+		defer p.close()
+
+		client, err := p.dial()
+		Expect(err).NotTo(HaveOccurred())
+		defer client.Close()
+
+		Expect(client.Do("SET", "a", "1")).To(Equal("OK"))
+		for _, node := range cluster.Nodes {
+			node.ResetCounts()
+		}
+		cluster.Nodes[1].SetFault("get", summitdbtest.Fault{Drop: true})
+		cluster.Nodes[2].SetFault("get", summitdbtest.Fault{Drop: true})
+
+		for i := 0; i < 3; i++ {
+			Expect(redis.String(client.Do("GET", "a"))).To(Equal("1"))
+		}
+		Expect(cluster.Nodes[1].Count("get") + cluster.Nodes[2].Count("get")).NotTo(BeZero())
+		Expect(cluster.Nodes[0].Count("get")).To(Equal(3))
+	})
+
+	It("should relay the error when retries are exhausted", func() {
+		p := startClusterProxy(&Config{LoadBalancer: loadBalancer{MaxIdle: 4, Routing: true, Passthrough: true}}, cluster)
+		defer p.close()
+
+		client, err := p.dial()
+		Expect(err).NotTo(HaveOccurred())
+		defer client.Close()
+
+		for _, node := range cluster.Nodes {
+			node.SetFault("get", summitdbtest.Fault{Drop: true})
+		}
+
+		_, err = client.Do("GET", "a")
+		Expect(err).To(MatchError(HavePrefix("ERR ")))
+
+		// the client connection stays usable
+		Expect(client.Do("SET", "a", "1")).To(Equal("OK"))
+	})
+})
+
+// benchKeys is the number of keys the fake backend starts with
+const benchKeys = 1000
+
+// fakeBackend starts a SummitDB leader holding the keys of the benchmarks
+func fakeBackend(b *testing.B) (string, func()) {
+	server, err := summitdbtest.NewServer()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	conn, err := redis.Dial("tcp", server.Addr())
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+
+	args := make([]interface{}, 0, 2*benchKeys)
+	for i := 0; i < benchKeys; i++ {
+		args = append(args, fmt.Sprintf("key:%04d", i), "value")
+	}
+	if _, err = conn.Do("MSET", args...); err != nil {
+		b.Fatal(err)
+	}
+
+	return server.Addr(), func() { server.Close() }
+}
+
+// benchBalancer serves a balancer in front of the backend and returns a
+// client connection to it
+func benchBalancer(b *testing.B, backendAddr string, passthrough bool) (redis.Conn, func()) {
+	p, err := startProxy(&Config{LoadBalancer: loadBalancer{
+		Mode:        "roundrobin",
+		MaxIdle:     16,
+		Routing:     true,
+		Passthrough: passthrough,
+		Upstream:    []backend{{Host: backendAddr, Fall: 2, Rise: 2, CheckInterval: time.Second}},
+	}})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	client, err := p.dial()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	return client, func() {
+		client.Close()
+		p.close()
+	}
+}
+
+// benchPaths runs the command through the Do path and the passthrough path
+func benchPaths(b *testing.B, name string, args ...interface{}) {
+	backendAddr, stop := fakeBackend(b)
+	defer stop()
+
+	for _, path := range []struct {
+		name        string
+		passthrough bool
+	}{{"do", false}, {"passthrough", true}} {
+		b.Run(path.name, func(b *testing.B) {
+			client, stop := benchBalancer(b, backendAddr, path.passthrough)
+			defer stop()
+
+			if _, err := client.Do(name, args...); err != nil {
+				b.Fatal(err)
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				if _, err := client.Do(name, args...); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkGet(b *testing.B) { benchPaths(b, "GET", "key:0001") }
+
+func BenchmarkSet(b *testing.B) { benchPaths(b, "SET", "key:0001", "value") }
+
+func BenchmarkMget(b *testing.B) {
+	args := make([]interface{}, 100)
+	for i := range args {
+		args[i] = fmt.Sprintf("key:%04d", i)
+	}
+	benchPaths(b, "MGET", args...)
+}
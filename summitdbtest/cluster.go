@@ -0,0 +1,79 @@
+package summitdbtest
+
+// Cluster is a group of fake nodes sharing their data, one of them leads
+type Cluster struct {
+	Nodes []*Server
+}
+
+// NewCluster starts n nodes on free local ports, the first one leads
+func NewCluster(n int) (*Cluster, error) {
+	c := &Cluster{}
+	st := newStore()
+
+	for i := 0; i < n; i++ {
+		s := newServer(st)
+		if err := s.listen("127.0.0.1:0"); err != nil {
+			c.Close()
+			return nil, err
+		}
+		c.Nodes = append(c.Nodes, s)
+	}
+
+	peers := c.Addrs()
+	for _, s := range c.Nodes {
+		s.SetPeers(peers)
+	}
+
+	c.Elect(0)
+	return c, nil
+}
+
+// Addrs returns the addresses of the nodes
+func (c *Cluster) Addrs() []string {
+	addrs := make([]string, len(c.Nodes))
+	for i, s := range c.Nodes {
+		addrs[i] = s.Addr()
+	}
+	return addrs
+}
+
+// Leader returns the leading node, nil while there is none
+func (c *Cluster) Leader() *Server {
+	for _, s := range c.Nodes {
+		if s.State() == Leader {
+			return s
+		}
+	}
+	return nil
+}
+
+// Elect makes the i-th node the leader and the others its followers
+func (c *Cluster) Elect(i int) {
+	leader := c.Nodes[i].Addr()
+	for j, s := range c.Nodes {
+		if j == i {
+			s.SetState(Leader, leader)
+		} else {
+			s.SetState(Follower, leader)
+		}
+	}
+}
+
+// Election puts all nodes into the candidate state without a leader, as
+// while the cluster votes
+func (c *Cluster) Election() {
+	for _, s := range c.Nodes {
+		s.SetState(Candidate, "")
+	}
+}
+
+// Close stops all nodes
+func (c *Cluster) Close() error {
+	var err error
+	for _, s := range c.Nodes {
+		if cerr := s.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
@@ -0,0 +1,304 @@
+package summitdbtest
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/tidwall/redcon"
+)
+
+var (
+	errInvalidJSON = errors.New("json not valid")
+	errSyntax      = errors.New("syntax error")
+)
+
+// command describes how a fake node runs a command
+type command struct {
+	// args is the argument count with the name, at least that many when
+	// variadic, and step the count the rest comes in multiples of
+	args, step int
+	variadic   bool
+
+	// write commands are rejected by followers
+	write bool
+
+	run func(s *Server, conn redcon.Conn, args [][]byte)
+}
+
+func (c command) arity(n int) bool {
+	if !c.variadic {
+		return n == c.args
+	}
+	return n >= c.args && (c.step == 0 || (n-c.args)%c.step == 0)
+}
+
+var commands = map[string]command{
+	"ping": {args: 1, variadic: true, run: func(s *Server, conn redcon.Conn, args [][]byte) {
+		if len(args) > 1 {
+			conn.WriteBulk(args[1])
+			return
+		}
+		conn.WriteString("PONG")
+	}},
+	"quit": {args: 1, run: func(s *Server, conn redcon.Conn, args [][]byte) {
+		conn.WriteString("OK")
+		conn.Close()
+	}},
+	"raftstate": {args: 1, run: func(s *Server, conn redcon.Conn, args [][]byte) {
+		conn.WriteBulkString(s.State())
+	}},
+	"raftleader": {args: 1, run: func(s *Server, conn redcon.Conn, args [][]byte) {
+		leader := s.Leader()
+		if leader == "" {
+			conn.WriteError("ERR leader not known")
+			return
+		}
+		conn.WriteBulkString(leader)
+	}},
+	"raftpeers": {args: 1, run: func(s *Server, conn redcon.Conn, args [][]byte) {
+		peers := s.peerList()
+		conn.WriteArray(len(peers))
+		for _, peer := range peers {
+			conn.WriteBulkString(peer)
+		}
+	}},
+	"get": {args: 2, run: func(s *Server, conn redcon.Conn, args [][]byte) {
+		writeValue(conn, s.store, string(args[1]))
+	}},
+	"mget": {args: 2, variadic: true, run: func(s *Server, conn redcon.Conn, args [][]byte) {
+		conn.WriteArray(len(args) - 1)
+		for _, key := range args[1:] {
+			writeValue(conn, s.store, string(key))
+		}
+	}},
+	"set": {args: 3, write: true, run: func(s *Server, conn redcon.Conn, args [][]byte) {
+		s.store.set(string(args[1]), string(args[2]))
+		conn.WriteString("OK")
+	}},
+	"mset": {args: 3, step: 2, variadic: true, write: true, run: func(s *Server, conn redcon.Conn, args [][]byte) {
+		for i := 1; i < len(args); i += 2 {
+			s.store.set(string(args[i]), string(args[i+1]))
+		}
+		conn.WriteString("OK")
+	}},
+	"dbsize": {args: 1, run: func(s *Server, conn redcon.Conn, args [][]byte) {
+		conn.WriteInt(s.store.size())
+	}},
+	"flushdb": {args: 1, write: true, run: func(s *Server, conn redcon.Conn, args [][]byte) {
+		s.store.flush()
+		conn.WriteString("OK")
+	}},
+	"fence": {args: 2, write: true, run: func(s *Server, conn redcon.Conn, args [][]byte) {
+		conn.WriteInt64(s.store.fence(string(args[1])))
+	}},
+	"publish": {args: 3, write: true, run: func(s *Server, conn redcon.Conn, args [][]byte) {
+		conn.WriteInt(s.pubsub.Publish(string(args[1]), string(args[2])))
+	}},
+	"subscribe": {args: 2, variadic: true, run: func(s *Server, conn redcon.Conn, args [][]byte) {
+		s.subscribe(conn, false, args[1:])
+	}},
+	"psubscribe": {args: 2, variadic: true, run: func(s *Server, conn redcon.Conn, args [][]byte) {
+		s.subscribe(conn, true, args[1:])
+	}},
+	"multi": {args: 1, write: true, run: func(s *Server, conn redcon.Conn, args [][]byte) {
+		conn.SetContext(&transaction{})
+		conn.WriteString("OK")
+	}},
+	"exec": {args: 1, run: func(s *Server, conn redcon.Conn, args [][]byte) {
+		tx, ok := conn.Context().(*transaction)
+		if !ok {
+			conn.WriteError("ERR EXEC without MULTI")
+			return
+		}
+		conn.SetContext(nil)
+
+		if tx.aborted {
+			conn.WriteError("EXECABORT Transaction discarded because of previous errors.")
+			return
+		}
+
+		conn.WriteArray(len(tx.queued))
+		for _, q := range tx.queued {
+			q.spec.run(s, conn, q.args)
+		}
+	}},
+	"discard": {args: 1, run: func(s *Server, conn redcon.Conn, args [][]byte) {
+		if _, ok := conn.Context().(*transaction); !ok {
+			conn.WriteError("ERR DISCARD without MULTI")
+			return
+		}
+		conn.SetContext(nil)
+		conn.WriteString("OK")
+	}},
+	"jset": {args: 4, variadic: true, write: true, run: func(s *Server, conn redcon.Conn, args [][]byte) {
+		if len(args) > 5 {
+			conn.WriteError("ERR syntax error")
+			return
+		}
+
+		mode := ""
+		if len(args) == 5 {
+			mode = strings.ToLower(string(args[4]))
+		}
+
+		if err := s.store.jset(string(args[1]), string(args[2]), string(args[3]), mode); err != nil {
+			conn.WriteError("ERR " + err.Error())
+			return
+		}
+		conn.WriteString("OK")
+	}},
+}
+
+// transaction holds the commands queued by a connection after MULTI
+type transaction struct {
+	queued  []queued
+	aborted bool
+}
+
+type queued struct {
+	spec command
+	args [][]byte
+}
+
+// abort makes EXEC discard the transaction, if any
+func (tx *transaction) abort() {
+	if tx != nil {
+		tx.aborted = true
+	}
+}
+
+// queue adds the command with a copy of the args, redcon reuses their
+// buffers
+func (tx *transaction) queue(spec command, args [][]byte) {
+	q := queued{spec: spec, args: make([][]byte, len(args))}
+	for i, arg := range args {
+		q.args[i] = append([]byte(nil), arg...)
+	}
+	tx.queued = append(tx.queued, q)
+}
+
+func writeValue(conn redcon.Conn, st *store, key string) {
+	val, ok := st.get(key)
+	if !ok {
+		conn.WriteNull()
+		return
+	}
+	conn.WriteBulkString(val)
+}
+
+// store is the data of a node, shared by the nodes of a cluster
+type store struct {
+	mu     sync.RWMutex
+	data   map[string]string
+	fences map[string]int64
+}
+
+func newStore() *store {
+	return &store{data: make(map[string]string), fences: make(map[string]int64)}
+}
+
+func (st *store) get(key string) (string, bool) {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+
+	val, ok := st.data[key]
+	return val, ok
+}
+
+func (st *store) set(key, val string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	st.data[key] = val
+}
+
+func (st *store) size() int {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+
+	return len(st.data)
+}
+
+// fence returns the next fencing token of the name
+func (st *store) fence(name string) int64 {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	st.fences[name]++
+	return st.fences[name]
+}
+
+func (st *store) flush() {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	st.data = make(map[string]string)
+}
+
+// jset sets the dotted path of the JSON document at key. The value is raw
+// JSON with the RAW mode, a string with STR, otherwise numbers, booleans
+// and null are taken as such and anything else as a string.
+func (st *store) jset(key, path, value, mode string) error {
+	var val interface{}
+	switch mode {
+	case "raw":
+		if err := json.Unmarshal([]byte(value), &val); err != nil {
+			return errInvalidJSON
+		}
+	case "str":
+		val = value
+	case "":
+		val = literal(value)
+	default:
+		return errSyntax
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	doc := map[string]interface{}{}
+	if current, ok := st.data[key]; ok {
+		if err := json.Unmarshal([]byte(current), &doc); err != nil {
+			return errInvalidJSON
+		}
+	}
+
+	parts := strings.Split(path, ".")
+	node := doc
+	for _, part := range parts[:len(parts)-1] {
+		next, ok := node[part].(map[string]interface{})
+		if !ok {
+			next = map[string]interface{}{}
+			node[part] = next
+		}
+		node = next
+	}
+	node[parts[len(parts)-1]] = val
+
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	st.data[key] = string(data)
+	return nil
+}
+
+// literal returns the JSON value the string stands for
+func literal(value string) interface{} {
+	switch value {
+	case "true":
+		return true
+	case "false":
+		return false
+	case "null":
+		return nil
+	}
+
+	if n, err := strconv.ParseFloat(value, 64); err == nil {
+		return n
+	}
+	return value
+}
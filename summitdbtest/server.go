@@ -0,0 +1,337 @@
+// Package summitdbtest provides in-process fake SummitDB nodes, so the
+// balancer and the proxy can be tested without a real cluster.
+//
+// A Server answers RAFTSTATE, RAFTLEADER, RAFTPEERS, PING, the GET, SET,
+// MGET, MSET, JSET, DBSIZE, FLUSHDB and FENCE commands, MULTI blocks and
+// pub/sub on the node. Followers reply "TRY <leader>" to writes like
+// SummitDB does. Nodes of a
+// Cluster share their data, and tests can elect another leader, stop and
+// start nodes, and inject latency, error replies and dropped connections
+// per command.
+package summitdbtest
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tidwall/redcon"
+)
+
+// Raft states replied to RAFTSTATE
+const (
+	Leader    = "Leader"
+	Follower  = "Follower"
+	Candidate = "Candidate"
+)
+
+// Fault changes how a node answers a command
+type Fault struct {
+	// Latency delays the reply
+	Latency time.Duration
+
+	// Error is replied instead of running the command, without the "-"
+	Error string
+
+	// Drop closes the connection instead of replying
+	Drop bool
+}
+
+// Server is a fake SummitDB node listening on a local port
+type Server struct {
+	addr  string
+	store *store
+
+	mu       sync.Mutex
+	state    string
+	leader   string
+	peers    []string
+	faults   map[string]Fault
+	commands map[string]int
+	conns    map[redcon.Conn]struct{}
+	server   *redcon.Server
+
+	// subscribers are the connections in subscribe mode, detached from
+	// the redcon server
+	pubsub      redcon.PubSub
+	subscribers map[net.Conn]struct{}
+}
+
+// NewServer starts a standalone leader on a free local port
+func NewServer() (*Server, error) {
+	s := newServer(newStore())
+
+	if err := s.listen("127.0.0.1:0"); err != nil {
+		return nil, err
+	}
+	s.SetState(Leader, s.Addr())
+	s.SetPeers([]string{s.Addr()})
+
+	return s, nil
+}
+
+func newServer(st *store) *Server {
+	return &Server{
+		store:       st,
+		state:       Follower,
+		faults:      make(map[string]Fault),
+		commands:    make(map[string]int),
+		conns:       make(map[redcon.Conn]struct{}),
+		subscribers: make(map[net.Conn]struct{}),
+	}
+}
+
+// listen serves on the address, the caller holds no lock
+func (s *Server) listen(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	server := redcon.NewServer(ln.Addr().String(), s.handle, s.accept, s.closed)
+
+	s.mu.Lock()
+	s.addr, s.server = ln.Addr().String(), server
+	s.mu.Unlock()
+
+	go server.Serve(ln)
+	return nil
+}
+
+// Addr returns the address the node listens on
+func (s *Server) Addr() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.addr
+}
+
+// State returns the raft state of the node
+func (s *Server) State() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.state
+}
+
+// SetState changes the raft state of the node and the leader it reports
+func (s *Server) SetState(state, leader string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.state, s.leader = state, leader
+}
+
+// Leader returns the address of the leader the node reports
+func (s *Server) Leader() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.leader
+}
+
+// SetFault makes the node answer the command, lowercase, with the fault.
+// The fault of the empty command applies to all commands.
+func (s *Server) SetFault(command string, f Fault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.faults[command] = f
+}
+
+// ClearFaults makes the node answer all commands normally again
+func (s *Server) ClearFaults() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.faults = make(map[string]Fault)
+}
+
+// Count returns how many times the node received the command, lowercase
+func (s *Server) Count(command string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.commands[command]
+}
+
+// ResetCounts sets the command counts to zero
+func (s *Server) ResetCounts() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.commands = make(map[string]int)
+}
+
+// Disconnect closes the client connections of the node, it keeps serving
+func (s *Server) Disconnect() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// the handlers own the redcon connections, closing the network
+	// connection is safe from other goroutines
+	for conn := range s.conns {
+		conn.NetConn().Close()
+	}
+
+	for conn := range s.subscribers {
+		conn.Close()
+	}
+	s.subscribers = make(map[net.Conn]struct{})
+}
+
+// Stop closes the listener and the client connections, the node keeps its
+// data and can be started again on the same address
+func (s *Server) Stop() error {
+	s.mu.Lock()
+	server := s.server
+	s.server = nil
+	s.mu.Unlock()
+
+	if server == nil {
+		return nil
+	}
+
+	err := server.Close()
+	s.Disconnect()
+	return err
+}
+
+// Start serves again on the address of the node after Stop
+func (s *Server) Start() error {
+	s.mu.Lock()
+	running, addr := s.server != nil, s.addr
+	s.mu.Unlock()
+
+	if running {
+		return nil
+	}
+	return s.listen(addr)
+}
+
+// Close stops the node
+func (s *Server) Close() error { return s.Stop() }
+
+// Get returns the value of the key in the data of the node
+func (s *Server) Get(key string) (string, bool) { return s.store.get(key) }
+
+func (s *Server) accept(conn redcon.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.conns[conn] = struct{}{}
+	return true
+}
+
+func (s *Server) closed(conn redcon.Conn, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.conns, conn)
+}
+
+// fault counts the command and returns its fault, with the state of the
+// node and the leader it reports
+func (s *Server) fault(name string) (Fault, string, string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.commands[name]++
+
+	f, ok := s.faults[name]
+	if !ok {
+		f = s.faults[""]
+	}
+	return f, s.state, s.leader
+}
+
+func (s *Server) handle(conn redcon.Conn, cmd redcon.Command) {
+	name := strings.ToLower(string(cmd.Args[0]))
+
+	f, state, leader := s.fault(name)
+	if f.Latency > 0 {
+		time.Sleep(f.Latency)
+	}
+
+	switch {
+	case f.Drop:
+		conn.Close()
+		return
+	case f.Error != "":
+		conn.WriteError(f.Error)
+		return
+	}
+
+	tx, _ := conn.Context().(*transaction)
+
+	spec, ok := commands[name]
+	if !ok {
+		tx.abort()
+		conn.WriteError("ERR unknown command '" + string(cmd.Args[0]) + "'")
+		return
+	}
+
+	if !spec.arity(len(cmd.Args)) {
+		tx.abort()
+		conn.WriteError("ERR wrong number of arguments for '" + name + "' command")
+		return
+	}
+
+	if tx != nil {
+		switch name {
+		case "multi":
+			conn.WriteError("ERR MULTI calls can not be nested")
+		case "exec", "discard":
+			spec.run(s, conn, cmd.Args)
+		default:
+			tx.queue(spec, cmd.Args)
+			conn.WriteString("QUEUED")
+		}
+		return
+	}
+
+	if spec.write && state != Leader {
+		if leader == "" {
+			conn.WriteError("ERR leader not known")
+			return
+		}
+		conn.WriteError("TRY " + leader)
+		return
+	}
+
+	spec.run(s, conn, cmd.Args)
+}
+
+// subscribe puts the connection in subscribe mode, where the redcon pub/sub
+// of the node reads its commands
+func (s *Server) subscribe(conn redcon.Conn, pattern bool, channels [][]byte) {
+	s.mu.Lock()
+	s.subscribers[conn.NetConn()] = struct{}{}
+	s.mu.Unlock()
+
+	for _, channel := range channels {
+		if pattern {
+			s.pubsub.Psubscribe(conn, string(channel))
+		} else {
+			s.pubsub.Subscribe(conn, string(channel))
+		}
+	}
+}
+
+// peerList returns the peers of the node
+func (s *Server) peerList() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]string(nil), s.peers...)
+}
+
+// SetPeers changes the cluster members the node replies to RAFTPEERS, like
+// RAFTADDPEER and RAFTREMOVEPEER do
+func (s *Server) SetPeers(peers []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.peers = peers
+}
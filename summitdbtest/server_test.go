@@ -0,0 +1,190 @@
+package summitdbtest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Server", func() {
+	var subject *Server
+	var conn redis.Conn
+
+	BeforeEach(func() {
+		var err error
+		subject, err = NewServer()
+		Expect(err).NotTo(HaveOccurred())
+
+		conn, err = redis.Dial("tcp", subject.Addr())
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		conn.Close()
+		Expect(subject.Close()).To(Succeed())
+	})
+
+	It("should lead on its own", func() {
+		Expect(redis.String(conn.Do("RAFTSTATE"))).To(Equal(Leader))
+		Expect(redis.String(conn.Do("RAFTLEADER"))).To(Equal(subject.Addr()))
+		Expect(redis.Strings(conn.Do("RAFTPEERS"))).To(Equal([]string{subject.Addr()}))
+	})
+
+	It("should store keys", func() {
+		Expect(redis.String(conn.Do("SET", "a", "1"))).To(Equal("OK"))
+		Expect(redis.String(conn.Do("MSET", "b", "2", "c", "3"))).To(Equal("OK"))
+		Expect(redis.String(conn.Do("GET", "a"))).To(Equal("1"))
+		Expect(redis.Values(conn.Do("MGET", "a", "b", "x"))).To(Equal([]interface{}{[]byte("1"), []byte("2"), nil}))
+
+		_, err := conn.Do("MSET", "a")
+		Expect(err).To(MatchError("ERR wrong number of arguments for 'mset' command"))
+
+		Expect(conn.Do("FENCE", "f")).To(BeEquivalentTo(1))
+		Expect(conn.Do("FENCE", "f")).To(BeEquivalentTo(2))
+
+		Expect(conn.Do("DBSIZE")).To(BeEquivalentTo(3))
+		Expect(conn.Do("FLUSHDB")).To(Equal("OK"))
+		Expect(conn.Do("DBSIZE")).To(BeEquivalentTo(0))
+	})
+
+	It("should set JSON paths", func() {
+		Expect(conn.Do("JSET", "doc", "name.first", "Ann")).To(Equal("OK"))
+		Expect(conn.Do("JSET", "doc", "age", "30")).To(Equal("OK"))
+		Expect(conn.Do("JSET", "doc", "zip", "01", "STR")).To(Equal("OK"))
+		Expect(conn.Do("JSET", "doc", "tags", `["a"]`, "RAW")).To(Equal("OK"))
+		doc, _ := subject.Get("doc")
+		Expect(doc).To(MatchJSON(`{"name":{"first":"Ann"},"age":30,"zip":"01","tags":["a"]}`))
+
+		_, err := conn.Do("JSET", "doc", "tags", "[", "RAW")
+		Expect(err).To(MatchError("ERR json not valid"))
+	})
+
+	It("should run transactions", func() {
+		Expect(conn.Do("MULTI")).To(Equal("OK"))
+		Expect(conn.Do("SET", "a", "1")).To(Equal("QUEUED"))
+		Expect(conn.Do("GET", "a")).To(Equal("QUEUED"))
+		Expect(redis.Values(conn.Do("EXEC"))).To(Equal([]interface{}{"OK", []byte("1")}))
+
+		Expect(conn.Do("MULTI")).To(Equal("OK"))
+		_, err := conn.Do("SET", "a")
+		Expect(err).To(MatchError("ERR wrong number of arguments for 'set' command"))
+		_, err = conn.Do("EXEC")
+		Expect(err).To(MatchError("EXECABORT Transaction discarded because of previous errors."))
+
+		Expect(conn.Do("MULTI")).To(Equal("OK"))
+		Expect(conn.Do("SET", "a", "2")).To(Equal("QUEUED"))
+		Expect(conn.Do("DISCARD")).To(Equal("OK"))
+		Expect(redis.String(conn.Do("GET", "a"))).To(Equal("1"))
+
+		_, err = conn.Do("EXEC")
+		Expect(err).To(MatchError("ERR EXEC without MULTI"))
+	})
+
+	It("should redirect writes as a follower", func() {
+		subject.SetState(Follower, "127.0.0.1:7481")
+		Expect(redis.String(conn.Do("RAFTSTATE"))).To(Equal(Follower))
+
+		_, err := conn.Do("SET", "a", "1")
+		Expect(err).To(MatchError("TRY 127.0.0.1:7481"))
+		Expect(conn.Do("GET", "a")).To(BeNil())
+
+		subject.SetState(Candidate, "")
+		_, err = conn.Do("SET", "a", "1")
+		Expect(err).To(MatchError("ERR leader not known"))
+	})
+
+	It("should inject faults", func() {
+		subject.SetFault("get", Fault{Error: "ERR boom"})
+		_, err := conn.Do("GET", "a")
+		Expect(err).To(MatchError("ERR boom"))
+
+		subject.SetFault("", Fault{Latency: 50 * time.Millisecond})
+		start := time.Now()
+		Expect(conn.Do("PING")).To(Equal("PONG"))
+		Expect(time.Since(start)).To(BeNumerically(">=", 50*time.Millisecond))
+
+		subject.SetFault("ping", Fault{Drop: true})
+		_, err = conn.Do("PING")
+		Expect(err).To(HaveOccurred())
+
+		subject.ClearFaults()
+		Expect(subject.Count("ping")).To(Equal(2))
+	})
+
+	It("should relay published messages to subscribers", func() {
+		sub, err := redis.Dial("tcp", subject.Addr())
+		Expect(err).NotTo(HaveOccurred())
+		defer sub.Close()
+
+		Expect(sub.Do("SUBSCRIBE", "news")).To(Equal([]interface{}{[]byte("subscribe"), []byte("news"), int64(1)}))
+		Expect(conn.Do("PUBLISH", "news", "hi")).To(BeEquivalentTo(1))
+		Expect(sub.Receive()).To(Equal([]interface{}{[]byte("message"), []byte("news"), []byte("hi")}))
+
+		// subscribers are disconnected too
+		subject.Disconnect()
+		_, err = sub.Receive()
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should disconnect clients and restart", func() {
+		subject.Disconnect()
+		_, err := conn.Do("PING")
+		Expect(err).To(HaveOccurred())
+
+		Expect(subject.Stop()).To(Succeed())
+		_, err = redis.Dial("tcp", subject.Addr())
+		Expect(err).To(HaveOccurred())
+
+		Expect(subject.Start()).To(Succeed())
+		conn, err = redis.Dial("tcp", subject.Addr())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(conn.Do("PING")).To(Equal("PONG"))
+	})
+})
+
+var _ = Describe("Cluster", func() {
+	var subject *Cluster
+
+	BeforeEach(func() {
+		var err error
+		subject, err = NewCluster(3)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(subject.Close()).To(Succeed())
+	})
+
+	It("should share data and move the leader", func() {
+		Expect(subject.Leader()).To(BeIdenticalTo(subject.Nodes[0]))
+
+		conn, err := redis.Dial("tcp", subject.Nodes[2].Addr())
+		Expect(err).NotTo(HaveOccurred())
+		defer conn.Close()
+
+		Expect(redis.Strings(conn.Do("RAFTPEERS"))).To(Equal(subject.Addrs()))
+
+		_, err = conn.Do("SET", "a", "1")
+		Expect(err).To(MatchError("TRY " + subject.Nodes[0].Addr()))
+
+		subject.Elect(2)
+		Expect(subject.Leader()).To(BeIdenticalTo(subject.Nodes[2]))
+		Expect(redis.String(conn.Do("RAFTLEADER"))).To(Equal(subject.Nodes[2].Addr()))
+		Expect(conn.Do("SET", "a", "1")).To(Equal("OK"))
+		val, ok := subject.Nodes[0].Get("a")
+		Expect(ok).To(BeTrue())
+		Expect(val).To(Equal("1"))
+
+		subject.Election()
+		Expect(subject.Leader()).To(BeNil())
+		Expect(redis.String(conn.Do("RAFTSTATE"))).To(Equal(Candidate))
+	})
+})
+
+func TestSuite(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "summitdbtest")
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/masomo/summitdb-balancer/summitdbtest"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/tidwall/redcon"
+)
+
+var _ = Describe("command timeout", func() {
+	const timeout = 200 * time.Millisecond
+
+	var cluster *summitdbtest.Cluster
+	var p *proxy
+	var client redis.Conn
+
+	// start serves the proxy with a backend that takes reads but never
+	// answers them in time, the health checks still pass
+	var start = func(lb loadBalancer) {
+		var err error
+		cluster, err = summitdbtest.NewCluster(1)
+		Expect(err).NotTo(HaveOccurred())
+
+		lb.MaxIdle, lb.Routing, lb.CommandTimeout = 4, true, timeout
+		p = startClusterProxy(&Config{LoadBalancer: lb}, cluster)
+
+		client, err = p.dial()
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(client.Do("SET", "a", "1")).To(Equal("OK"))
+		for _, name := range []string{"get", "mget"} {
+			cluster.Nodes[0].SetFault(name, summitdbtest.Fault{Latency: 10 * timeout})
+		}
+	}
+
+	// timesOut expects the error reply of the command within the timeout,
+	// with some slack for the proxy
+	var timesOut = func(do func() error) {
+		began := time.Now()
+		Expect(do()).To(MatchError(ContainSubstring("i/o timeout")))
+		Expect(time.Since(began)).To(BeNumerically("<", 3*timeout))
+	}
+
+	AfterEach(func() {
+		client.Close()
+		p.close()
+		Expect(cluster.Close()).To(Succeed())
+	})
+
+	It("should fail buffered commands", func() {
+		start(loadBalancer{})
+
+		timesOut(func() error {
+			_, err := client.Do("GET", "a")
+			return err
+		})
+	})
+
+	It("should fail pipelined commands", func() {
+		start(loadBalancer{})
+
+		timesOut(func() error {
+			// pipelined GETs alone are joined into one MGET
+			Expect(client.Send("GET", "a")).To(Succeed())
+			Expect(client.Send("MGET", "a")).To(Succeed())
+			Expect(client.Flush()).To(Succeed())
+
+			_, err := client.Receive()
+			Expect(err).To(HaveOccurred())
+			_, err = client.Receive()
+			return err
+		})
+	})
+
+	It("should fail streamed commands", func() {
+		start(loadBalancer{StreamThreshold: 1024})
+
+		Expect(p.sb.forwards(lookupCommand("get"), redcon.Command{Args: [][]byte{[]byte("GET"), []byte("a")}})).NotTo(BeNil())
+		timesOut(func() error {
+			_, err := client.Do("GET", "a")
+			return err
+		})
+	})
+})
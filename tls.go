@@ -0,0 +1,36 @@
+package main
+
+import (
+	"crypto/tls"
+
+	"github.com/masomo/summitdb-balancer/balancer"
+)
+
+// config builds the server TLS config, nil when TLS is off
+func (t *listenerTLS) config() (*tls.Config, error) {
+	if t.Cert == "" && t.Key == "" {
+		return nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(t.Cert, t.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if t.ClientCA != "" {
+		pool, err := balancer.LoadCertPool(t.ClientCA)
+		if err != nil {
+			return nil, err
+		}
+
+		c.ClientCAs = pool
+		c.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return c, nil
+}
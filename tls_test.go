@@ -0,0 +1,200 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/masomo/summitdb-balancer/summitdbtest"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// testCert is a certificate written to disk with its key
+type testCert struct {
+	cert     *x509.Certificate
+	key      *ecdsa.PrivateKey
+	certFile string
+	keyFile  string
+}
+
+// writeTestCert writes a certificate for 127.0.0.1 signed by the CA, self
+// signed and a CA itself when ca is nil
+func writeTestCert(dir, name string, ca *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).NotTo(HaveOccurred())
+
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	Expect(err).NotTo(HaveOccurred())
+
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	parent, parentKey := tmpl, key
+	if ca == nil {
+		tmpl.IsCA, tmpl.BasicConstraintsValid = true, true
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		parent, parentKey = ca.cert, ca.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	Expect(err).NotTo(HaveOccurred())
+	cert, err := x509.ParseCertificate(der)
+	Expect(err).NotTo(HaveOccurred())
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	Expect(err).NotTo(HaveOccurred())
+
+	c := &testCert{
+		cert:     cert,
+		key:      key,
+		certFile: filepath.Join(dir, name+".pem"),
+		keyFile:  filepath.Join(dir, name+"-key.pem"),
+	}
+	Expect(ioutil.WriteFile(c.certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)).To(Succeed())
+	Expect(ioutil.WriteFile(c.keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)).To(Succeed())
+
+	return c
+}
+
+var _ = Describe("listener TLS", func() {
+	var dir string
+	var ca, server, client *testCert
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "sb")
+		Expect(err).NotTo(HaveOccurred())
+
+		ca = writeTestCert(dir, "ca", nil)
+		server = writeTestCert(dir, "server", ca)
+		client = writeTestCert(dir, "client", ca)
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	It("should be off without a certificate", func() {
+		c, err := (&listenerTLS{}).config()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(c).To(BeNil())
+	})
+
+	It("should fail on missing files", func() {
+		_, err := (&listenerTLS{Cert: filepath.Join(dir, "none.pem"), Key: server.keyFile}).config()
+		Expect(err).To(HaveOccurred())
+
+		_, err = (&listenerTLS{Cert: server.certFile, Key: server.keyFile, ClientCA: filepath.Join(dir, "none.pem")}).config()
+		Expect(err).To(HaveOccurred())
+	})
+
+	Context("through the proxy", func() {
+		var cluster *summitdbtest.Cluster
+		var p *proxy
+		var dl *drainListener
+		var ln net.Listener
+		var served chan struct{}
+		var saved string
+
+		// start serves the proxy on a TLS listener
+		var start = func(t listenerTLS) {
+			tlsConfig, err := t.config()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(tlsConfig).NotTo(BeNil())
+
+			saved, *flagaddr = *flagaddr, "127.0.0.1:0"
+			dl, ln, err = listen(tlsConfig)
+			*flagaddr = saved
+			Expect(err).NotTo(HaveOccurred())
+
+			served = make(chan struct{})
+			go runBalancer(p.sb, ln, served)
+		}
+
+		// dial connects a TLS client trusting the CA, with the certificate
+		// of the client when given
+		var dial = func(cert *testCert) (redis.Conn, error) {
+			roots := x509.NewCertPool()
+			roots.AddCert(ca.cert)
+
+			c := &tls.Config{RootCAs: roots}
+			if cert != nil {
+				pair, err := tls.LoadX509KeyPair(cert.certFile, cert.keyFile)
+				Expect(err).NotTo(HaveOccurred())
+				c.Certificates = []tls.Certificate{pair}
+			}
+
+			return redis.Dial("tcp", ln.Addr().String(), redis.DialUseTLS(true), redis.DialTLSConfig(c))
+		}
+
+		// ping returns the error of a PING, nil when it was answered
+		var ping = func(conn redis.Conn, err error) error {
+			if err != nil {
+				return err
+			}
+			defer conn.Close()
+
+			reply, err := conn.Do("PING")
+			if err == nil {
+				Expect(reply).To(Equal("PONG"))
+			}
+			return err
+		}
+
+		BeforeEach(func() {
+			var err error
+			cluster, err = summitdbtest.NewCluster(1)
+			Expect(err).NotTo(HaveOccurred())
+
+			p = startClusterProxy(&Config{LoadBalancer: loadBalancer{MaxIdle: 4, Routing: true}}, cluster)
+		})
+
+		AfterEach(func() {
+			ln.Close()
+			dl.Release()
+			Eventually(served).Should(BeClosed())
+			p.close()
+			Expect(cluster.Close()).To(Succeed())
+		})
+
+		It("should serve TLS clients and reject plaintext ones", func() {
+			start(listenerTLS{Cert: server.certFile, Key: server.keyFile})
+
+			Expect(ping(dial(nil))).To(Succeed())
+			Expect(ping(dial(client))).To(Succeed())
+
+			Expect(ping(redis.Dial("tcp", ln.Addr().String(), redis.DialReadTimeout(time.Second)))).NotTo(Succeed())
+		})
+
+		It("should require client certificates signed by the client CA", func() {
+			start(listenerTLS{Cert: server.certFile, Key: server.keyFile, ClientCA: ca.certFile})
+
+			Expect(ping(dial(client))).To(Succeed())
+			Expect(ping(dial(nil))).NotTo(Succeed())
+
+			// a certificate of another CA
+			other := writeTestCert(dir, "other", writeTestCert(dir, "otherca", nil))
+			Expect(ping(dial(other))).NotTo(Succeed())
+		})
+	})
+})
@@ -8,6 +8,7 @@ import (
 
 	"github.com/gomodule/redigo/redis"
 	"github.com/masomo/summitdb-balancer/balancer"
+	"github.com/semihalev/log"
 	"github.com/tidwall/redcon"
 )
 
@@ -71,6 +72,26 @@ func qcmdlower(n []byte) string {
 	return strings.ToLower(string(n))
 }
 
+func writeReply(conn redcon.Conn, reply interface{}) {
+	switch val := reply.(type) {
+	case redis.Error:
+		conn.WriteError(string(val))
+	case string:
+		conn.WriteString(val)
+	case []byte:
+		conn.WriteBulk(val)
+	case int64:
+		conn.WriteInt64(val)
+	case []interface{}:
+		writeArray(conn, val)
+	case nil:
+		conn.WriteNull()
+	default:
+		log.Debug("Invalid response from backend", "response-type", reflect.TypeOf(reply))
+		conn.WriteError("ERR invalid response")
+	}
+}
+
 func writeArray(conn redcon.Conn, val []interface{}) {
 	conn.WriteArray(len(val))
 
@@ -172,31 +193,65 @@ func buildCommand(args [][]byte) redcon.Command {
 	return ncmd
 }
 
+func commandArgs(cmd redcon.Command) []interface{} {
+	args := make([]interface{}, 0, len(cmd.Args)-1)
+	for _, arg := range cmd.Args[1:] {
+		args = append(args, arg)
+	}
+	return args
+}
+
+// doWithDeadline runs the command on a backend connection, the reply must
+// arrive within the command timeout when one is set
+func doWithDeadline(c redis.Conn, name string, args ...interface{}) (interface{}, error) {
+	if timeout := getConfig().LoadBalancer.CommandTimeout; timeout > 0 {
+		return redis.DoWithTimeout(c, timeout, name, args...)
+	}
+	return c.Do(name, args...)
+}
+
+// receiveWithDeadline receives a pipelined reply within the command timeout
+func receiveWithDeadline(c redis.Conn) (interface{}, error) {
+	if timeout := getConfig().LoadBalancer.CommandTimeout; timeout > 0 {
+		return redis.ReceiveWithTimeout(c, timeout)
+	}
+	return c.Receive()
+}
+
+// backendReply turns error replies, which redigo returns as errors, back
+// into replies so only connection errors are left as errors
+func backendReply(reply interface{}, err error) (interface{}, error) {
+	if e, ok := err.(redis.Error); ok {
+		return e, nil
+	}
+	return reply, err
+}
+
+// redirectAddr returns the leader address from a SummitDB "TRY <addr>" reply
+func redirectAddr(reply interface{}) (string, bool) {
+	err, ok := reply.(redis.Error)
+	if !ok || !strings.HasPrefix(string(err), "TRY ") {
+		return "", false
+	}
+
+	addr := strings.TrimSpace(string(err)[4:])
+	return addr, addr != ""
+}
+
 func respPipeline(conn redcon.Conn, pn int, err error) {
 	if err != nil {
 		if conn != nil {
-			for i := 0; i < pn-1; i++ {
-				conn.WriteError(err.Error())
+			for i := 0; i < pn; i++ {
+				conn.WriteError(clientError(err))
 			}
 		}
 	}
 }
 
 func modeFromString(modeString string) balancer.BalanceMode {
-	switch modeString {
-	case "leastconn":
-		return balancer.ModeLeastConn
-	case "firstup":
-		return balancer.ModeFirstUp
-	case "minlatency":
-		return balancer.ModeMinLatency
-	case "random":
-		return balancer.ModeRandom
-	case "weightedlatency":
-		return balancer.ModeWeightedLatency
-	case "roundrobin":
-		return balancer.ModeRoundRobin
-	default:
+	mode, err := balancer.ParseMode(modeString)
+	if err != nil {
 		return balancer.ModeLeastConn
 	}
+	return mode
 }